@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/coreos/coreos-kubernetes/multi-node/aws/pkg/cluster"
+	"github.com/coreos/coreos-kubernetes/multi-node/aws/pkg/config"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdCerts = &cobra.Command{
+		Use:   "certs",
+		Short: "Manage the cluster's TLS certificates",
+		Long:  ``,
+	}
+
+	cmdCertsRotate = &cobra.Command{
+		Use:   "rotate",
+		Short: "Re-issue the cluster's certificates from its CA and update the cluster",
+		Long:  ``,
+		Run:   runCmdCertsRotate,
+	}
+
+	certsRotateOpts = struct {
+		awsDebug bool
+		newKeys  bool
+		timeout  time.Duration
+	}{}
+
+	cmdCertsStatus = &cobra.Command{
+		Use:   "status",
+		Short: "Report on the cluster's certificates and their expiry",
+		Long:  ``,
+		Run:   runCmdCertsStatus,
+	}
+
+	certsStatusOpts = struct {
+		expiringWithin time.Duration
+		output         string
+	}{}
+
+	cmdCertsImport = &cobra.Command{
+		Use:   "import",
+		Short: "Add certificates signed by an external CA to the cluster assets",
+		Long:  ``,
+		Run:   runCmdCertsImport,
+	}
+
+	certsImportOpts = struct {
+		certDir string
+	}{}
+
+	cmdCertsRevoke = &cobra.Command{
+		Use:   "revoke <name|serial>",
+		Short: "Record a certificate signed by the cluster's CA as revoked and re-generate the CRL",
+		Long: `Records the certificate as revoked and re-generates ./credentials/crl.pem, for
+clients and proxies that check it. kube-apiserver and etcd cannot be given a
+CRL, so the certificate keeps working against the cluster until it expires.
+Replace the CA to lock it out sooner.
+
+The serial number is read as printed by openssl, in hexadecimal with the
+serial= prefix of "openssl x509 -serial" or colon separated, or with 0x. Serial
+numbers of decimal digits only are read as decimal, as printed by kube-aws.`,
+		Run: runCmdCertsRevoke,
+	}
+
+	cmdCertsIssueUser = &cobra.Command{
+		Use:   "issue-user",
+		Short: "Issue a client certificate and kubeconfig for a named user",
+		Long:  ``,
+		Run:   runCmdCertsIssueUser,
+	}
+
+	certsIssueUserOpts = struct {
+		name   string
+		groups []string
+	}{}
+)
+
+func init() {
+	cmdRoot.AddCommand(cmdCerts)
+	cmdCerts.AddCommand(cmdCertsRotate)
+	cmdCertsRotate.Flags().DurationVar(&certsRotateOpts.timeout, "timeout", 0, "give up waiting on the stack after this long, leaving the operation to CloudFormation (0 waits indefinitely)")
+	cmdCertsRotate.Flags().BoolVar(&certsRotateOpts.awsDebug, "aws-debug", false, "Log debug information from aws-sdk-go library")
+	cmdCertsRotate.Flags().BoolVar(&certsRotateOpts.newKeys, "new-keys", false, "generate new keys for the certificates instead of re-signing the existing ones (the service account key is kept)")
+	cmdCerts.AddCommand(cmdCertsStatus)
+	cmdCertsStatus.Flags().DurationVar(&certsStatusOpts.expiringWithin, "expiring-within", 30*24*time.Hour, "flag certificates expiring within this duration")
+	cmdCertsStatus.Flags().StringVar(&certsStatusOpts.output, "output", "text", "output format, text or json")
+	cmdCerts.AddCommand(cmdCertsImport)
+	cmdCertsImport.Flags().StringVar(&certsImportOpts.certDir, "cert-dir", "", "directory holding ca.pem and the signed certificates, named after their requests (apiserver.csr is signed into apiserver.pem)")
+	cmdCerts.AddCommand(cmdCertsRevoke)
+	cmdCerts.AddCommand(cmdCertsIssueUser)
+	cmdCertsIssueUser.Flags().StringVar(&certsIssueUserOpts.name, "name", "", "name of the user, the certificate's common name")
+	cmdCertsIssueUser.Flags().StringSliceVar(&certsIssueUserOpts.groups, "group", nil, "group of the user, the certificate's organization (may be repeated)")
+}
+
+func runCmdCertsRotate(cmd *cobra.Command, args []string) {
+	cfg, err := config.NewConfigFromFile(ConfigPath)
+	if err != nil {
+		stderr("Unable to load cluster config: %v", err)
+		os.Exit(1)
+	}
+
+	if err := cfg.ReadAssetsFromFiles(); err != nil {
+		stderr("Error reading assets from files: %v", err)
+		os.Exit(1)
+	}
+
+	if err := cfg.RotateTLSAssets(certsRotateOpts.newKeys); err != nil {
+		stderr("Error rotating certificates: %v", err)
+		os.Exit(1)
+	}
+	fmt.Println("Re-issued the certificates in ./credentials")
+
+	caCert, err := cfg.TLSConfig.CACertificate()
+	if err != nil {
+		stderr("%v", err)
+		os.Exit(1)
+	}
+	if caCert.NotAfter.Before(time.Now().Add(cfg.TLS.Validity())) {
+		fmt.Printf("WARNING: the CA certificate expires on %s, before the re-issued certificates. Re-render the cluster assets to replace it.\n", caCert.NotAfter.Format(time.RFC3339))
+	}
+
+	cluster := cluster.New(cfg, certsRotateOpts.awsDebug)
+	if err := cluster.EncryptWorkerSignerKey(); err != nil {
+		stderr("Error encrypting worker signer key: %v", err)
+		os.Exit(1)
+	}
+
+	if err := cfg.TemplateAndEncodeAssets(); err != nil {
+		stderr("Error templating assets: %v", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := waitContext(certsRotateOpts.timeout)
+	defer cancel()
+	if err := cluster.Update(ctx); err != nil {
+		stderr("Error updating cluster: %v", err)
+		stderr("The re-issued certificates are kept in ./credentials, roll them out with \"kube-aws up --update\"")
+		os.Exit(1)
+	}
+
+	info, err := cluster.Info()
+	if err != nil {
+		stderr("Failed fetching cluster info: %v", err)
+		os.Exit(1)
+	}
+
+	fmt.Print(info.String())
+}
+
+func runCmdCertsStatus(cmd *cobra.Command, args []string) {
+	if certsStatusOpts.output != "text" && certsStatusOpts.output != "json" {
+		stderr("Unknown output format %q, expected text or json", certsStatusOpts.output)
+		os.Exit(1)
+	}
+
+	cfg, err := config.NewConfigFromFile(ConfigPath)
+	if err != nil {
+		stderr("Unable to load cluster config: %v", err)
+		os.Exit(1)
+	}
+
+	if err := cfg.ReadAssetsFromFiles(); err != nil {
+		stderr("Error reading assets from files: %v", err)
+		os.Exit(1)
+	}
+
+	statuses := cfg.TLSConfig.CertificateStatuses(certsStatusOpts.expiringWithin)
+
+	if certsStatusOpts.output == "json" {
+		out, err := json.MarshalIndent(statuses, "", "  ")
+		if err != nil {
+			stderr("Error encoding certificate status: %v", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(out))
+		return
+	}
+
+	for i, status := range statuses {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Print(status.String())
+	}
+}
+
+func runCmdCertsImport(cmd *cobra.Command, args []string) {
+	if certsImportOpts.certDir == "" {
+		stderr("--cert-dir must be given")
+		os.Exit(1)
+	}
+
+	cfg, err := config.NewConfigFromFile(ConfigPath)
+	if err != nil {
+		stderr("Unable to load cluster config: %v", err)
+		os.Exit(1)
+	}
+
+	if err := cfg.ImportCertificates(certsImportOpts.certDir); err != nil {
+		stderr("Error importing certificates: %v", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Imported the certificates into ./credentials. Use the \"kube-aws up\" command to create the stack")
+}
+
+func runCmdCertsRevoke(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		stderr("Expected the name of a certificate in ./credentials (e.g. admin.pem) or a serial number")
+		os.Exit(1)
+	}
+
+	cfg, err := config.NewConfigFromFile(ConfigPath)
+	if err != nil {
+		stderr("Unable to load cluster config: %v", err)
+		os.Exit(1)
+	}
+
+	if err := cfg.ReadAssetsFromFiles(); err != nil {
+		stderr("Error reading assets from files: %v", err)
+		os.Exit(1)
+	}
+
+	revoked, err := cfg.RevokeCertificate(args[0])
+	if err != nil {
+		stderr("Error revoking certificate: %v", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Revoked serial number %s and re-generated ./credentials/crl.pem\n", revoked.SerialNumber)
+	if revoked.Name != "" {
+		fmt.Printf("%s is still in ./credentials, use the \"kube-aws certs rotate\" command to replace it\n", revoked.Name)
+	}
+	stderr("Warning: kube-apiserver and etcd cannot be given the CRL, so the certificate keeps working against the cluster until it expires. To lock it out now, replace the CA (see \"Updating SSL assets\" in the README)")
+}
+
+func runCmdCertsIssueUser(cmd *cobra.Command, args []string) {
+	if certsIssueUserOpts.name == "" {
+		stderr("--name must be given")
+		os.Exit(1)
+	}
+
+	cfg, err := config.NewConfigFromFile(ConfigPath)
+	if err != nil {
+		stderr("Unable to load cluster config: %v", err)
+		os.Exit(1)
+	}
+
+	if err := cfg.ReadAssetsFromFiles(); err != nil {
+		stderr("Error reading assets from files: %v", err)
+		os.Exit(1)
+	}
+
+	cert, err := cfg.IssueUserCertificate(certsIssueUserOpts.name, certsIssueUserOpts.groups)
+	if err != nil {
+		stderr("Error issuing user certificate: %v", err)
+		os.Exit(1)
+	}
+
+	name := certsIssueUserOpts.name
+	fmt.Printf("Issued a certificate for %s with serial number %s, valid until %s\n", name, cert.SerialNumber, cert.NotAfter.Format(time.RFC3339))
+	fmt.Printf("Hand ./credentials/kubeconfig-%s, user-%s.pem, user-%s-key.pem and ca.pem over to the user, to be kept in the same directory\n", name, name, name)
+	if cfg.CredentialsEncryption != nil {
+		fmt.Printf("The key is encrypted as user-%s-key.pem%s, decrypt it with age first\n", name, config.EncryptedSuffix)
+	}
+}
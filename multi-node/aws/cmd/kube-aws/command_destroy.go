@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/coreos/coreos-kubernetes/multi-node/aws/pkg/cluster"
 	"github.com/coreos/coreos-kubernetes/multi-node/aws/pkg/config"
@@ -17,13 +18,16 @@ var (
 		Run:   runCmdDestroy,
 	}
 	destroyOpts = struct {
-		awsDebug bool
+		awsDebug, force bool
+		timeout         time.Duration
 	}{}
 )
 
 func init() {
 	cmdRoot.AddCommand(cmdDestroy)
 	cmdDestroy.Flags().BoolVar(&destroyOpts.awsDebug, "aws-debug", false, "Log debug information from aws-sdk-go library")
+	cmdDestroy.Flags().DurationVar(&destroyOpts.timeout, "timeout", 0, "give up waiting on the stack after this long, leaving the operation to CloudFormation (0 waits indefinitely)")
+	cmdDestroy.Flags().BoolVar(&destroyOpts.force, "force", false, "don't ask for the cluster name before destroying it")
 }
 
 func runCmdDestroy(cmd *cobra.Command, args []string) {
@@ -33,9 +37,19 @@ func runCmdDestroy(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
+	if !destroyOpts.force {
+		prompt := fmt.Sprintf("This deletes cluster %s and all of its resources, including etcd's data. Type the cluster name to confirm: ", cfg.ClusterName)
+		if !confirm(prompt, cfg.ClusterName) {
+			stderr("Cluster name not confirmed, leaving the cluster alone")
+			os.Exit(1)
+		}
+	}
+
 	cluster := cluster.New(cfg, destroyOpts.awsDebug)
 
-	if err := cluster.Destroy(); err != nil {
+	ctx, cancel := waitContext(destroyOpts.timeout)
+	defer cancel()
+	if err := cluster.Destroy(ctx); err != nil {
 		stderr("Failed destroying cluster: %v", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/coreos/coreos-kubernetes/multi-node/aws/pkg/cluster"
+	"github.com/coreos/coreos-kubernetes/multi-node/aws/pkg/config"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdPlan = &cobra.Command{
+		Use:   "plan",
+		Short: "Show the changes \"up --update\" would make to the cluster's stack",
+		Long:  ``,
+		Run:   runCmdPlan,
+	}
+
+	planOpts = struct {
+		awsDebug bool
+		timeout  time.Duration
+	}{}
+)
+
+func init() {
+	cmdRoot.AddCommand(cmdPlan)
+	cmdPlan.Flags().DurationVar(&planOpts.timeout, "timeout", 0, "give up waiting on the change set after this long (0 waits indefinitely)")
+	cmdPlan.Flags().BoolVar(&planOpts.awsDebug, "aws-debug", false, "Log debug information from aws-sdk-go library")
+}
+
+func runCmdPlan(cmd *cobra.Command, args []string) {
+	cfg, err := config.NewConfigFromFile(ConfigPath)
+	if err != nil {
+		stderr("Unable to load cluster config: %v", err)
+		os.Exit(1)
+	}
+
+	if err := cfg.ReadAssetsFromFiles(); err != nil {
+		stderr("Error reading assets from files: %v", err)
+		os.Exit(1)
+	}
+
+	cluster := cluster.New(cfg, planOpts.awsDebug)
+	if err := cluster.EncryptWorkerSignerKey(); err != nil {
+		stderr("Error encrypting worker signer key: %v", err)
+		os.Exit(1)
+	}
+
+	if err := cfg.TemplateAndEncodeAssets(); err != nil {
+		stderr("Error templating assets: %v", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := waitContext(planOpts.timeout)
+	defer cancel()
+	plan, err := cluster.Plan(ctx)
+	if err != nil {
+		stderr("Error planning update: %v", err)
+		os.Exit(1)
+	}
+	fmt.Print(plan.String())
+
+	//the change set only serves to compute the plan
+	if err := cluster.DiscardPlan(plan); err != nil {
+		stderr("%v", err)
+		os.Exit(1)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 
 	"github.com/coreos/coreos-kubernetes/multi-node/aws/pkg/config"
@@ -15,10 +16,18 @@ var (
 		Long:  ``,
 		Run:   runCmdRender,
 	}
+
+	renderOpts = struct {
+		caCertPath, caKeyPath string
+		generateCSRs          bool
+	}{}
 )
 
 func init() {
 	cmdRoot.AddCommand(cmdRender)
+	cmdRender.Flags().StringVar(&renderOpts.caCertPath, "ca-cert-path", "", "path to an existing CA certificate (PEM, optionally followed by its chain) to sign the cluster's certificates with")
+	cmdRender.Flags().StringVar(&renderOpts.caKeyPath, "ca-key-path", "", "path to the private key (PEM) of the CA given by --ca-cert-path")
+	cmdRender.Flags().BoolVar(&renderOpts.generateCSRs, "generate-csrs", false, "write certificate signing requests for an external CA to sign instead of certificates")
 }
 
 func runCmdRender(cmd *cobra.Command, args []string) {
@@ -28,12 +37,40 @@ func runCmdRender(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
+	if (renderOpts.caCertPath == "") != (renderOpts.caKeyPath == "") {
+		stderr("--ca-cert-path and --ca-key-path must be given together")
+		os.Exit(1)
+	}
+	if renderOpts.generateCSRs && renderOpts.caCertPath != "" {
+		stderr("--generate-csrs and --ca-cert-path cannot be used together")
+		os.Exit(1)
+	}
+	if renderOpts.generateCSRs {
+		cfg.TLSConfig.UseExternalCA()
+	}
+	if renderOpts.caCertPath != "" {
+		caCertPEM, err := ioutil.ReadFile(renderOpts.caCertPath)
+		if err != nil {
+			stderr("Error reading CA certificate: %v", err)
+			os.Exit(1)
+		}
+		caKeyPEM, err := ioutil.ReadFile(renderOpts.caKeyPath)
+		if err != nil {
+			stderr("Error reading CA key: %v", err)
+			os.Exit(1)
+		}
+		if err := cfg.TLSConfig.ImportCA(caCertPEM, caKeyPEM); err != nil {
+			stderr("Error importing CA: %v", err)
+			os.Exit(1)
+		}
+	}
+
 	if err := cfg.GenerateDefaultAssets(); err != nil {
 		stderr("Error generating default assets : %v", err)
 		os.Exit(1)
 	}
 
-	if err := cfg.KubeConfig.Template(cfg); err != nil {
+	if err := cfg.TemplateKubeConfig(); err != nil {
 		stderr("Error templating kubeconfig : %v", err)
 		os.Exit(1)
 	}
@@ -43,5 +80,8 @@ func runCmdRender(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
+	if renderOpts.generateCSRs {
+		fmt.Println("Have your CA sign the certificate signing requests (*.csr) in ./credentials. Then use the \"kube-aws certs import\" command to add the signed certificates")
+	}
 	fmt.Printf("Edit %s and/or any of the cluster assets. Then use the \"kube-aws up\" command to create the stack\n", ConfigPath)
 }
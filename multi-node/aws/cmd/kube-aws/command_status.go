@@ -1,12 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 
 	"github.com/coreos/coreos-kubernetes/multi-node/aws/pkg/cluster"
 	"github.com/coreos/coreos-kubernetes/multi-node/aws/pkg/config"
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
 )
 
 var (
@@ -16,13 +18,23 @@ var (
 		Long:  ``,
 		Run:   runCmdStatus,
 	}
+
+	statusOpts = struct {
+		output string
+	}{}
 )
 
 func init() {
 	cmdRoot.AddCommand(cmdStatus)
+	cmdStatus.Flags().StringVar(&statusOpts.output, "output", "text", "output format, text, json or yaml")
 }
 
 func runCmdStatus(cmd *cobra.Command, args []string) {
+	if statusOpts.output != "text" && statusOpts.output != "json" && statusOpts.output != "yaml" {
+		stderr("Unknown output format %q, expected text, json or yaml", statusOpts.output)
+		os.Exit(1)
+	}
+
 	cfg, err := config.NewConfigFromFile(ConfigPath)
 	if err != nil {
 		stderr("Error parsing config: %v", err)
@@ -37,5 +49,22 @@ func runCmdStatus(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
-	fmt.Print(info.String())
+	switch statusOpts.output {
+	case "json":
+		out, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			stderr("Error encoding cluster info: %v", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(out))
+	case "yaml":
+		out, err := yaml.Marshal(info)
+		if err != nil {
+			stderr("Error encoding cluster info: %v", err)
+			os.Exit(1)
+		}
+		fmt.Print(string(out))
+	default:
+		fmt.Print(info.String())
+	}
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"time"
 
 	"github.com/coreos/coreos-kubernetes/multi-node/aws/pkg/cluster"
 	"github.com/coreos/coreos-kubernetes/multi-node/aws/pkg/config"
@@ -19,7 +20,8 @@ var (
 	}
 
 	upOpts = struct {
-		awsDebug, export, update bool
+		awsDebug, export, update, plan bool
+		timeout                        time.Duration
 	}{}
 )
 
@@ -27,10 +29,17 @@ func init() {
 	cmdRoot.AddCommand(cmdUp)
 	cmdUp.Flags().BoolVar(&upOpts.export, "export", false, "don't create cluster. instead export cloudformation stack file")
 	cmdUp.Flags().BoolVar(&upOpts.update, "update", false, "update existing cluster with new cloudformation stack")
+	cmdUp.Flags().BoolVar(&upOpts.plan, "plan", false, "with --update, show the changes to the stack and ask before making them")
+	cmdUp.Flags().DurationVar(&upOpts.timeout, "timeout", 0, "give up waiting on the stack after this long, leaving the operation to CloudFormation (0 waits indefinitely)")
 	cmdUp.Flags().BoolVar(&upOpts.awsDebug, "aws-debug", false, "Log debug information from aws-sdk-go library")
 }
 
 func runCmdUp(cmd *cobra.Command, args []string) {
+	if upOpts.plan && !upOpts.update {
+		stderr("--plan can only be used with --update")
+		os.Exit(1)
+	}
+
 	cfg, err := config.NewConfigFromFile(ConfigPath)
 	if err != nil {
 		stderr("Unable to load cluster config: %v", err)
@@ -42,29 +51,51 @@ func runCmdUp(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
+	cluster := cluster.New(cfg, upOpts.awsDebug)
+	if err := cluster.EncryptWorkerSignerKey(); err != nil {
+		stderr("Error encrypting worker signer key: %v", err)
+		os.Exit(1)
+	}
+
 	if err := cfg.TemplateAndEncodeAssets(); err != nil {
 		stderr("Error templating assets: %v", err)
 		os.Exit(1)
 	}
 	if upOpts.export {
 		templatePath := fmt.Sprintf("./%s.stack-template.json", cfg.ClusterName)
+		data := cfg.StackTemplate.Bytes()
+		if cfg.CredentialsEncryption != nil {
+			templatePath += config.EncryptedSuffix
+			if data, err = cfg.CredentialsEncryption.Encrypt(data); err != nil {
+				stderr("Error encrypting %s : %v", templatePath, err)
+				os.Exit(1)
+			}
+		}
 		fmt.Printf("Exporting %s\n", templatePath)
-		if err := ioutil.WriteFile(templatePath, cfg.StackTemplate.Bytes(), 0600); err != nil {
+		if err := ioutil.WriteFile(templatePath, data, 0600); err != nil {
 			stderr("Error writing %s : %v", templatePath, err)
 			os.Exit(1)
 		}
-		fmt.Printf("BEWARE: %s contains your TLS secrets!\n", templatePath)
+		if cfg.CredentialsEncryption == nil {
+			fmt.Printf("BEWARE: %s contains your TLS secrets!\n", templatePath)
+		}
 		os.Exit(0)
 	}
-	cluster := cluster.New(cfg, upOpts.awsDebug)
-
-	if upOpts.update {
-		if err := cluster.Update(); err != nil {
+	if upOpts.plan {
+		if !runPlan(cluster, upOpts.timeout) {
+			os.Exit(0)
+		}
+	} else if upOpts.update {
+		ctx, cancel := waitContext(upOpts.timeout)
+		defer cancel()
+		if err := cluster.Update(ctx); err != nil {
 			stderr("Error updating cluster: %v", err)
 			os.Exit(1)
 		}
 	} else {
-		if err := cluster.Create(); err != nil {
+		ctx, cancel := waitContext(upOpts.timeout)
+		defer cancel()
+		if err := cluster.Create(ctx); err != nil {
 			stderr("Error creating cluster: %v", err)
 			os.Exit(1)
 		}
@@ -79,3 +110,35 @@ func runCmdUp(cmd *cobra.Command, args []string) {
 	fmt.Print(info.String())
 
 }
+
+// runPlan shows the changes the update makes to the stack, and makes them
+// once the user agrees. It reports whether the stack was updated. Planning
+// and updating are each given timeout, but not the user's answer.
+func runPlan(c *cluster.Cluster, timeout time.Duration) bool {
+	ctx, cancel := waitContext(timeout)
+	plan, err := c.Plan(ctx)
+	//SIGINT exits again while the user is asked
+	cancel()
+	if err != nil {
+		stderr("Error planning update: %v", err)
+		os.Exit(1)
+	}
+	fmt.Print(plan.String())
+
+	if len(plan.Changes) == 0 || !confirm("\nType yes to update the stack with these changes: ", "yes") {
+		if err := c.DiscardPlan(plan); err != nil {
+			stderr("%v", err)
+			os.Exit(1)
+		}
+		fmt.Println("Left the stack unchanged")
+		return false
+	}
+
+	ctx, cancel = waitContext(timeout)
+	defer cancel()
+	if err := c.ExecutePlan(ctx, plan); err != nil {
+		stderr("Error updating cluster: %v", err)
+		os.Exit(1)
+	}
+	return true
+}
@@ -34,13 +34,17 @@ func runCmdValidate(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
+	cluster := cluster.New(cfg, upOpts.awsDebug)
+	if err := cluster.EncryptWorkerSignerKey(); err != nil {
+		stderr("Error encrypting worker signer key: %v", err)
+		os.Exit(1)
+	}
+
 	if err := cfg.TemplateAndEncodeAssets(); err != nil {
 		stderr("template/encode error: %v", err)
 		os.Exit(1)
 	}
 
-	cluster := cluster.New(cfg, upOpts.awsDebug)
-
 	report, err := cluster.ValidateStack()
 
 	if report != "" {
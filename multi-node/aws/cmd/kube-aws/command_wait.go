@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/coreos/coreos-kubernetes/multi-node/aws/pkg/cluster"
+	"github.com/coreos/coreos-kubernetes/multi-node/aws/pkg/config"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdWait = &cobra.Command{
+		Use:   "wait",
+		Short: "Wait for the operation in progress on the cluster's stack to finish",
+		Long:  ``,
+		Run:   runCmdWait,
+	}
+
+	waitOpts = struct {
+		awsDebug bool
+		timeout  time.Duration
+	}{}
+)
+
+func init() {
+	cmdRoot.AddCommand(cmdWait)
+	cmdWait.Flags().DurationVar(&waitOpts.timeout, "timeout", 0, "give up waiting on the stack after this long (0 waits indefinitely)")
+	cmdWait.Flags().BoolVar(&waitOpts.awsDebug, "aws-debug", false, "Log debug information from aws-sdk-go library")
+}
+
+func runCmdWait(cmd *cobra.Command, args []string) {
+	cfg, err := config.NewConfigFromFile(ConfigPath)
+	if err != nil {
+		stderr("Unable to load cluster config: %v", err)
+		os.Exit(1)
+	}
+
+	cluster := cluster.New(cfg, waitOpts.awsDebug)
+
+	ctx, cancel := waitContext(waitOpts.timeout)
+	defer cancel()
+	status, err := cluster.Wait(ctx)
+	if err != nil {
+		stderr("Error waiting for cluster: %v", err)
+		os.Exit(1)
+	}
+
+	if status == cloudformation.StackStatusDeleteComplete {
+		fmt.Println("Destroyed cluster")
+		return
+	}
+
+	info, err := cluster.Info()
+	if err != nil {
+		stderr("Failed fetching cluster info: %v", err)
+		os.Exit(1)
+	}
+
+	fmt.Print(info.String())
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -24,3 +29,42 @@ func main() {
 func stderr(msg string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, msg+"\n", args...)
 }
+
+// confirm prints prompt and reports whether the line the user answers
+// with is answer
+func confirm(prompt, answer string) bool {
+	fmt.Print(prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		fmt.Println()
+		return false
+	}
+	return strings.TrimSpace(line) == answer
+}
+
+// waitContext returns the context stack operations are waited on with. It
+// is done on SIGINT, or once timeout passes unless it is zero. A second
+// SIGINT kills the command.
+func waitContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	interrupted, interrupt := context.WithCancel(context.Background())
+	ctx, cancel := interrupted, interrupt
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(interrupted, timeout)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		select {
+		case <-signals:
+			interrupt()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+
+	return ctx, func() {
+		cancel()
+		interrupt()
+	}
+}
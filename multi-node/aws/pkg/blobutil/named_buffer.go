@@ -57,12 +57,12 @@ func (buf *NamedBuffer) Template(data interface{}) error {
 
 func (buf *NamedBuffer) WriteToFile(dirPath string) error {
 	path := filepath.Join(dirPath, buf.Name)
-	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
 	if err != nil {
 		return fmt.Errorf("Error opening %s : %v", path, err)
 	}
 	defer out.Close()
-	if _, err := buf.WriteTo(out); err != nil {
+	if _, err := out.Write(buf.Bytes()); err != nil {
 		return fmt.Errorf("Error writing %s : %v", path, err)
 	}
 
@@ -2,14 +2,18 @@ package cluster
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"text/tabwriter"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/cloudformation"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/kms"
 
 	"github.com/coreos/coreos-kubernetes/multi-node/aws/pkg/config"
 )
@@ -18,8 +22,43 @@ import (
 var VERSION = "UNKNOWN"
 
 type ClusterInfo struct {
-	Name         string
-	ControllerIP string
+	Name                string `json:"name" yaml:"name"`
+	StackStatus         string `json:"stackStatus" yaml:"stackStatus"`
+	LastUpdated         string `json:"lastUpdated" yaml:"lastUpdated"`
+	APIServerEndpoint   string `json:"apiServerEndpoint" yaml:"apiServerEndpoint"`
+	ControllerIP        string `json:"controllerIP" yaml:"controllerIP"`
+	LoadBalancerDNSName string `json:"loadBalancerDNSName,omitempty" yaml:"loadBalancerDNSName,omitempty"`
+
+	Instances         []*InstanceInfo         `json:"instances" yaml:"instances"`
+	AutoScalingGroups []*AutoScalingGroupInfo `json:"autoScalingGroups" yaml:"autoScalingGroups"`
+}
+
+// InstanceInfo describes one of the cluster's nodes, either created by the
+// stack or launched by one of its auto scaling groups
+type InstanceInfo struct {
+	// Name is the instance's name in the stack (e.g. Controller1), or the
+	// name of its auto scaling group's pool (e.g. Worker)
+	Name             string `json:"name" yaml:"name"`
+	Role             string `json:"role" yaml:"role"`
+	ID               string `json:"id" yaml:"id"`
+	PrivateIP        string `json:"privateIP" yaml:"privateIP"`
+	PublicIP         string `json:"publicIP,omitempty" yaml:"publicIP,omitempty"`
+	AvailabilityZone string `json:"availabilityZone" yaml:"availabilityZone"`
+	State            string `json:"state" yaml:"state"`
+	LaunchTime       string `json:"launchTime" yaml:"launchTime"`
+	// Health is the auto scaling group's view of the instance
+	Health string `json:"health,omitempty" yaml:"health,omitempty"`
+}
+
+// AutoScalingGroupInfo describes the size of one of the cluster's auto
+// scaling groups
+type AutoScalingGroupInfo struct {
+	Name      string `json:"name" yaml:"name"`
+	ID        string `json:"id" yaml:"id"`
+	Desired   int64  `json:"desired" yaml:"desired"`
+	Min       int64  `json:"min" yaml:"min"`
+	Max       int64  `json:"max" yaml:"max"`
+	InService int64  `json:"inService" yaml:"inService"`
 }
 
 func (c *ClusterInfo) String() string {
@@ -28,12 +67,44 @@ func (c *ClusterInfo) String() string {
 	w.Init(buf, 0, 8, 0, '\t', 0)
 
 	fmt.Fprintf(w, "Cluster Name:\t%s\n", c.Name)
+	fmt.Fprintf(w, "Stack Status:\t%s (last updated %s)\n", c.StackStatus, c.LastUpdated)
+	fmt.Fprintf(w, "API Server Endpoint:\t%s\n", c.APIServerEndpoint)
 	fmt.Fprintf(w, "Controller IP:\t%s\n", c.ControllerIP)
-
+	if c.LoadBalancerDNSName != "" {
+		fmt.Fprintf(w, "API Server Load Balancer:\t%s\n", c.LoadBalancerDNSName)
+	}
 	w.Flush()
+
+	if len(c.Instances) > 0 {
+		w.Init(buf, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(buf, "\nInstances:\n")
+		fmt.Fprintf(w, "NAME\tROLE\tID\tPRIVATE IP\tPUBLIC IP\tZONE\tSTATE\tHEALTH\tLAUNCHED\n")
+		for _, i := range c.Instances {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", i.Name, i.Role, i.ID, i.PrivateIP, orDash(i.PublicIP), i.AvailabilityZone, i.State, orDash(i.Health), i.LaunchTime)
+		}
+		w.Flush()
+	}
+
+	if len(c.AutoScalingGroups) > 0 {
+		w.Init(buf, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(buf, "\nAuto Scaling Groups:\n")
+		fmt.Fprintf(w, "NAME\tID\tDESIRED\tMIN\tMAX\tIN SERVICE\n")
+		for _, g := range c.AutoScalingGroups {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\n", g.Name, g.ID, g.Desired, g.Min, g.Max, g.InService)
+		}
+		w.Flush()
+	}
+
 	return buf.String()
 }
 
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
 func New(cfg *config.Config, awsDebug bool) *Cluster {
 
 	//Set up AWS config
@@ -73,6 +144,12 @@ func (c *Cluster) getStackBody() (string, error) {
 	return string(miniStackBody), nil
 }
 
+// EncryptWorkerSignerKey encrypts the worker signer CA key with KMS, for
+// the controllers to decrypt at boot
+func (c *Cluster) EncryptWorkerSignerKey() error {
+	return c.cfg.EncryptWorkerSignerKey(kms.New(session.New(c.aws)))
+}
+
 func (c *Cluster) ValidateStack() (string, error) {
 
 	stackBody, err := c.getStackBody()
@@ -83,42 +160,103 @@ func (c *Cluster) ValidateStack() (string, error) {
 	return validateStack(cloudformation.New(session.New(c.aws)), stackBody)
 }
 
-func (c *Cluster) Create() error {
+// Create creates the cluster's stack and waits until it is complete, or
+// until ctx is done
+func (c *Cluster) Create(ctx context.Context) error {
 	stackBody, err := c.getStackBody()
 	if err != nil {
 		return err
 	}
-	return createStackAndWait(cloudformation.New(session.New(c.aws)), c.stackName(), stackBody)
+	return createStackAndWait(ctx, cloudformation.New(session.New(c.aws)), c.stackName(), stackBody)
 }
 
-func (c *Cluster) Update() error {
+// Update updates the cluster's stack and waits until it is complete, or
+// until ctx is done
+func (c *Cluster) Update(ctx context.Context) error {
 	stackBody, err := c.getStackBody()
 	if err != nil {
 		return err
 	}
 
-	report, err := updateStack(cloudformation.New(session.New(c.aws)), c.stackName(), stackBody)
+	report, err := updateStack(ctx, cloudformation.New(session.New(c.aws)), c.stackName(), stackBody)
 
 	fmt.Printf("Update stack: %s\n", report)
 	return err
 }
 
-//TODO: validate cluster
+// Plan creates a change set updating the stack to the rendered template,
+// and describes the changes it would make. The change set is kept until
+// it is executed or discarded.
+func (c *Cluster) Plan(ctx context.Context) (*Plan, error) {
+	stackBody, err := c.getStackBody()
+	if err != nil {
+		return nil, err
+	}
+
+	changeSetName := fmt.Sprintf("kube-aws-%s", time.Now().UTC().Format("20060102150405"))
+	return createChangeSet(ctx, cloudformation.New(session.New(c.aws)), c.stackName(), changeSetName, stackBody)
+}
+
+// ExecutePlan updates the stack with the plan's change set, and waits
+// until it is complete, or until ctx is done
+func (c *Cluster) ExecutePlan(ctx context.Context, plan *Plan) error {
+	return executeChangeSet(ctx, cloudformation.New(session.New(c.aws)), plan)
+}
+
+// DiscardPlan deletes the plan's change set, leaving the stack as it is
+func (c *Cluster) DiscardPlan(plan *Plan) error {
+	return deleteChangeSet(cloudformation.New(session.New(c.aws)), plan)
+}
+
+// TODO: validate cluster
 func (c *Cluster) Info() (*ClusterInfo, error) {
-	resources, err := getStackResources(cloudformation.New(session.New(c.aws)), c.stackName())
+	sess := session.New(c.aws)
+	cfSvc := cloudformation.New(sess)
+	stack, err := describeStack(cfSvc, c.stackName())
+	if err != nil {
+		return nil, err
+	}
+
+	resources, err := getStackResources(cfSvc, c.stackName())
 	if err != nil {
 		return nil, err
 	}
 
-	info, err := mapStackResourcesToClusterInfo(ec2.New(session.New(c.aws)), resources)
+	info, err := mapStackResourcesToClusterInfo(resources)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := describeAutoScalingGroups(autoscaling.New(sess), info); err != nil {
+		return nil, err
+	}
+	if err := describeInstances(ec2.New(sess), info); err != nil {
+		return nil, err
+	}
+
+	info.LoadBalancerDNSName = stackOutputs(stack)["APIServerLoadBalancerDNSName"]
+
 	info.Name = c.cfg.ClusterName
+	info.APIServerEndpoint = c.cfg.APIServerEndpoint
+	info.StackStatus = aws.StringValue(stack.StackStatus)
+	lastUpdated := stack.CreationTime
+	if stack.LastUpdatedTime != nil {
+		lastUpdated = stack.LastUpdatedTime
+	}
+	info.LastUpdated = aws.TimeValue(lastUpdated).UTC().Format(time.RFC3339)
 	return info, nil
 }
 
-func (c *Cluster) Destroy() error {
-	return destroyStack(cloudformation.New(session.New(c.aws)), c.stackName())
+// Destroy deletes the cluster's stack and waits until it is gone, or until
+// ctx is done. Stacks not tagged as created by kube-aws for the cluster are
+// left alone.
+func (c *Cluster) Destroy(ctx context.Context) error {
+	return destroyStack(ctx, cloudformation.New(session.New(c.aws)), c.stackName())
+}
+
+// Wait waits for the operation in progress on the cluster's stack, such as
+// one whose command was interrupted, to end. It returns the status of the
+// stack once successful.
+func (c *Cluster) Wait(ctx context.Context) (string, error) {
+	return waitForStackOperation(ctx, cloudformation.New(session.New(c.aws)), c.stackName())
 }
@@ -0,0 +1,118 @@
+package cluster
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+)
+
+// stackEvents prints the events of a stack as they happen, each once, and
+// keeps the first resource that failed
+type stackEvents struct {
+	svc     *cloudformation.CloudFormation
+	stackID string
+	seen    map[string]bool
+
+	firstFailure *cloudformation.StackEvent
+}
+
+func newStackEvents(svc *cloudformation.CloudFormation, stackID string) *stackEvents {
+	return &stackEvents{
+		svc:     svc,
+		stackID: stackID,
+		seen:    map[string]bool{},
+	}
+}
+
+// skipExisting marks the events that already happened as seen, so that
+// only those of the operation about to start get printed
+func (e *stackEvents) skipExisting() error {
+	resp, err := e.svc.DescribeStackEvents(&cloudformation.DescribeStackEventsInput{
+		StackName: aws.String(e.stackID),
+	})
+	if err != nil {
+		return err
+	}
+	for _, event := range resp.StackEvents {
+		e.seen[aws.StringValue(event.EventId)] = true
+	}
+	return nil
+}
+
+// poll prints the events that happened since it was last called, oldest
+// first
+func (e *stackEvents) poll() error {
+	events := []*cloudformation.StackEvent{}
+	req := cloudformation.DescribeStackEventsInput{
+		StackName: aws.String(e.stackID),
+	}
+	//events are listed newest first, so the new ones end where the
+	//events seen before begin
+paging:
+	for {
+		resp, err := e.svc.DescribeStackEvents(&req)
+		if err != nil {
+			return err
+		}
+		for _, event := range resp.StackEvents {
+			id := aws.StringValue(event.EventId)
+			if e.seen[id] {
+				break paging
+			}
+			e.seen[id] = true
+			events = append(events, event)
+		}
+		req.NextToken = resp.NextToken
+		if aws.StringValue(req.NextToken) == "" {
+			break
+		}
+	}
+
+	for i := len(events) - 1; i >= 0; i-- {
+		event := events[i]
+		fmt.Println(formatStackEvent(event))
+		if e.firstFailure == nil && isResourceFailure(event) {
+			e.firstFailure = event
+		}
+	}
+	return nil
+}
+
+// failureSummary describes the first resource that failed, if any
+func (e *stackEvents) failureSummary() string {
+	if e.firstFailure == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s (%s) %s: %s",
+		aws.StringValue(e.firstFailure.LogicalResourceId),
+		aws.StringValue(e.firstFailure.ResourceType),
+		aws.StringValue(e.firstFailure.ResourceStatus),
+		aws.StringValue(e.firstFailure.ResourceStatusReason))
+}
+
+// isResourceFailure reports whether event is a resource failing on its
+// own account, rather than being cancelled because another one failed
+func isResourceFailure(event *cloudformation.StackEvent) bool {
+	if !strings.HasSuffix(aws.StringValue(event.ResourceStatus), "_FAILED") {
+		return false
+	}
+	//the stack itself fails along with its first resource
+	if aws.StringValue(event.ResourceType) == "AWS::CloudFormation::Stack" {
+		return false
+	}
+	return !strings.Contains(aws.StringValue(event.ResourceStatusReason), "cancelled")
+}
+
+func formatStackEvent(event *cloudformation.StackEvent) string {
+	line := fmt.Sprintf("%s  %-36s %-40s %-28s",
+		aws.TimeValue(event.Timestamp).Local().Format("15:04:05"),
+		aws.StringValue(event.LogicalResourceId),
+		aws.StringValue(event.ResourceType),
+		aws.StringValue(event.ResourceStatus))
+	if reason := aws.StringValue(event.ResourceStatusReason); reason != "" {
+		line += " " + reason
+	}
+	return strings.TrimRight(line, " ")
+}
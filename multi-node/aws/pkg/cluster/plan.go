@@ -0,0 +1,87 @@
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"text/tabwriter"
+)
+
+// ResourceChange is a change to one of the stack's resources, as planned
+// by a change set
+type ResourceChange struct {
+	Action       string
+	LogicalID    string
+	PhysicalID   string
+	ResourceType string
+	// Replacement is True, False or Conditional (the resource is replaced
+	// depending on a property only known while updating)
+	Replacement string
+}
+
+// Destructive reports whether the change removes the resource or may
+// replace it, losing whatever state it holds
+func (r *ResourceChange) Destructive() bool {
+	return r.Action == "Remove" || r.Replacement == "True" || r.Replacement == "Conditional"
+}
+
+// Plan is the set of changes a stack update would make, held in a
+// change set until it is executed or discarded
+type Plan struct {
+	StackName     string
+	ChangeSetName string
+	ChangeSetID   string
+	Changes       []*ResourceChange
+}
+
+// statefulResourceTypes are the resource types losing data along with
+// the resource when they are replaced
+var statefulResourceTypes = map[string]string{
+	"AWS::EC2::Volume":   "the volume's data is lost",
+	"AWS::EC2::Instance": "the instance is terminated along with its root volume",
+}
+
+func (p *Plan) String() string {
+	if len(p.Changes) == 0 {
+		return fmt.Sprintf("No changes to stack %s\n", p.StackName)
+	}
+
+	buf := new(bytes.Buffer)
+	w := new(tabwriter.Writer)
+	w.Init(buf, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(buf, "Changes to stack %s (change set %s):\n", p.StackName, p.ChangeSetName)
+	fmt.Fprintf(w, "\tACTION\tLOGICAL ID\tTYPE\tREPLACEMENT\n")
+	destructive := []*ResourceChange{}
+	for _, change := range p.Changes {
+		marker := ""
+		if change.Destructive() {
+			marker = "!"
+			destructive = append(destructive, change)
+		}
+		replacement := change.Replacement
+		if replacement == "" {
+			replacement = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", marker, change.Action, change.LogicalID, change.ResourceType, replacement)
+	}
+	w.Flush()
+
+	if len(destructive) > 0 {
+		fmt.Fprintf(buf, "\n%d of the changes (marked !) remove or replace resources:\n", len(destructive))
+		for _, change := range destructive {
+			what := "replaced"
+			switch {
+			case change.Action == "Remove":
+				what = "removed"
+			case change.Replacement == "Conditional":
+				what = "may be replaced"
+			}
+			fmt.Fprintf(buf, "  %s %s", change.LogicalID, what)
+			if loss, ok := statefulResourceTypes[change.ResourceType]; ok {
+				fmt.Fprintf(buf, ": %s", loss)
+			}
+			fmt.Fprintln(buf)
+		}
+	}
+	return buf.String()
+}
@@ -1,21 +1,39 @@
 package cluster
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/cloudformation"
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
-func createStackAndWait(svc *cloudformation.CloudFormation, name, stackBody string) error {
+// stackTagKey tags the stacks created by kube-aws with the name of their
+// cluster, so that destroy does not delete a stack it did not create
+const stackTagKey = "kube-aws:cluster-name"
+
+func stackTags(name string) []*cloudformation.Tag {
+	return []*cloudformation.Tag{
+		{Key: aws.String(stackTagKey), Value: aws.String(name)},
+	}
+}
+
+// pollInterval is how often the status of stacks and change sets is
+// checked while waiting on them
+const pollInterval = 3 * time.Second
+
+func createStackAndWait(ctx context.Context, svc *cloudformation.CloudFormation, name, stackBody string) error {
 	creq := &cloudformation.CreateStackInput{
 		StackName:    aws.String(name),
 		OnFailure:    aws.String("DO_NOTHING"),
 		Capabilities: []*string{aws.String(cloudformation.CapabilityCapabilityIam)},
 		TemplateBody: aws.String(stackBody),
+		Tags:         stackTags(name),
 	}
 
 	resp, err := svc.CreateStack(creq)
@@ -23,11 +41,8 @@ func createStackAndWait(svc *cloudformation.CloudFormation, name, stackBody stri
 		return err
 	}
 
-	if err := waitForStackCreateComplete(svc, aws.StringValue(resp.StackId)); err != nil {
-		return err
-	}
-
-	return nil
+	events := newStackEvents(svc, aws.StringValue(resp.StackId))
+	return waitForStack(ctx, svc, events, cloudformation.StackStatusCreateComplete)
 }
 
 func validateStack(svc *cloudformation.CloudFormation, stackBody string) (string, error) {
@@ -45,12 +60,18 @@ func validateStack(svc *cloudformation.CloudFormation, stackBody string) (string
 	return validationReport.String(), err
 }
 
-func updateStack(svc *cloudformation.CloudFormation, stackName, stackBody string) (string, error) {
+func updateStack(ctx context.Context, svc *cloudformation.CloudFormation, stackName, stackBody string) (string, error) {
 
 	input := &cloudformation.UpdateStackInput{
 		Capabilities: []*string{aws.String(cloudformation.CapabilityCapabilityIam)},
 		StackName:    aws.String(stackName),
 		TemplateBody: aws.String(stackBody),
+		Tags:         stackTags(stackName),
+	}
+
+	events := newStackEvents(svc, stackName)
+	if err := events.skipExisting(); err != nil {
+		return "", err
 	}
 
 	updateOutput, err := svc.UpdateStack(input)
@@ -59,53 +80,228 @@ func updateStack(svc *cloudformation.CloudFormation, stackName, stackBody string
 		return "", fmt.Errorf("Error updating cloudformation stack: %v", err)
 	}
 
-	return updateOutput.String(), waitForStackUpdateComplete(svc, *updateOutput.StackId)
+	return updateOutput.String(), waitForStack(ctx, svc, events, cloudformation.StackStatusUpdateComplete)
 }
 
-func waitForStackUpdateComplete(svc *cloudformation.CloudFormation, stackID string) error {
-	req := cloudformation.DescribeStacksInput{
-		StackName: aws.String(stackID),
+func createChangeSet(ctx context.Context, svc *cloudformation.CloudFormation, stackName, changeSetName, stackBody string) (*Plan, error) {
+	input := &cloudformation.CreateChangeSetInput{
+		Capabilities:  []*string{aws.String(cloudformation.CapabilityCapabilityIam)},
+		ChangeSetName: aws.String(changeSetName),
+		StackName:     aws.String(stackName),
+		TemplateBody:  aws.String(stackBody),
+		Tags:          stackTags(stackName),
+	}
+
+	resp, err := svc.CreateChangeSet(input)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating change set: %v", err)
+	}
+
+	plan := &Plan{
+		StackName:     stackName,
+		ChangeSetName: changeSetName,
+		ChangeSetID:   aws.StringValue(resp.Id),
+	}
+	if err := waitForChangeSetCreateComplete(ctx, svc, plan); err != nil {
+		//without a plan, nothing is left to discard the change set
+		if deleteErr := deleteChangeSet(svc, plan); deleteErr != nil {
+			return nil, fmt.Errorf("%v. Change set %s is left behind: %v", err, changeSetName, deleteErr)
+		}
+		return nil, err
+	}
+	return plan, nil
+}
+
+// waitForChangeSetCreateComplete waits for CloudFormation to compute the
+// plan's change set, and fills in its changes. A change set without any
+// changes fails to be created, which is reported as an empty plan.
+func waitForChangeSetCreateComplete(ctx context.Context, svc *cloudformation.CloudFormation, plan *Plan) error {
+	req := cloudformation.DescribeChangeSetInput{
+		ChangeSetName: aws.String(plan.ChangeSetID),
 	}
 	for {
-		resp, err := svc.DescribeStacks(&req)
+		resp, err := svc.DescribeChangeSet(&req)
 		if err != nil {
 			return err
 		}
-		if len(resp.Stacks) == 0 {
-			return fmt.Errorf("stack not found")
+
+		switch status := aws.StringValue(resp.Status); status {
+		case cloudformation.ChangeSetStatusCreatePending, cloudformation.ChangeSetStatusCreateInProgress:
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("Stopped waiting for change set %s: %v", plan.ChangeSetName, ctx.Err())
+			case <-time.After(pollInterval):
+			}
+			continue
+		case cloudformation.ChangeSetStatusCreateComplete:
+		case cloudformation.ChangeSetStatusFailed:
+			reason := aws.StringValue(resp.StatusReason)
+			if strings.Contains(reason, "didn't contain changes") || strings.Contains(reason, "No updates are to be performed") {
+				return nil
+			}
+			return fmt.Errorf("Change set failed: %s", reason)
+		default:
+			return fmt.Errorf("Change set %s is %s", plan.ChangeSetName, status)
+		}
+
+		for _, change := range resp.Changes {
+			rc := change.ResourceChange
+			if rc == nil {
+				continue
+			}
+			plan.Changes = append(plan.Changes, &ResourceChange{
+				Action:       aws.StringValue(rc.Action),
+				LogicalID:    aws.StringValue(rc.LogicalResourceId),
+				PhysicalID:   aws.StringValue(rc.PhysicalResourceId),
+				ResourceType: aws.StringValue(rc.ResourceType),
+				Replacement:  aws.StringValue(rc.Replacement),
+			})
 		}
-		statusString := aws.StringValue(resp.Stacks[0].StackStatus)
-		switch statusString {
-		case cloudformation.ResourceStatusUpdateComplete:
+		req.NextToken = resp.NextToken
+		if aws.StringValue(req.NextToken) == "" {
 			return nil
-		case cloudformation.ResourceStatusUpdateFailed, cloudformation.StackStatusUpdateRollbackComplete, cloudformation.StackStatusUpdateRollbackFailed:
-			errMsg := fmt.Sprintf("Stack status: %s : %s", statusString, aws.StringValue(resp.Stacks[0].StackStatusReason))
-			return errors.New(errMsg)
 		}
-		time.Sleep(3 * time.Second)
 	}
 }
 
-func waitForStackCreateComplete(svc *cloudformation.CloudFormation, stackID string) error {
-	req := cloudformation.DescribeStacksInput{
-		StackName: aws.String(stackID),
+func executeChangeSet(ctx context.Context, svc *cloudformation.CloudFormation, plan *Plan) error {
+	events := newStackEvents(svc, plan.StackName)
+	if err := events.skipExisting(); err != nil {
+		return err
+	}
+
+	input := &cloudformation.ExecuteChangeSetInput{
+		ChangeSetName: aws.String(plan.ChangeSetID),
+	}
+	if _, err := svc.ExecuteChangeSet(input); err != nil {
+		return fmt.Errorf("Error executing change set: %v", err)
 	}
+
+	return waitForStack(ctx, svc, events, cloudformation.StackStatusUpdateComplete)
+}
+
+func deleteChangeSet(svc *cloudformation.CloudFormation, plan *Plan) error {
+	input := &cloudformation.DeleteChangeSetInput{
+		ChangeSetName: aws.String(plan.ChangeSetID),
+	}
+	if _, err := svc.DeleteChangeSet(input); err != nil {
+		return fmt.Errorf("Error deleting change set: %v", err)
+	}
+	return nil
+}
+
+// waitForStack waits for the operation on the stack to end, printing its
+// events along the way. It succeeds when the stack ends up in one of the
+// success statuses. Should ctx be done first, the operation is left to
+// carry on in CloudFormation.
+func waitForStack(ctx context.Context, svc *cloudformation.CloudFormation, events *stackEvents, success ...string) error {
 	for {
-		resp, err := svc.DescribeStacks(&req)
+		stack, err := describeStack(svc, events.stackID)
 		if err != nil {
 			return err
 		}
-		if len(resp.Stacks) == 0 {
-			return fmt.Errorf("stack not found")
+		//the events are polled after the status, so that those leading
+		//up to it are all printed
+		if err := events.poll(); err != nil {
+			return err
 		}
-		switch aws.StringValue(resp.Stacks[0].StackStatus) {
-		case cloudformation.ResourceStatusCreateComplete:
-			return nil
-		case cloudformation.ResourceStatusCreateFailed:
-			return errors.New(aws.StringValue(resp.Stacks[0].StackStatusReason))
+
+		status := aws.StringValue(stack.StackStatus)
+		if isStackStatusTerminal(status) {
+			for _, s := range success {
+				if status == s {
+					return nil
+				}
+			}
+			if status == cloudformation.StackStatusDeleteFailed {
+				return deleteFailure(svc, stack)
+			}
+			return stackFailure(stack, events)
 		}
-		time.Sleep(3 * time.Second)
+
+		select {
+		case <-ctx.Done():
+			reason := "Interrupted"
+			if ctx.Err() == context.DeadlineExceeded {
+				reason = "Timed out"
+			}
+			return fmt.Errorf("%s while stack %s is %s. CloudFormation carries on with it; run \"kube-aws wait\" to wait for it again", reason, aws.StringValue(stack.StackName), status)
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// waitForStackOperation waits for the operation in progress on the stack,
+// if any, to end. It returns the status the stack ends up in.
+func waitForStackOperation(ctx context.Context, svc *cloudformation.CloudFormation, name string) (string, error) {
+	stack, err := describeStack(svc, name)
+	if err != nil {
+		return "", err
+	}
+	events := newStackEvents(svc, aws.StringValue(stack.StackId))
+	if err := events.skipExisting(); err != nil {
+		return "", err
+	}
+
+	fmt.Printf("Waiting for stack %s, which is %s\n", name, aws.StringValue(stack.StackStatus))
+	if err := waitForStack(ctx, svc, events,
+		cloudformation.StackStatusCreateComplete,
+		cloudformation.StackStatusUpdateComplete,
+		cloudformation.StackStatusDeleteComplete,
+		cloudformation.StackStatusImportComplete); err != nil {
+		return "", err
 	}
+
+	stack, err = describeStack(svc, events.stackID)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(stack.StackStatus), nil
+}
+
+// isStackStatusTerminal reports whether status ends an operation on the
+// stack, rather than being a step towards the end
+func isStackStatusTerminal(status string) bool {
+	switch status {
+	case cloudformation.StackStatusCreateInProgress,
+		cloudformation.StackStatusRollbackInProgress,
+		cloudformation.StackStatusDeleteInProgress,
+		cloudformation.StackStatusUpdateInProgress,
+		cloudformation.StackStatusUpdateCompleteCleanupInProgress,
+		cloudformation.StackStatusUpdateRollbackInProgress,
+		cloudformation.StackStatusUpdateRollbackCompleteCleanupInProgress,
+		cloudformation.StackStatusReviewInProgress,
+		cloudformation.StackStatusImportInProgress,
+		cloudformation.StackStatusImportRollbackInProgress:
+		return false
+	case cloudformation.StackStatusCreateComplete,
+		cloudformation.StackStatusCreateFailed,
+		cloudformation.StackStatusRollbackComplete,
+		cloudformation.StackStatusRollbackFailed,
+		cloudformation.StackStatusDeleteComplete,
+		cloudformation.StackStatusDeleteFailed,
+		cloudformation.StackStatusUpdateComplete,
+		cloudformation.StackStatusUpdateFailed,
+		cloudformation.StackStatusUpdateRollbackComplete,
+		cloudformation.StackStatusUpdateRollbackFailed,
+		cloudformation.StackStatusImportComplete,
+		cloudformation.StackStatusImportRollbackComplete,
+		cloudformation.StackStatusImportRollbackFailed:
+		return true
+	}
+	//statuses added since are assumed to follow the same naming
+	return !strings.HasSuffix(status, "_IN_PROGRESS")
+}
+
+// stackFailure describes why the stack operation failed, naming the first
+// resource that failed rather than only the stack's status reason, which
+// rarely says more than that resources failed
+func stackFailure(stack *cloudformation.Stack, events *stackEvents) error {
+	msg := fmt.Sprintf("Stack status: %s : %s", aws.StringValue(stack.StackStatus), aws.StringValue(stack.StackStatusReason))
+	if summary := events.failureSummary(); summary != "" {
+		msg += "\nFirst failed resource: " + summary
+	}
+	return errors.New(msg)
 }
 
 func getStackResources(svc *cloudformation.CloudFormation, stackID string) ([]cloudformation.StackResourceSummary, error) {
@@ -129,26 +325,207 @@ func getStackResources(svc *cloudformation.CloudFormation, stackID string) ([]cl
 	return resources, nil
 }
 
-func mapStackResourcesToClusterInfo(svc *ec2.EC2, resources []cloudformation.StackResourceSummary) (*ClusterInfo, error) {
+func stackOutputs(stack *cloudformation.Stack) map[string]string {
+	outputs := make(map[string]string)
+	for _, o := range stack.Outputs {
+		outputs[aws.StringValue(o.OutputKey)] = aws.StringValue(o.OutputValue)
+	}
+	return outputs
+}
+
+func mapStackResourcesToClusterInfo(resources []cloudformation.StackResourceSummary) (*ClusterInfo, error) {
 	var info ClusterInfo
 	for _, r := range resources {
-		switch aws.StringValue(r.LogicalResourceId) {
-		case "EIPController":
+		logicalID := aws.StringValue(r.LogicalResourceId)
+		switch {
+		case logicalID == "EIPController":
 			if r.PhysicalResourceId != nil {
 				info.ControllerIP = *r.PhysicalResourceId
 			} else {
 				return nil, fmt.Errorf("unable to get public IP of controller instance")
 			}
+		case aws.StringValue(r.ResourceType) == "AWS::EC2::Instance" && r.PhysicalResourceId != nil:
+			name := strings.TrimPrefix(logicalID, "Instance")
+			role := "controller"
+			if strings.HasPrefix(name, "Etcd") {
+				role = "etcd"
+			}
+			info.Instances = append(info.Instances, &InstanceInfo{
+				Name: name,
+				Role: role,
+				ID:   *r.PhysicalResourceId,
+			})
+		case aws.StringValue(r.ResourceType) == "AWS::AutoScaling::AutoScalingGroup" && r.PhysicalResourceId != nil:
+			info.AutoScalingGroups = append(info.AutoScalingGroups, &AutoScalingGroupInfo{
+				Name: strings.TrimPrefix(logicalID, "AutoScale"),
+				ID:   *r.PhysicalResourceId,
+			})
 		}
 	}
 
 	return &info, nil
 }
 
-func destroyStack(svc *cloudformation.CloudFormation, name string) error {
+// describeAutoScalingGroups fills in the sizes of the cluster's auto
+// scaling groups, and adds the workers they launched to its instances
+func describeAutoScalingGroups(svc *autoscaling.AutoScaling, info *ClusterInfo) error {
+	if len(info.AutoScalingGroups) == 0 {
+		return nil
+	}
+
+	groups := map[string]*AutoScalingGroupInfo{}
+	req := autoscaling.DescribeAutoScalingGroupsInput{}
+	for _, group := range info.AutoScalingGroups {
+		groups[group.ID] = group
+		req.AutoScalingGroupNames = append(req.AutoScalingGroupNames, aws.String(group.ID))
+	}
+	for {
+		resp, err := svc.DescribeAutoScalingGroups(&req)
+		if err != nil {
+			return err
+		}
+		for _, g := range resp.AutoScalingGroups {
+			group, ok := groups[aws.StringValue(g.AutoScalingGroupName)]
+			if !ok {
+				continue
+			}
+			group.Desired = aws.Int64Value(g.DesiredCapacity)
+			group.Min = aws.Int64Value(g.MinSize)
+			group.Max = aws.Int64Value(g.MaxSize)
+			for _, i := range g.Instances {
+				if aws.StringValue(i.LifecycleState) == autoscaling.LifecycleStateInService {
+					group.InService++
+				}
+				info.Instances = append(info.Instances, &InstanceInfo{
+					Name:   group.Name,
+					Role:   "worker",
+					ID:     aws.StringValue(i.InstanceId),
+					Health: aws.StringValue(i.HealthStatus),
+				})
+			}
+		}
+		req.NextToken = resp.NextToken
+		if aws.StringValue(req.NextToken) == "" {
+			return nil
+		}
+	}
+}
+
+// describeInstances fills in the addresses, placement and state of the
+// cluster's instances
+func describeInstances(svc *ec2.EC2, info *ClusterInfo) error {
+	if len(info.Instances) == 0 {
+		return nil
+	}
+
+	instances := map[string]*InstanceInfo{}
+	ids := []*string{}
+	for _, instance := range info.Instances {
+		instances[instance.ID] = instance
+		ids = append(ids, aws.String(instance.ID))
+	}
+	//filtering, unlike listing instance IDs, does not fail on instances
+	//terminated long enough ago to be forgotten
+	req := ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("instance-id"), Values: ids},
+		},
+	}
+	for {
+		resp, err := svc.DescribeInstances(&req)
+		if err != nil {
+			return err
+		}
+		for _, reservation := range resp.Reservations {
+			for _, i := range reservation.Instances {
+				instance, ok := instances[aws.StringValue(i.InstanceId)]
+				if !ok {
+					continue
+				}
+				instance.PrivateIP = aws.StringValue(i.PrivateIpAddress)
+				instance.PublicIP = aws.StringValue(i.PublicIpAddress)
+				if i.Placement != nil {
+					instance.AvailabilityZone = aws.StringValue(i.Placement.AvailabilityZone)
+				}
+				if i.State != nil {
+					instance.State = aws.StringValue(i.State.Name)
+				}
+				if i.LaunchTime != nil {
+					instance.LaunchTime = i.LaunchTime.UTC().Format(time.RFC3339)
+				}
+			}
+		}
+		req.NextToken = resp.NextToken
+		if aws.StringValue(req.NextToken) == "" {
+			return nil
+		}
+	}
+}
+
+func describeStack(svc *cloudformation.CloudFormation, stackID string) (*cloudformation.Stack, error) {
+	resp, err := svc.DescribeStacks(&cloudformation.DescribeStacksInput{
+		StackName: aws.String(stackID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Stacks) == 0 {
+		return nil, fmt.Errorf("stack not found")
+	}
+	return resp.Stacks[0], nil
+}
+
+// destroyStack deletes the stack, once it is found to be tagged with the
+// cluster's name, and waits for it to be deleted
+func destroyStack(ctx context.Context, svc *cloudformation.CloudFormation, name string) error {
+	stack, err := describeStack(svc, name)
+	if err != nil {
+		return err
+	}
+	tagged := false
+	for _, tag := range stack.Tags {
+		if aws.StringValue(tag.Key) == stackTagKey && aws.StringValue(tag.Value) == name {
+			tagged = true
+		}
+	}
+	if !tagged {
+		return fmt.Errorf("stack %s is not tagged %s=%s, refusing to delete a stack kube-aws did not create. Stacks created by older versions of kube-aws are tagged by \"kube-aws up --update\"", name, stackTagKey, name)
+	}
+
+	//the stack ID keeps identifying the stack once it is deleted, unlike
+	//its name
+	events := newStackEvents(svc, aws.StringValue(stack.StackId))
+	if err := events.skipExisting(); err != nil {
+		return err
+	}
+
 	dreq := &cloudformation.DeleteStackInput{
 		StackName: aws.String(name),
 	}
-	_, err := svc.DeleteStack(dreq)
-	return err
+	if _, err := svc.DeleteStack(dreq); err != nil {
+		return err
+	}
+	return waitForStack(ctx, svc, events, cloudformation.StackStatusDeleteComplete)
+}
+
+func deleteFailure(svc *cloudformation.CloudFormation, stack *cloudformation.Stack) error {
+	msg := fmt.Sprintf("Stack status: %s : %s", aws.StringValue(stack.StackStatus), aws.StringValue(stack.StackStatusReason))
+
+	resources, err := getStackResources(svc, aws.StringValue(stack.StackId))
+	if err != nil {
+		return fmt.Errorf("%s\nError listing the resources left behind: %v", msg, err)
+	}
+	msg += "\nResources that failed to delete:"
+	for _, r := range resources {
+		if aws.StringValue(r.ResourceStatus) != cloudformation.ResourceStatusDeleteFailed {
+			continue
+		}
+		msg += fmt.Sprintf("\n  %s (%s %s): %s",
+			aws.StringValue(r.LogicalResourceId),
+			aws.StringValue(r.ResourceType),
+			aws.StringValue(r.PhysicalResourceId),
+			aws.StringValue(r.ResourceStatusReason))
+	}
+	msg += "\nThese are usually held by resources created outside of the stack, such as network interfaces or load balancer security groups created by Kubernetes. Delete those, then destroy the cluster again"
+	return errors.New(msg)
 }
@@ -2,13 +2,25 @@ package config
 
 import (
 	"bytes"
+	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
 
 	"github.com/coreos/coreos-kubernetes/multi-node/aws/pkg/blobutil"
+	"github.com/coreos/coreos-kubernetes/multi-node/aws/pkg/tlsutil"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -29,10 +41,25 @@ func NewDefaultConfig() *Config {
 		KubernetesServiceIP:      "10.3.0.1",
 		DNSServiceIP:             "10.3.0.10",
 		K8sVer:                   "v1.1.7-coreos.1",
+		ControllerCount:          1,
 		ControllerInstanceType:   "m3.medium",
-        ControllerEtcdVolumeSize: 30,
+		ControllerEtcdVolumeSize: 30,
+		EtcdCount:                0,
+		EtcdInstanceType:         "m3.medium",
+		EtcdVolumeSize:           30,
+		EtcdIP:                   "10.0.0.20",
 		WorkerCount:              1,
 		WorkerInstanceType:       "m3.medium",
+		WorkerTopology:           "public",
+		TLS: TLS{
+			KeyAlgorithm:   tlsutil.DefaultKeyAlgorithm,
+			CAValidityDays: 365,
+			ValidityDays:   90,
+			CACommonName:   "kube-ca",
+			Subject: TLSSubject{
+				Organization: "kube-aws",
+			},
+		},
 
 		TLSConfig:     newTLSConfig(),
 		UserData:      newUserDataConfig(),
@@ -40,41 +67,229 @@ func NewDefaultConfig() *Config {
 		StackTemplate: &blobutil.NamedBuffer{Name: "stack-template.json"},
 	}
 }
+
 type ExistingVPC struct {
-    VPCID string `yaml:"vpcID"`
-    RouteTableID string `yaml:"routeTableID"`
+	VPCID            string   `yaml:"vpcID"`
+	RouteTableID     string   `yaml:"routeTableID"`
+	SecurityGroupIDs []string `yaml:"securityGroupIDs"`
+}
+
+// APIServerLoadBalancer is an ELB placed in front of the controllers' apiservers
+type APIServerLoadBalancer struct {
+	Scheme string `yaml:"scheme"`
+	// HostedZoneID, when set, is the Route53 hosted zone in which a record
+	// pointing externalDNSName at the load balancer is created
+	HostedZoneID string `yaml:"hostedZoneID"`
+}
+
+// TLS configures the CA and certificates generated by render
+type TLS struct {
+	KeyAlgorithm   string `yaml:"keyAlgorithm"`
+	CAValidityDays int    `yaml:"caValidityDays"`
+	ValidityDays   int    `yaml:"validityDays"`
+	// UserValidityDays is how long certificates issued to users are valid,
+	// ValidityDays unless set. As revoked certificates keep working until
+	// they expire, it bounds how long a leaked one can be used
+	UserValidityDays int        `yaml:"userValidityDays"`
+	CACommonName     string     `yaml:"caCommonName"`
+	Subject          TLSSubject `yaml:"subject"`
+	// APIServerDNSNames and APIServerIPs are added to the apiserver
+	// certificate's SANs
+	APIServerDNSNames []string `yaml:"apiServerDNSNames"`
+	APIServerIPs      []string `yaml:"apiServerIPs"`
+	// PerNodeWorkerCertificates has the controllers sign each worker its
+	// own certificate at boot instead of sharing worker.pem. Workers prove
+	// who they are with their instance identity document, whose signature
+	// is checked against InstanceIdentityCertificate. The controllers sign
+	// with an intermediate CA whose key is encrypted with KMSKeyARN
+	PerNodeWorkerCertificates   bool   `yaml:"perNodeWorkerCertificates"`
+	InstanceIdentityCertificate string `yaml:"instanceIdentityCertificate"`
+	KMSKeyARN                   string `yaml:"kmsKeyARN"`
+}
+
+type TLSSubject struct {
+	Organization       string `yaml:"organization"`
+	OrganizationalUnit string `yaml:"organizationalUnit"`
+	Country            string `yaml:"country"`
+	Province           string `yaml:"province"`
+	Locality           string `yaml:"locality"`
+}
+
+// OpenSSLSubject returns the subject with commonName in the
+// /type0=value0/type1=value1 form taken by openssl
+func (s TLSSubject) OpenSSLSubject(commonName string) string {
+	parts := []string{}
+	for _, attr := range []struct {
+		key, value string
+	}{
+		{"C", s.Country},
+		{"ST", s.Province},
+		{"L", s.Locality},
+		{"O", s.Organization},
+		{"OU", s.OrganizationalUnit},
+		{"CN", commonName},
+	} {
+		if attr.value != "" {
+			parts = append(parts, "/"+attr.key+"="+strings.Replace(attr.value, "/", "\\/", -1))
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+func (s TLSSubject) subject() tlsutil.Subject {
+	return tlsutil.Subject{
+		Organization:       s.Organization,
+		OrganizationalUnit: s.OrganizationalUnit,
+		Country:            s.Country,
+		Province:           s.Province,
+		Locality:           s.Locality,
+	}
+}
+
+// CAValidity is how long a CA generated by render is valid
+func (t *TLS) CAValidity() time.Duration {
+	return time.Duration(t.CAValidityDays) * 24 * time.Hour
+}
+
+// Validity is how long the certificates signed by the CA are valid
+func (t *TLS) Validity() time.Duration {
+	return time.Duration(t.ValidityDays) * 24 * time.Hour
+}
+
+// UserValidity is how long the certificates issued to users are valid
+func (t *TLS) UserValidity() time.Duration {
+	if t.UserValidityDays == 0 {
+		return t.Validity()
+	}
+	return time.Duration(t.UserValidityDays) * 24 * time.Hour
+}
+
+// EncodedInstanceIdentityCertificate returns InstanceIdentityCertificate
+// base64 encoded, for writing it out from a cloud-config
+func (t *TLS) EncodedInstanceIdentityCertificate() string {
+	return base64.StdEncoding.EncodeToString([]byte(t.InstanceIdentityCertificate))
+}
+
+type Subnet struct {
+	AvailabilityZone    string `yaml:"availabilityZone"`
+	InstanceCIDR        string `yaml:"instanceCIDR"`
+	PrivateInstanceCIDR string `yaml:"privateInstanceCIDR"`
+	SubnetID            string `yaml:"subnetID"`
+	PrivateSubnetID     string `yaml:"privateSubnetID"`
+	// Name is embedded in the logical IDs of the subnet's resources
+	Name string `yaml:"-"`
+	// PrivateName is embedded in the logical IDs of the resources of the
+	// subnet's private counterpart, when workerTopology is private
+	PrivateName string `yaml:"-"`
+}
+
+// Ref returns the stack template JSON value identifying the subnet: either
+// the existing subnet's ID or a reference to the subnet the stack creates
+func (s *Subnet) Ref() string {
+	if s.SubnetID != "" {
+		return fmt.Sprintf("%q", s.SubnetID)
+	}
+	return fmt.Sprintf(`{"Ref": %q}`, s.Name)
+}
+
+// WorkerPool is a group of identically configured workers sharing a launch
+// configuration and auto scaling group
+type WorkerPool struct {
+	Name           string            `yaml:"name"`
+	InstanceType   string            `yaml:"instanceType"`
+	Count          int               `yaml:"count"`
+	MinCount       int               `yaml:"minCount"`
+	MaxCount       int               `yaml:"maxCount"`
+	SpotPrice      string            `yaml:"spotPrice"`
+	RootVolumeSize int               `yaml:"rootVolumeSize"`
+	NodeLabels     map[string]string `yaml:"nodeLabels"`
+	Taints         []string          `yaml:"taints"`
+	// LogicalName is embedded in the logical IDs of the pool's resources.
+	// The pool built from workerCount and friends is named "Worker" so
+	// that existing stacks can still be updated in place.
+	LogicalName string `yaml:"-"`
+	// UserData is the worker cloud-config rendered for this pool
+	UserData *blobutil.NamedBuffer `yaml:"-"`
+}
+
+// NodeLabelList returns the pool's node labels as a sorted, comma
+// separated list of key=value pairs
+func (p *WorkerPool) NodeLabelList() string {
+	labels := make([]string, 0, len(p.NodeLabels))
+	for k, v := range p.NodeLabels {
+		labels = append(labels, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(labels)
+	return strings.Join(labels, ",")
+}
+
+// TaintList returns the pool's taints as a comma separated list
+func (p *WorkerPool) TaintList() string {
+	return strings.Join(p.Taints, ",")
 }
+
+// Instance is a single statically addressed node rendered into the stack template
+type Instance struct {
+	// Name is embedded in the logical IDs of the instance's resources.
+	// The first instance of a role keeps the bare role name (e.g.
+	// "Controller") so that stacks created with a single controller
+	// can still be updated in place.
+	Name   string
+	IP     string
+	Subnet *Subnet
+}
+
 type Config struct {
-	ClusterName              string `yaml:"clusterName"`
-	ExternalDNSName          string `yaml:"externalDNSName"`
-	KeyName                  string `yaml:"keyName"`
-	Region                   string `yaml:"region"`
-	AvailabilityZone         string `yaml:"availabilityZone"`
-	ReleaseChannel           string `yaml:"releaseChannel"`
-	ControllerInstanceType   string `yaml:"controllerInstanceType"`
-    ControllerEtcdVolumeSize int `yaml:"controllerEtcdVolumeSize"`
-	WorkerCount              int    `yaml:"workerCount"`
-	WorkerInstanceType       string `yaml:"workerInstanceType"`
-	WorkerSpotPrice          string `yaml:"workerSpotPrice"`
-	VPCCIDR                  string `yaml:"vpcCIDR"`
-    ExistingVPC        *ExistingVPC `yaml:"existingVPC"`
-	InstanceCIDR             string `yaml:"instanceCIDR"`
-	ControllerIP             string `yaml:"controllerIP"`
-	PodCIDR                  string `yaml:"podCIDR"`
-	ServiceCIDR              string `yaml:"serviceCIDR"`
-	KubernetesServiceIP      string `yaml:"kubernetesServiceIP"`
-	DNSServiceIP             string `yaml:"dnsServiceIP"`
-	K8sVer                   string `yaml:"kubernetesVersion"`
-	AMI               string `yaml:"ami"`
+	ClusterName                  string                 `yaml:"clusterName"`
+	ExternalDNSName              string                 `yaml:"externalDNSName"`
+	KeyName                      string                 `yaml:"keyName"`
+	Region                       string                 `yaml:"region"`
+	AvailabilityZone             string                 `yaml:"availabilityZone"`
+	ReleaseChannel               string                 `yaml:"releaseChannel"`
+	ControllerCount              int                    `yaml:"controllerCount"`
+	ControllerInstanceType       string                 `yaml:"controllerInstanceType"`
+	ControllerEtcdVolumeSize     int                    `yaml:"controllerEtcdVolumeSize"`
+	EtcdCount                    int                    `yaml:"etcdCount"`
+	EtcdInstanceType             string                 `yaml:"etcdInstanceType"`
+	EtcdVolumeSize               int                    `yaml:"etcdVolumeSize"`
+	EtcdIP                       string                 `yaml:"etcdIP"`
+	WorkerCount                  int                    `yaml:"workerCount"`
+	WorkerInstanceType           string                 `yaml:"workerInstanceType"`
+	WorkerMinCount               int                    `yaml:"workerMinCount"`
+	WorkerMaxCount               int                    `yaml:"workerMaxCount"`
+	WorkerSpotPrice              string                 `yaml:"workerSpotPrice"`
+	WorkerTopology               string                 `yaml:"workerTopology"`
+	SSHAccessCIDRs               []string               `yaml:"sshAccessCIDRs"`
+	VPCCIDR                      string                 `yaml:"vpcCIDR"`
+	ExistingVPC                  *ExistingVPC           `yaml:"existingVPC"`
+	APIServerLoadBalancer        *APIServerLoadBalancer `yaml:"apiServerLoadBalancer"`
+	InstanceCIDR                 string                 `yaml:"instanceCIDR"`
+	PrivateInstanceCIDR          string                 `yaml:"privateInstanceCIDR"`
+	Subnets                      []*Subnet              `yaml:"subnets"`
+	WorkerPools                  []*WorkerPool          `yaml:"workerPools"`
+	ClusterAutoscaler            bool                   `yaml:"clusterAutoscaler"`
+	ControllerInstanceProfileARN string                 `yaml:"controllerInstanceProfileARN"`
+	WorkerInstanceProfileARN     string                 `yaml:"workerInstanceProfileARN"`
+	TLS                          TLS                    `yaml:"tls"`
+	CredentialsEncryption        *CredentialsEncryption `yaml:"credentialsEncryption"`
+	ControllerIP                 string                 `yaml:"controllerIP"`
+	PodCIDR                      string                 `yaml:"podCIDR"`
+	ServiceCIDR                  string                 `yaml:"serviceCIDR"`
+	KubernetesServiceIP          string                 `yaml:"kubernetesServiceIP"`
+	DNSServiceIP                 string                 `yaml:"dnsServiceIP"`
+	K8sVer                       string                 `yaml:"kubernetesVersion"`
+	AMI                          string                 `yaml:"ami"`
 	//Calculated fields
-	APIServers        string `yaml:"-"`
-	SecureAPIServers  string `yaml:"-"`
-	ETCDEndpoints     string `yaml:"-"`
-	APIServerEndpoint string `yaml:"-"`
-
-    //TODO: we should work these in as config options
-    MinWorkersASG        int `yaml:"-"`
-    MaxWorkersASG        int `yaml:"-"`
+	APIServers                string     `yaml:"-"`
+	SecureAPIServers          string     `yaml:"-"`
+	WorkerAPIServerEndpoint   string     `yaml:"-"`
+	ETCDEndpoints             string     `yaml:"-"`
+	ETCDInitialCluster        string     `yaml:"-"`
+	APIServerEndpoint         string     `yaml:"-"`
+	Controllers               []Instance `yaml:"-"`
+	EtcdInstances             []Instance `yaml:"-"`
+	WorkerSubnets             []*Subnet  `yaml:"-"`
+	ControllerInstanceProfile string     `yaml:"-"`
 
 	//Subconfig
 	TLSConfig     *TLSConfig            `yaml:"-"`
@@ -83,6 +298,36 @@ type Config struct {
 	StackTemplate *blobutil.NamedBuffer `yaml:"-"`
 }
 
+var (
+	//worker pool names end up in stack template logical IDs
+	workerPoolNameRegexp = regexp.MustCompile("^[a-zA-Z0-9]+$")
+	taintRegexp          = regexp.MustCompile("^[^=:]+=[^=:]*:(NoSchedule|PreferNoSchedule|NoExecute)$")
+	//the last submatch is the instance profile name
+	instanceProfileARNRegexp = regexp.MustCompile(`^arn:aws[a-z-]*:iam::[0-9]{12}:instance-profile/(?:[\w+=,.@/-]*/)?([\w+=,.@-]+)$`)
+	//aliases are not accepted, as the controllers' role is granted the key
+	kmsKeyARNRegexp = regexp.MustCompile(`^arn:aws[a-z-]*:kms:[a-z0-9-]+:[0-9]{12}:key/[a-zA-Z0-9-]+$`)
+	//user names end up in credentials file names
+	userNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._@-]*$`)
+	//the submatches are the major and minor versions
+	kubernetesVersionRegexp = regexp.MustCompile(`^v([0-9]+)\.([0-9]+)\.`)
+)
+
+// kubernetesVersionAtLeast returns an error naming feature unless
+// kubernetesVersion is major.minor or newer
+func (cfg *Config) kubernetesVersionAtLeast(major, minor int, feature string) error {
+	match := kubernetesVersionRegexp.FindStringSubmatch(cfg.K8sVer)
+	if match == nil {
+		return fmt.Errorf("%s requires kubernetesVersion v%d.%d or newer, but kubernetesVersion %q cannot be parsed", feature, major, minor, cfg.K8sVer)
+	}
+	//the regexp only matches numbers
+	gotMajor, _ := strconv.Atoi(match[1])
+	gotMinor, _ := strconv.Atoi(match[2])
+	if gotMajor < major || gotMajor == major && gotMinor < minor {
+		return fmt.Errorf("%s requires kubernetesVersion v%d.%d or newer, got %s", feature, major, minor, cfg.K8sVer)
+	}
+	return nil
+}
+
 func (cfg *Config) valid() error {
 	if cfg.ExternalDNSName == "" {
 		return errors.New("externalDNSName must be set")
@@ -93,38 +338,251 @@ func (cfg *Config) valid() error {
 	if cfg.Region == "" {
 		return errors.New("region must be set")
 	}
-	if cfg.AvailabilityZone == "" {
-		return errors.New("availabilityZone must be set")
+	if len(cfg.Subnets) == 0 {
+		if cfg.AvailabilityZone == "" {
+			return errors.New("availabilityZone must be set")
+		}
+	} else if cfg.AvailabilityZone != "" {
+		return errors.New("availabilityZone must not be set when subnets are specified")
 	}
 	if cfg.ClusterName == "" {
 		return errors.New("clusterName must be set")
 	}
 
+	if cfg.WorkerTopology != "public" && cfg.WorkerTopology != "private" {
+		return fmt.Errorf("workerTopology must be public or private, got %s", cfg.WorkerTopology)
+	}
+	privateWorkers := cfg.WorkerTopology == "private"
+
 	_, vpcNet, err := net.ParseCIDR(cfg.VPCCIDR)
 	if err != nil {
 		return fmt.Errorf("invalid vpcCIDR: %v", err)
 	}
 
-	instancesNetIP, instancesNet, err := net.ParseCIDR(cfg.InstanceCIDR)
+	sshAccessCIDRs := make(map[string]bool)
+	for _, cidr := range cfg.SSHAccessCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid sshAccessCIDRs entry: %v", err)
+		}
+		if sshAccessCIDRs[cidr] {
+			return fmt.Errorf("sshAccessCIDRs entry %s is listed twice", cidr)
+		}
+		sshAccessCIDRs[cidr] = true
+	}
+
+	var usedCIDRs []string
+	var usedNets []*net.IPNet
+	checkCIDR := func(field, cidr string) (*net.IPNet, error) {
+		netIP, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", field, err)
+		}
+		if !vpcNet.Contains(netIP) {
+			return nil, fmt.Errorf("vpcCIDR (%s) does not contain %s (%s)", cfg.VPCCIDR, field, cidr)
+		}
+		for j, otherNet := range usedNets {
+			if otherNet.Contains(netIP) || ipNet.Contains(otherNet.IP) {
+				return nil, fmt.Errorf("%s (%s) overlaps with subnet (%s)", field, cidr, usedCIDRs[j])
+			}
+		}
+		usedCIDRs = append(usedCIDRs, cidr)
+		usedNets = append(usedNets, ipNet)
+		return ipNet, nil
+	}
+
+	subnets := cfg.instanceSubnets()
+	instanceNets := make([]*net.IPNet, len(subnets))
+	privateNets := make([]*net.IPNet, len(subnets))
+	availabilityZones := map[string]bool{}
+	for i, subnet := range subnets {
+		if subnet.AvailabilityZone == "" {
+			return fmt.Errorf("availabilityZone must be set for subnet %d", i)
+		}
+		if availabilityZones[subnet.AvailabilityZone] {
+			return fmt.Errorf("availabilityZone (%s) is used by more than one subnet", subnet.AvailabilityZone)
+		}
+		availabilityZones[subnet.AvailabilityZone] = true
+
+		if instanceNets[i], err = checkCIDR("instanceCIDR", subnet.InstanceCIDR); err != nil {
+			return err
+		}
+		if (subnet.SubnetID != "" || subnet.PrivateSubnetID != "") && cfg.ExistingVPC == nil {
+			return errors.New("subnetID and privateSubnetID require existingVPC to be set")
+		}
+		if subnet.SubnetID == "" && cfg.ExistingVPC != nil && cfg.ExistingVPC.RouteTableID == "" {
+			return fmt.Errorf("existingVPC.routeTableID must be set unless subnet %d has a subnetID", i)
+		}
+
+		if !privateWorkers {
+			if subnet.PrivateInstanceCIDR != "" || subnet.PrivateSubnetID != "" {
+				return errors.New("privateInstanceCIDR and privateSubnetID require workerTopology to be private")
+			}
+			continue
+		}
+		if subnet.PrivateInstanceCIDR == "" {
+			return fmt.Errorf("privateInstanceCIDR must be set for subnet %d when workerTopology is private", i)
+		}
+		if privateNets[i], err = checkCIDR("privateInstanceCIDR", subnet.PrivateInstanceCIDR); err != nil {
+			return err
+		}
+	}
+
+	if cfg.ControllerCount < 1 {
+		return fmt.Errorf("controllerCount must be at least 1, got %d", cfg.ControllerCount)
+	}
+
+	if lb := cfg.APIServerLoadBalancer; lb != nil && lb.Scheme != "" && lb.Scheme != "internal" && lb.Scheme != "internet-facing" {
+		return fmt.Errorf("apiServerLoadBalancer.scheme must be internal or internet-facing, got %s", lb.Scheme)
+	}
+
+	//Workers reach multiple controllers through externalDNSName, so the stack must create its record
+	if cfg.ControllerCount > 1 && (cfg.APIServerLoadBalancer == nil || cfg.APIServerLoadBalancer.HostedZoneID == "") {
+		return fmt.Errorf("apiServerLoadBalancer.hostedZoneID is required when controllerCount is greater than 1")
+	}
+
+	controllerIPAddrs, err := instanceIPs("controllerIP", cfg.ControllerIP, cfg.ControllerCount, subnets, instanceNets)
 	if err != nil {
-		return fmt.Errorf("invalid instanceCIDR: %v", err)
+		return err
 	}
-	if !vpcNet.Contains(instancesNetIP) {
-		return fmt.Errorf("vpcCIDR (%s) does not contain instanceCIDR (%s)",
-			cfg.VPCCIDR,
-			cfg.InstanceCIDR,
-		)
+
+	if cfg.EtcdCount < 0 {
+		return fmt.Errorf("etcdCount must not be negative, got %d", cfg.EtcdCount)
+	}
+	if cfg.EtcdCount > 0 {
+		//the etcd tier lives alongside the workers
+		etcdSubnets, etcdNets := subnets, instanceNets
+		if privateWorkers {
+			etcdSubnets, etcdNets = privateSubnets(subnets), privateNets
+		}
+		etcdIPAddrs, err := instanceIPs("etcdIP", cfg.EtcdIP, cfg.EtcdCount, etcdSubnets, etcdNets)
+		if err != nil {
+			return err
+		}
+		for _, etcdIPAddr := range etcdIPAddrs {
+			for _, controllerIPAddr := range controllerIPAddrs {
+				if etcdIPAddr.Equal(controllerIPAddr) {
+					return fmt.Errorf("etcd and controller instances both use IP %s", etcdIPAddr)
+				}
+			}
+		}
 	}
 
-	controllerIPAddr := net.ParseIP(cfg.ControllerIP)
-	if controllerIPAddr == nil {
-		return fmt.Errorf("invalid controllerIP: %s", cfg.ControllerIP)
+	if cfg.WorkerCount < 0 {
+		return fmt.Errorf("workerCount must not be negative, got %d", cfg.WorkerCount)
 	}
-	if !instancesNet.Contains(controllerIPAddr) {
-		return fmt.Errorf("instanceCIDR (%s) does not contain controllerIP (%s)",
-			cfg.InstanceCIDR,
-			cfg.ControllerIP,
-		)
+	if cfg.WorkerMinCount < 0 || cfg.WorkerMinCount > cfg.WorkerCount {
+		return fmt.Errorf("workerMinCount must be between 0 and workerCount (%d), got %d", cfg.WorkerCount, cfg.WorkerMinCount)
+	}
+	if cfg.WorkerMaxCount != 0 && cfg.WorkerMaxCount < cfg.WorkerCount {
+		return fmt.Errorf("workerMaxCount must not be less than workerCount (%d), got %d", cfg.WorkerCount, cfg.WorkerMaxCount)
+	}
+
+	poolNames := map[string]bool{}
+	for i, pool := range cfg.WorkerPools {
+		if !workerPoolNameRegexp.MatchString(pool.Name) {
+			return fmt.Errorf("name of worker pool %d must be alphanumeric, got %q", i, pool.Name)
+		}
+		//names differing only in their first letter's case share logical IDs
+		logicalName := workerPoolLogicalName(pool.Name)
+		if poolNames[logicalName] {
+			return fmt.Errorf("worker pool name (%s) is used more than once", pool.Name)
+		}
+		poolNames[logicalName] = true
+
+		if pool.Count < 0 {
+			return fmt.Errorf("count of worker pool %s must not be negative, got %d", pool.Name, pool.Count)
+		}
+		if pool.MinCount < 0 || pool.MinCount > pool.Count {
+			return fmt.Errorf("minCount of worker pool %s must be between 0 and count (%d), got %d", pool.Name, pool.Count, pool.MinCount)
+		}
+		if pool.MaxCount != 0 && pool.MaxCount < pool.Count {
+			return fmt.Errorf("maxCount of worker pool %s must not be less than count (%d), got %d", pool.Name, pool.Count, pool.MaxCount)
+		}
+		if pool.RootVolumeSize < 0 {
+			return fmt.Errorf("rootVolumeSize of worker pool %s must not be negative, got %d", pool.Name, pool.RootVolumeSize)
+		}
+		for _, taint := range pool.Taints {
+			if !taintRegexp.MatchString(taint) {
+				return fmt.Errorf("taint %q of worker pool %s must be of the form key=value:effect", taint, pool.Name)
+			}
+		}
+		//the kubelet registers them with --node-labels (1.2) and
+		//--register-with-taints (1.6), and fails to start without
+		if len(pool.NodeLabels) > 0 {
+			if err := cfg.kubernetesVersionAtLeast(1, 2, "nodeLabels of worker pool "+pool.Name); err != nil {
+				return err
+			}
+		}
+		if len(pool.Taints) > 0 {
+			if err := cfg.kubernetesVersionAtLeast(1, 6, "taints of worker pool "+pool.Name); err != nil {
+				return err
+			}
+		}
+	}
+
+	//cluster-autoscaler v0.6.0 speaks the API of Kubernetes 1.7
+	if cfg.ClusterAutoscaler {
+		if err := cfg.kubernetesVersionAtLeast(1, 7, "clusterAutoscaler"); err != nil {
+			return err
+		}
+	}
+
+	for field, arn := range map[string]string{
+		"controllerInstanceProfileARN": cfg.ControllerInstanceProfileARN,
+		"workerInstanceProfileARN":     cfg.WorkerInstanceProfileARN,
+	} {
+		if arn != "" && !instanceProfileARNRegexp.MatchString(arn) {
+			return fmt.Errorf("%s must be an IAM instance profile ARN, got %q", field, arn)
+		}
+	}
+
+	validKeyAlgorithm := false
+	for _, algorithm := range tlsutil.KeyAlgorithms {
+		validKeyAlgorithm = validKeyAlgorithm || cfg.TLS.KeyAlgorithm == algorithm
+	}
+	if !validKeyAlgorithm {
+		return fmt.Errorf("tls.keyAlgorithm must be one of %s, got %q", strings.Join(tlsutil.KeyAlgorithms, ", "), cfg.TLS.KeyAlgorithm)
+	}
+	if cfg.TLS.CAValidityDays <= 0 || cfg.TLS.ValidityDays <= 0 {
+		return errors.New("tls.caValidityDays and tls.validityDays must be positive")
+	}
+	if cfg.TLS.ValidityDays > cfg.TLS.CAValidityDays {
+		return fmt.Errorf("tls.validityDays (%d) must not exceed tls.caValidityDays (%d)", cfg.TLS.ValidityDays, cfg.TLS.CAValidityDays)
+	}
+	if cfg.TLS.UserValidityDays < 0 || cfg.TLS.UserValidityDays > cfg.TLS.CAValidityDays {
+		return fmt.Errorf("tls.userValidityDays (%d) must be between 0 and tls.caValidityDays (%d)", cfg.TLS.UserValidityDays, cfg.TLS.CAValidityDays)
+	}
+	if cfg.TLS.CACommonName == "" {
+		return errors.New("tls.caCommonName must be set")
+	}
+	for _, dnsName := range cfg.TLS.APIServerDNSNames {
+		if dnsName == "" {
+			return errors.New("tls.apiServerDNSNames must not contain empty names")
+		}
+	}
+	for _, ip := range cfg.TLS.APIServerIPs {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid IP in tls.apiServerIPs: %s", ip)
+		}
+	}
+	if cfg.TLS.PerNodeWorkerCertificates {
+		if cfg.TLS.InstanceIdentityCertificate == "" {
+			return errors.New("tls.instanceIdentityCertificate must be set when tls.perNodeWorkerCertificates is enabled")
+		}
+		if _, err := tlsutil.DecodeCertificatePEM([]byte(cfg.TLS.InstanceIdentityCertificate)); err != nil {
+			return fmt.Errorf("invalid tls.instanceIdentityCertificate: %v", err)
+		}
+		if cfg.TLS.KMSKeyARN == "" {
+			return errors.New("tls.kmsKeyARN must be set when tls.perNodeWorkerCertificates is enabled")
+		}
+		if !kmsKeyARNRegexp.MatchString(cfg.TLS.KMSKeyARN) {
+			return fmt.Errorf("invalid tls.kmsKeyARN: %s", cfg.TLS.KMSKeyARN)
+		}
+	}
+	if cfg.CredentialsEncryption != nil {
+		if err := cfg.CredentialsEncryption.valid(); err != nil {
+			return err
+		}
 	}
 
 	podNetIP, podNet, err := net.ParseCIDR(cfg.PodCIDR)
@@ -188,6 +646,13 @@ func (cfg *Config) GenerateDefaultAssets() error {
 }
 
 func (cfg *Config) WriteAssetsToFiles() error {
+	//fail before anything is written if the keys cannot be encrypted
+	if cfg.CredentialsEncryption != nil {
+		if _, err := cfg.CredentialsEncryption.recipients(); err != nil {
+			return err
+		}
+	}
+
 	gitIgnorePath := "./.gitignore"
 	if err := ioutil.WriteFile(gitIgnorePath, []byte("/credentials/*.pem\n"), 0600); err != nil {
 		return fmt.Errorf("Error writing .gitignore file %s: %v", gitIgnorePath, err)
@@ -199,7 +664,7 @@ func (cfg *Config) WriteAssetsToFiles() error {
 		}
 	}
 
-	if err := cfg.TLSConfig.buffers.WriteToFiles(credentialsDir); err != nil {
+	if err := cfg.TLSConfig.writeToFiles(credentialsDir); err != nil {
 		return err
 	}
 
@@ -219,7 +684,7 @@ func (cfg *Config) WriteAssetsToFiles() error {
 }
 
 func (cfg *Config) ReadAssetsFromFiles() error {
-	if err := cfg.TLSConfig.buffers.ReadFromFiles(credentialsDir); err != nil {
+	if err := cfg.TLSConfig.readFromFiles(credentialsDir); err != nil {
 		return err
 	}
 
@@ -238,10 +703,193 @@ func (cfg *Config) ReadAssetsFromFiles() error {
 	return nil
 }
 
+// RotateTLSAssets re-issues the cluster's certificates from the CA read
+// by ReadAssetsFromFiles, for their existing keys unless newKeys is set,
+// and writes them back to the credentials directory.
+func (cfg *Config) RotateTLSAssets(newKeys bool) error {
+	if err := cfg.TLSConfig.rotateLeafTLS(cfg, newKeys); err != nil {
+		return err
+	}
+	//the CRL is re-signed along with the certificates, so it stays current
+	if err := cfg.TLSConfig.generateCRL(cfg); err != nil {
+		return err
+	}
+
+	//the service account key is written too, as it may have been taken
+	//from an apiserver key which no longer exists
+	bufs := append(cfg.TLSConfig.leafBuffers(), cfg.TLSConfig.ServiceAccountKey)
+	if cfg.TLS.PerNodeWorkerCertificates {
+		bufs = append(bufs, cfg.TLSConfig.workerSignerBuffers()...)
+	}
+	if err := cfg.TLSConfig.writeCredentials(credentialsDir, bufs); err != nil {
+		return err
+	}
+	//a new worker signer key has to be encrypted with KMS again
+	if cfg.TLSConfig.WorkerSignerCAKeyCiphertext.Len() == 0 {
+		if err := removeIfExists(filepath.Join(credentialsDir, cfg.TLSConfig.WorkerSignerCAKeyCiphertext.Name)); err != nil {
+			return err
+		}
+	}
+	return cfg.TLSConfig.writeRevocationsToFiles(credentialsDir)
+}
+
+// KMSEncryptionService is the part of the KMS API used to encrypt the
+// worker signer key
+type KMSEncryptionService interface {
+	Encrypt(*kms.EncryptInput) (*kms.EncryptOutput, error)
+}
+
+// EncryptWorkerSignerKey encrypts the worker signer CA key with
+// tls.kmsKeyARN, bound to the cluster by its encryption context, and
+// writes the ciphertext to the credentials directory. It does nothing
+// without tls.perNodeWorkerCertificates, or when the key has already been
+// encrypted.
+func (cfg *Config) EncryptWorkerSignerKey(svc KMSEncryptionService) error {
+	tc := cfg.TLSConfig
+	if !cfg.TLS.PerNodeWorkerCertificates || tc.WorkerSignerCAKeyCiphertext.Len() > 0 {
+		return nil
+	}
+	if tc.WorkerSignerCAKey.Len() == 0 {
+		return fmt.Errorf("%s is missing, run kube-aws certs rotate to issue it", tc.WorkerSignerCAKey.Name)
+	}
+
+	out, err := svc.Encrypt(&kms.EncryptInput{
+		KeyId:     aws.String(cfg.TLS.KMSKeyARN),
+		Plaintext: tc.WorkerSignerCAKey.Bytes(),
+		EncryptionContext: map[string]*string{
+			"KubernetesCluster": aws.String(cfg.ClusterName),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := tc.WorkerSignerCAKeyCiphertext.Write(out.CiphertextBlob); err != nil {
+		return err
+	}
+	return tc.WorkerSignerCAKeyCiphertext.WriteToFile(credentialsDir)
+}
+
+// RevokeCertificate adds a certificate, named after its file in the
+// credentials directory or given by serial number, to the revocation
+// database read by ReadAssetsFromFiles. It then writes the database and
+// the re-generated CRL back to the credentials directory.
+func (cfg *Config) RevokeCertificate(certificate string) (*RevokedCertificate, error) {
+	revoked, err := cfg.TLSConfig.revoke(cfg, certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.TLSConfig.writeRevocationsToFiles(credentialsDir); err != nil {
+		return nil, err
+	}
+	return revoked, nil
+}
+
+// ImportCertificates validates the certificates in dir, signed by an
+// external CA from the requests written by render, and places them in the
+// credentials directory.
+func (cfg *Config) ImportCertificates(dir string) error {
+	for _, leaf := range cfg.TLSConfig.leafCerts(cfg) {
+		if err := readCredential(credentialsDir, leaf.keyBuf); err != nil {
+			return err
+		}
+	}
+
+	if err := cfg.TLSConfig.importCertificates(cfg, dir); err != nil {
+		return err
+	}
+
+	certBufs := blobutil.NamedBufferList{cfg.TLSConfig.CACert}
+	for _, leaf := range cfg.TLSConfig.leafCerts(cfg) {
+		certBufs = append(certBufs, leaf.certBuf)
+	}
+	return certBufs.WriteToFiles(credentialsDir)
+}
+
+// kubeConfigTemplateData is what kubeconfigs are templated with: the
+// cluster config, plus the user they authenticate as and the user's
+// client certificate and key
+type kubeConfigTemplateData struct {
+	*Config
+	User       string
+	ClientCert *blobutil.NamedBuffer
+	ClientKey  *blobutil.NamedBuffer
+}
+
+// TemplateKubeConfig templates the admin kubeconfig
+func (cfg *Config) TemplateKubeConfig() error {
+	return cfg.KubeConfig.Template(kubeConfigTemplateData{
+		Config:     cfg,
+		User:       "admin",
+		ClientCert: cfg.TLSConfig.AdminCert,
+		ClientKey:  cfg.TLSConfig.AdminKey,
+	})
+}
+
+// IssueUserCertificate signs a client certificate for user, as a member
+// of groups, with the CA read by ReadAssetsFromFiles. The certificate, its
+// key and a kubeconfig for the user are written to the credentials
+// directory, named user-<user>.pem, user-<user>-key.pem and
+// kubeconfig-<user>.
+func (cfg *Config) IssueUserCertificate(user string, groups []string) (*x509.Certificate, error) {
+	if !userNameRegexp.MatchString(user) {
+		return nil, fmt.Errorf("user name must consist of letters, digits and . _ @ -, got %q", user)
+	}
+	for _, group := range groups {
+		if group == "" {
+			return nil, errors.New("group names must not be empty")
+		}
+	}
+
+	certBuf := &blobutil.NamedBuffer{Name: "user-" + user + ".pem"}
+	keyBuf := &blobutil.NamedBuffer{Name: "user-" + user + "-key.pem"}
+	kubeConfig := &blobutil.NamedBuffer{Name: "kubeconfig-" + user}
+	buffers := blobutil.NamedBufferList{certBuf, keyBuf, kubeConfig}
+	for _, buf := range buffers {
+		if credentialExists(credentialsDir, buf.Name) {
+			return nil, fmt.Errorf("%s already exists, user %s has been issued a certificate", filepath.Join(credentialsDir, buf.Name), user)
+		}
+	}
+
+	cert, err := cfg.TLSConfig.issueUserTLS(cfg, user, groups, certBuf, keyBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := kubeConfig.ReadFrom(bytes.NewBufferString(defaultKubeConfigTemplate)); err != nil {
+		return nil, err
+	}
+	if err := kubeConfig.Template(kubeConfigTemplateData{
+		Config:     cfg,
+		User:       user,
+		ClientCert: certBuf,
+		ClientKey:  keyBuf,
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.TLSConfig.writeCredentials(credentialsDir, buffers); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
 func (cfg *Config) TemplateAndEncodeAssets() error {
+	//controllers sign the workers' certificates with the worker signer CA,
+	//whose key they only get encrypted with KMS
+	workerSignerBuffers := blobutil.NamedBufferList{}
+	if cfg.TLS.PerNodeWorkerCertificates {
+		workerSignerBuffers = blobutil.NamedBufferList{cfg.TLSConfig.WorkerSignerCACert, cfg.TLSConfig.WorkerSignerCAKeyCiphertext}
+	}
+	for _, buf := range workerSignerBuffers {
+		if buf.Len() == 0 {
+			return fmt.Errorf("tls.perNodeWorkerCertificates requires %s, run kube-aws certs rotate to issue it", buf.Name)
+		}
+	}
 
 	//Template kubeconfig
-	if err := cfg.KubeConfig.Template(cfg); err != nil {
+	if err := cfg.TemplateKubeConfig(); err != nil {
 		return err
 	}
 
@@ -252,9 +900,12 @@ func (cfg *Config) TemplateAndEncodeAssets() error {
 	if err := cfg.TLSConfig.buffers.EncodeBuffers(); err != nil {
 		return err
 	}
+	if err := workerSignerBuffers.EncodeBuffers(); err != nil {
+		return err
+	}
 
 	//Template and encode userdata assets
-	if err := cfg.UserData.buffers.TemplateBuffers(cfg); err != nil {
+	if err := cfg.UserData.templateBuffers(cfg); err != nil {
 		return err
 	}
 
@@ -262,7 +913,7 @@ func (cfg *Config) TemplateAndEncodeAssets() error {
 		return fmt.Errorf("user-data validation error: %s", err)
 	}
 
-	if err := cfg.UserData.buffers.EncodeBuffers(); err != nil {
+	if err := cfg.UserData.rendered.EncodeBuffers(); err != nil {
 		return err
 	}
 
@@ -292,27 +943,238 @@ func newConfigFromBytes(d []byte) (*Config, error) {
 	if err := out.valid(); err != nil {
 		return nil, fmt.Errorf("config file invalid: %v", err)
 	}
+	out.TLSConfig.encryption = out.CredentialsEncryption
 
-	//TODO: this will look different once we support multiple controllers
-	out.ETCDEndpoints = fmt.Sprintf("http://%s:2379", out.ControllerIP)
-	out.APIServers = fmt.Sprintf("http://%s:8080", out.ControllerIP)
-	out.SecureAPIServers = fmt.Sprintf("https://%s:443", out.ControllerIP)
+	out.Subnets = out.instanceSubnets()
+	instanceNets := make([]*net.IPNet, len(out.Subnets))
+	for i, subnet := range out.Subnets {
+		subnet.Name = "Subnet"
+		if i > 0 {
+			subnet.Name = fmt.Sprintf("Subnet%d", i)
+		}
+		subnet.PrivateName = "Private" + subnet.Name
+		_, instanceNets[i], _ = net.ParseCIDR(subnet.InstanceCIDR)
+	}
+
+	//Only controllers are reachable from outside the VPC when workers are private,
+	//and then only on 443 unless SSH access is granted explicitly
+	out.WorkerSubnets = out.Subnets
+	workerNets := instanceNets
+	if out.SSHAccessCIDRs == nil && out.WorkerTopology == "public" {
+		out.SSHAccessCIDRs = []string{"0.0.0.0/0"}
+	}
+	if out.WorkerTopology == "private" {
+		out.WorkerSubnets = privateSubnets(out.Subnets)
+		workerNets = make([]*net.IPNet, len(out.WorkerSubnets))
+		for i, subnet := range out.WorkerSubnets {
+			_, workerNets[i], _ = net.ParseCIDR(subnet.InstanceCIDR)
+		}
+	}
+
+	//Multiple controllers always sit behind a load balancer, which
+	//stays internal unless configured otherwise
+	if lb := out.APIServerLoadBalancer; lb != nil && lb.Scheme == "" {
+		if out.ControllerCount > 1 {
+			lb.Scheme = "internal"
+		} else {
+			lb.Scheme = "internet-facing"
+		}
+	}
+
+	//EC2 instances refer to their instance profile by name, not ARN
+	if out.ControllerInstanceProfileARN != "" {
+		out.ControllerInstanceProfile = instanceProfileARNRegexp.FindStringSubmatch(out.ControllerInstanceProfileARN)[1]
+	}
+
+	out.Controllers = placeInstances("Controller", out.ControllerIP, out.ControllerCount, out.Subnets, instanceNets)
+	out.EtcdInstances = placeInstances("Etcd", out.EtcdIP, out.EtcdCount, out.WorkerSubnets, workerNets)
+
+	if out.EtcdCount > 0 {
+		out.UserData.enableEtcd()
+	}
+
+	etcdMembers := out.etcdMembers()
+	etcdEndpoints := make([]string, len(etcdMembers))
+	etcdInitialCluster := make([]string, len(etcdMembers))
+	for i, member := range etcdMembers {
+		etcdEndpoints[i] = fmt.Sprintf("https://%s:2379", member.IP)
+		etcdInitialCluster[i] = fmt.Sprintf("%s=https://%s:2380", member.IP, member.IP)
+	}
+
+	apiServers := make([]string, len(out.Controllers))
+	secureAPIServers := make([]string, len(out.Controllers))
+	for i, controller := range out.Controllers {
+		apiServers[i] = fmt.Sprintf("http://%s:8080", controller.IP)
+		secureAPIServers[i] = fmt.Sprintf("https://%s:443", controller.IP)
+	}
+
+	out.ETCDEndpoints = strings.Join(etcdEndpoints, ",")
+	out.ETCDInitialCluster = strings.Join(etcdInitialCluster, ",")
+	out.APIServers = strings.Join(apiServers, ",")
+	out.SecureAPIServers = strings.Join(secureAPIServers, ",")
 	out.APIServerEndpoint = fmt.Sprintf("https://%s", out.ExternalDNSName)
 
-    if out.WorkerSpotPrice == "" {
-        out.MinWorkersASG = 0
-    }else{
-        out.MinWorkersASG = out.WorkerCount
-    }
+	//Multiple controllers sit behind a load balancer, which the externalDNSName record routes to
+	if out.ControllerCount > 1 {
+		out.WorkerAPIServerEndpoint = out.APIServerEndpoint
+	} else {
+		out.WorkerAPIServerEndpoint = secureAPIServers[0]
+	}
 
-    out.MaxWorkersASG = out.WorkerCount+1
+	if len(out.WorkerPools) == 0 {
+		pool := &WorkerPool{
+			InstanceType: out.WorkerInstanceType,
+			Count:        out.WorkerCount,
+			MinCount:     out.WorkerMinCount,
+			MaxCount:     out.WorkerMaxCount,
+			SpotPrice:    out.WorkerSpotPrice,
+			LogicalName:  "Worker",
+		}
+		//Spot workers are not scaled in below workerCount unless asked to
+		if pool.MinCount == 0 && out.WorkerSpotPrice != "" {
+			pool.MinCount = out.WorkerCount
+		}
+		out.WorkerPools = []*WorkerPool{pool}
+	}
+	for _, pool := range out.WorkerPools {
+		if pool.LogicalName == "" {
+			pool.LogicalName = workerPoolLogicalName(pool.Name)
+		}
+		if pool.InstanceType == "" {
+			pool.InstanceType = out.WorkerInstanceType
+		}
+		if pool.MaxCount == 0 {
+			pool.MaxCount = pool.Count + 1
+		}
+	}
 
-    if out.AMI == "" {
-        var err error
-        if out.AMI, err = getAMI(out.Region, out.ReleaseChannel); err != nil {
-            return nil, fmt.Errorf("Error getting region map: %v", err)
-        }
-    }
+	if out.AMI == "" {
+		var err error
+		if out.AMI, err = getAMI(out.Region, out.ReleaseChannel); err != nil {
+			return nil, fmt.Errorf("Error getting region map: %v", err)
+		}
+	}
 
 	return out, nil
 }
+
+// instanceSubnets returns the configured subnets, or a single subnet built
+// from availabilityZone and instanceCIDR when none are configured
+func (cfg *Config) instanceSubnets() []*Subnet {
+	if len(cfg.Subnets) > 0 {
+		return cfg.Subnets
+	}
+	return []*Subnet{
+		{
+			AvailabilityZone:    cfg.AvailabilityZone,
+			InstanceCIDR:        cfg.InstanceCIDR,
+			PrivateInstanceCIDR: cfg.PrivateInstanceCIDR,
+		},
+	}
+}
+
+// workerPoolLogicalName returns the name embedded in the logical IDs of a
+// worker pool's resources. Pool names are ASCII alphanumeric, so only the
+// first byte needs upper-casing
+func workerPoolLogicalName(name string) string {
+	if name == "" {
+		return "Worker"
+	}
+	return "Worker" + strings.ToUpper(name[:1]) + name[1:]
+}
+
+// privateSubnets returns the private counterparts of subnets, which share
+// their availability zones
+func privateSubnets(subnets []*Subnet) []*Subnet {
+	private := make([]*Subnet, len(subnets))
+	for i, subnet := range subnets {
+		private[i] = &Subnet{
+			AvailabilityZone: subnet.AvailabilityZone,
+			InstanceCIDR:     subnet.PrivateInstanceCIDR,
+			SubnetID:         subnet.PrivateSubnetID,
+			Name:             subnet.PrivateName,
+		}
+	}
+	return private
+}
+
+// instanceIPs validates the addresses of count instances whose first
+// address is given by the config field name, and returns them
+func instanceIPs(field, firstIP string, count int, subnets []*Subnet, subnetNets []*net.IPNet) ([]net.IP, error) {
+	firstIPAddr := net.ParseIP(firstIP)
+	if firstIPAddr == nil {
+		return nil, fmt.Errorf("invalid %s: %s", field, firstIP)
+	}
+	if !subnetNets[0].Contains(firstIPAddr) {
+		return nil, fmt.Errorf("instanceCIDR (%s) does not contain %s (%s)",
+			subnets[0].InstanceCIDR,
+			field,
+			firstIP,
+		)
+	}
+
+	ips := spreadIPs(firstIPAddr, count, subnetNets)
+	for i, ip := range ips {
+		if !subnetNets[i%len(subnetNets)].Contains(ip) {
+			return nil, fmt.Errorf("instanceCIDR (%s) does not contain %s of instance %d (%s)",
+				subnets[i%len(subnets)].InstanceCIDR,
+				field,
+				i+1,
+				ip,
+			)
+		}
+	}
+	return ips, nil
+}
+
+// etcdMembers returns the instances running etcd: the controllers, unless a
+// dedicated etcd tier is configured
+func (cfg *Config) etcdMembers() []Instance {
+	if cfg.EtcdCount > 0 {
+		return cfg.EtcdInstances
+	}
+	return cfg.Controllers
+}
+
+// placeInstances spreads count instances of a role round-robin across subnets
+func placeInstances(role, firstIP string, count int, subnets []*Subnet, subnetNets []*net.IPNet) []Instance {
+	instances := make([]Instance, count)
+	for i, ip := range spreadIPs(net.ParseIP(firstIP), count, subnetNets) {
+		name := role
+		if i > 0 {
+			name = fmt.Sprintf("%s%d", role, i)
+		}
+		instances[i] = Instance{
+			Name:   name,
+			IP:     ip.String(),
+			Subnet: subnets[i%len(subnets)],
+		}
+	}
+	return instances
+}
+
+// spreadIPs spreads count addresses round-robin across subnets. Each
+// address has the host offset firstIP has within the first subnet, and
+// addresses sharing a subnet are consecutive.
+func spreadIPs(firstIP net.IP, count int, subnets []*net.IPNet) []net.IP {
+	offset := int(ipToUint32(firstIP) - ipToUint32(subnets[0].IP))
+	ips := make([]net.IP, count)
+	for i := range ips {
+		ips[i] = incrementIP(subnets[i%len(subnets)].IP, offset+i/len(subnets))
+	}
+	return ips
+}
+
+// incrementIP returns the IPv4 address n addresses after ip
+func incrementIP(ip net.IP, n int) net.IP {
+	v := ipToUint32(ip) + uint32(n)
+	return net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0
+	}
+	return uint32(ip4[0])<<24 | uint32(ip4[1])<<16 | uint32(ip4[2])<<8 | uint32(ip4[3])
+}
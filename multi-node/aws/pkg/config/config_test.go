@@ -1,6 +1,7 @@
 package config
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -29,6 +30,17 @@ podCIDR: 10.6.0.0/16
 serviceCIDR: 10.5.0.0/16
 kubernetesServiceIP: 10.5.100.100
 dnsServiceIP: 10.5.100.101
+`, `
+vpcCIDR: 10.4.0.0/16
+instanceCIDR: 10.4.3.0/24
+controllerIP: 10.4.3.5
+controllerCount: 3
+apiServerLoadBalancer:
+  hostedZoneID: ZXXXXXXXXXXXXX
+podCIDR: 10.6.0.0/16
+serviceCIDR: 10.5.0.0/16
+kubernetesServiceIP: 10.5.100.100
+dnsServiceIP: 10.5.100.101
 `,
 }
 
@@ -66,6 +78,25 @@ podCIDR: 172.4.0.0/16
 serviceCIDR: 172.5.0.0/16
 kubernetesServiceIP: 172.5.100.100
 dnsServiceIP: 172.6.100.101 #dnsServiceIP not in service CIDR
+`, `
+vpcCIDR: 10.4.0.0/16
+instanceCIDR: 10.4.3.0/24
+controllerIP: 10.4.3.254
+controllerCount: 3 #controllers run past the end of instanceCIDR
+apiServerLoadBalancer:
+  hostedZoneID: ZXXXXXXXXXXXXX
+podCIDR: 10.6.0.0/16
+serviceCIDR: 10.5.0.0/16
+kubernetesServiceIP: 10.5.100.100
+dnsServiceIP: 10.5.100.101
+`, `
+controllerCount: 0 #at least one controller is required
+`, `
+etcdCount: 3
+etcdIP: 10.0.0.49 #second etcd node collides with controllerIP
+`, `
+etcdCount: 1
+etcdIP: 10.0.1.20 #etcdIP not in instanceCIDR
 `,
 }
 
@@ -86,3 +117,489 @@ func TestNetworkValidation(t *testing.T) {
 	}
 
 }
+
+func TestMultipleControllers(t *testing.T) {
+	cfg, err := newConfigFromBytes([]byte(MinimalConfigYaml + `
+controllerCount: 3
+apiServerLoadBalancer:
+  hostedZoneID: ZXXXXXXXXXXXXX
+`))
+	if err != nil {
+		t.Fatalf("failed generating config: %v", err)
+	}
+
+	if len(cfg.Controllers) != 3 {
+		t.Fatalf("expected 3 controllers, got %d", len(cfg.Controllers))
+	}
+
+	expectedIPs := []string{"10.0.0.50", "10.0.0.51", "10.0.0.52"}
+	for i, controller := range cfg.Controllers {
+		if controller.IP != expectedIPs[i] {
+			t.Errorf("controller %d: expected IP %s, got %s", i, expectedIPs[i], controller.IP)
+		}
+	}
+
+	if cfg.Controllers[0].Name != "Controller" {
+		t.Errorf("first controller must keep the name Controller, got %s", cfg.Controllers[0].Name)
+	}
+
+	expectedEndpoints := "https://10.0.0.50:2379,https://10.0.0.51:2379,https://10.0.0.52:2379"
+	if cfg.ETCDEndpoints != expectedEndpoints {
+		t.Errorf("expected etcd endpoints %s, got %s", expectedEndpoints, cfg.ETCDEndpoints)
+	}
+
+	if cfg.WorkerAPIServerEndpoint != cfg.APIServerEndpoint {
+		t.Errorf("workers should reach multiple controllers through %s, got %s",
+			cfg.APIServerEndpoint, cfg.WorkerAPIServerEndpoint)
+	}
+}
+
+var goodSubnetConfigs []string = []string{
+	`
+subnets:
+  - availabilityZone: us-west-1a
+    instanceCIDR: 10.0.0.0/24
+  - availabilityZone: us-west-1c
+    instanceCIDR: 10.0.1.0/24
+`, `
+vpcCIDR: 10.4.0.0/16
+controllerIP: 10.4.3.5
+controllerCount: 3
+apiServerLoadBalancer:
+  hostedZoneID: ZXXXXXXXXXXXXX
+subnets:
+  - availabilityZone: us-west-1a
+    instanceCIDR: 10.4.3.0/24
+  - availabilityZone: us-west-1b
+    instanceCIDR: 10.4.4.0/24
+  - availabilityZone: us-west-1c
+    instanceCIDR: 10.4.5.0/24
+`, `
+workerTopology: private
+subnets:
+  - availabilityZone: us-west-1a
+    instanceCIDR: 10.0.0.0/24
+    privateInstanceCIDR: 10.0.128.0/24
+  - availabilityZone: us-west-1c
+    instanceCIDR: 10.0.1.0/24
+    privateInstanceCIDR: 10.0.129.0/24
+`, `
+existingVPC:
+  vpcID: vpc-xxxx
+subnets:
+  - availabilityZone: us-west-1a
+    instanceCIDR: 10.0.0.0/24
+    subnetID: subnet-xxxx
+  - availabilityZone: us-west-1c
+    instanceCIDR: 10.0.1.0/24
+    subnetID: subnet-yyyy
+`, `
+existingVPC:
+  vpcID: vpc-xxxx
+  routeTableID: rtb-xxxx
+  securityGroupIDs:
+    - sg-xxxx
+workerTopology: private
+subnets:
+  - availabilityZone: us-west-1a
+    instanceCIDR: 10.0.0.0/24
+    privateInstanceCIDR: 10.0.128.0/24
+    privateSubnetID: subnet-xxxx
+`,
+}
+
+var incorrectSubnetConfigs []string = []string{
+	`
+availabilityZone: us-west-1c #availabilityZone and subnets are exclusive
+subnets:
+  - availabilityZone: us-west-1a
+    instanceCIDR: 10.0.0.0/24
+`, `
+subnets:
+  - availabilityZone: us-west-1a
+    instanceCIDR: 10.0.0.0/24
+  - availabilityZone: us-west-1c
+    instanceCIDR: 10.0.0.128/25 #overlaps with first subnet
+`, `
+subnets:
+  - availabilityZone: us-west-1a
+    instanceCIDR: 10.0.0.0/24
+  - availabilityZone: us-west-1c
+    instanceCIDR: 10.1.0.0/24 #not in vpcCIDR
+`, `
+subnets:
+  - availabilityZone: us-west-1a
+    instanceCIDR: 10.0.0.0/24
+  - availabilityZone: us-west-1a #availabilityZone used twice
+    instanceCIDR: 10.0.1.0/24
+`, `
+subnets:
+  - instanceCIDR: 10.0.0.0/24 #missing availabilityZone
+`, `
+controllerIP: 10.0.0.50
+controllerCount: 2
+apiServerLoadBalancer:
+  hostedZoneID: ZXXXXXXXXXXXXX
+subnets:
+  - availabilityZone: us-west-1a
+    instanceCIDR: 10.0.0.0/24
+  - availabilityZone: us-west-1c
+    instanceCIDR: 10.0.1.0/27 #too small for second controller's offset
+`, `
+workerTopology: private
+subnets:
+  - availabilityZone: us-west-1a
+    instanceCIDR: 10.0.0.0/24 #missing privateInstanceCIDR
+`, `
+workerTopology: private
+subnets:
+  - availabilityZone: us-west-1a
+    instanceCIDR: 10.0.0.0/24
+    privateInstanceCIDR: 10.0.0.128/25 #overlaps with instanceCIDR
+`, `
+workerTopology: private
+subnets:
+  - availabilityZone: us-west-1a
+    instanceCIDR: 10.0.0.0/24
+    privateInstanceCIDR: 10.1.0.0/24 #not in vpcCIDR
+`, `
+subnets:
+  - availabilityZone: us-west-1a
+    instanceCIDR: 10.0.0.0/24
+    privateInstanceCIDR: 10.0.128.0/24 #workerTopology is not private
+`, `
+workerTopology: hidden #not a topology
+subnets:
+  - availabilityZone: us-west-1a
+    instanceCIDR: 10.0.0.0/24
+`, `
+subnets:
+  - availabilityZone: us-west-1a
+    instanceCIDR: 10.0.0.0/24
+    subnetID: subnet-xxxx #existingVPC not set
+`, `
+existingVPC:
+  vpcID: vpc-xxxx
+subnets:
+  - availabilityZone: us-west-1a
+    instanceCIDR: 10.0.0.0/24
+    subnetID: subnet-xxxx
+  - availabilityZone: us-west-1c
+    instanceCIDR: 10.0.1.0/24 #created by the stack without a routeTableID
+`,
+}
+
+func TestSubnetValidation(t *testing.T) {
+	minimalConfig := strings.Replace(MinimalConfigYaml, "availabilityZone: us-west-1c\n", "", 1)
+
+	for _, subnetConfig := range goodSubnetConfigs {
+		configBody := minimalConfig + subnetConfig
+		if _, err := newConfigFromBytes([]byte(configBody)); err != nil {
+			t.Errorf("Correct config tested invalid: %s\n%s", err, subnetConfig)
+		}
+	}
+
+	for _, subnetConfig := range incorrectSubnetConfigs {
+		configBody := minimalConfig + subnetConfig
+		if _, err := newConfigFromBytes([]byte(configBody)); err == nil {
+			t.Errorf("Incorrect config tested valid, expected error:\n%s", subnetConfig)
+		}
+	}
+}
+
+func TestControllerPlacement(t *testing.T) {
+	configBody := strings.Replace(MinimalConfigYaml, "availabilityZone: us-west-1c\n", "", 1) + `
+controllerIP: 10.0.0.50
+controllerCount: 3
+apiServerLoadBalancer:
+  hostedZoneID: ZXXXXXXXXXXXXX
+subnets:
+  - availabilityZone: us-west-1a
+    instanceCIDR: 10.0.0.0/24
+  - availabilityZone: us-west-1c
+    instanceCIDR: 10.0.1.0/24
+`
+	cfg, err := newConfigFromBytes([]byte(configBody))
+	if err != nil {
+		t.Fatalf("failed generating config: %v", err)
+	}
+
+	expected := []struct {
+		IP               string
+		AvailabilityZone string
+	}{
+		{"10.0.0.50", "us-west-1a"},
+		{"10.0.1.50", "us-west-1c"},
+		{"10.0.0.51", "us-west-1a"},
+	}
+	for i, controller := range cfg.Controllers {
+		if controller.IP != expected[i].IP {
+			t.Errorf("controller %d: expected IP %s, got %s", i, expected[i].IP, controller.IP)
+		}
+		if controller.Subnet.AvailabilityZone != expected[i].AvailabilityZone {
+			t.Errorf("controller %d: expected availabilityZone %s, got %s",
+				i, expected[i].AvailabilityZone, controller.Subnet.AvailabilityZone)
+		}
+	}
+}
+
+func TestEtcdTier(t *testing.T) {
+	cfg, err := newConfigFromBytes([]byte(MinimalConfigYaml + "etcdCount: 3\n"))
+	if err != nil {
+		t.Fatalf("failed generating config: %v", err)
+	}
+
+	if len(cfg.EtcdInstances) != 3 {
+		t.Fatalf("expected 3 etcd instances, got %d", len(cfg.EtcdInstances))
+	}
+
+	expectedEndpoints := "https://10.0.0.20:2379,https://10.0.0.21:2379,https://10.0.0.22:2379"
+	if cfg.ETCDEndpoints != expectedEndpoints {
+		t.Errorf("expected etcd endpoints %s, got %s", expectedEndpoints, cfg.ETCDEndpoints)
+	}
+
+	found := false
+	for _, buffer := range cfg.UserData.buffers {
+		if buffer == cfg.UserData.Etcd {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("etcd cloud-config not rendered for dedicated etcd tier")
+	}
+}
+
+func TestPrivateWorkerTopology(t *testing.T) {
+	configBody := MinimalConfigYaml + `
+workerTopology: private
+privateInstanceCIDR: 10.0.128.0/24
+etcdCount: 1
+etcdIP: 10.0.128.20
+`
+	cfg, err := newConfigFromBytes([]byte(configBody))
+	if err != nil {
+		t.Fatalf("failed generating config: %v", err)
+	}
+
+	if len(cfg.WorkerSubnets) != 1 || cfg.WorkerSubnets[0].Name != "PrivateSubnet" {
+		t.Fatalf("expected workers in PrivateSubnet, got %+v", cfg.WorkerSubnets)
+	}
+	if cfg.Controllers[0].Subnet.Name != "Subnet" {
+		t.Errorf("expected controller in Subnet, got %s", cfg.Controllers[0].Subnet.Name)
+	}
+	if cfg.EtcdInstances[0].Subnet.Name != "PrivateSubnet" {
+		t.Errorf("expected etcd instance in PrivateSubnet, got %s", cfg.EtcdInstances[0].Subnet.Name)
+	}
+	if len(cfg.SSHAccessCIDRs) != 0 {
+		t.Errorf("expected no SSH access from outside the VPC by default, got %v", cfg.SSHAccessCIDRs)
+	}
+
+	cfg, err = newConfigFromBytes([]byte(MinimalConfigYaml))
+	if err != nil {
+		t.Fatalf("failed generating config: %v", err)
+	}
+	if len(cfg.SSHAccessCIDRs) != 1 || cfg.SSHAccessCIDRs[0] != "0.0.0.0/0" {
+		t.Errorf("expected SSH access from anywhere for public workers, got %v", cfg.SSHAccessCIDRs)
+	}
+
+	if _, err := newConfigFromBytes([]byte(configBody + `
+sshAccessCIDRs:
+  - 203.0.113.0/24
+  - 203.0.113.0/24 #listed twice
+`)); err == nil {
+		t.Errorf("expected error for duplicate sshAccessCIDRs entry")
+	}
+
+	if _, err := newConfigFromBytes([]byte(MinimalConfigYaml + `
+workerTopology: private
+privateInstanceCIDR: 10.0.128.0/24
+etcdCount: 1
+`)); err == nil {
+		t.Errorf("expected error for etcdIP outside privateInstanceCIDR")
+	}
+}
+
+func TestAPIServerLoadBalancer(t *testing.T) {
+	if _, err := newConfigFromBytes([]byte(MinimalConfigYaml + "controllerCount: 2\n")); err == nil {
+		t.Errorf("expected error for multiple controllers without a hosted zone for externalDNSName")
+	}
+
+	cfg, err := newConfigFromBytes([]byte(MinimalConfigYaml + `
+controllerCount: 2
+apiServerLoadBalancer:
+  hostedZoneID: ZXXXXXXXXXXXXX
+`))
+	if err != nil {
+		t.Fatalf("failed generating config: %v", err)
+	}
+	if cfg.APIServerLoadBalancer == nil || cfg.APIServerLoadBalancer.Scheme != "internal" {
+		t.Errorf("expected an internal load balancer for multiple controllers, got %+v", cfg.APIServerLoadBalancer)
+	}
+
+	cfg, err = newConfigFromBytes([]byte(MinimalConfigYaml + `
+apiServerLoadBalancer:
+  hostedZoneID: ZXXXXXXXXXXXXX
+`))
+	if err != nil {
+		t.Fatalf("failed generating config: %v", err)
+	}
+	if cfg.APIServerLoadBalancer.Scheme != "internet-facing" {
+		t.Errorf("expected an internet-facing load balancer, got %s", cfg.APIServerLoadBalancer.Scheme)
+	}
+
+	if _, err := newConfigFromBytes([]byte(MinimalConfigYaml + `
+apiServerLoadBalancer:
+  scheme: external
+`)); err == nil {
+		t.Errorf("expected error for invalid load balancer scheme")
+	}
+}
+
+func TestWorkerPools(t *testing.T) {
+	cfg, err := newConfigFromBytes([]byte(MinimalConfigYaml))
+	if err != nil {
+		t.Fatalf("failed generating config: %v", err)
+	}
+	if len(cfg.WorkerPools) != 1 || cfg.WorkerPools[0].LogicalName != "Worker" {
+		t.Fatalf("expected a single default worker pool, got %+v", cfg.WorkerPools)
+	}
+
+	cfg, err = newConfigFromBytes([]byte(MinimalConfigYaml + `
+kubernetesVersion: v1.6.1_coreos.0
+workerPools:
+  - name: compute
+    instanceType: c4.xlarge
+    count: 3
+    nodeLabels:
+      zone: b
+      pool: compute
+  - name: memory
+    count: 2
+    minCount: 1
+    maxCount: 4
+    taints:
+      - dedicated=memory:NoSchedule
+`))
+	if err != nil {
+		t.Fatalf("failed generating config: %v", err)
+	}
+	compute, memory := cfg.WorkerPools[0], cfg.WorkerPools[1]
+	if compute.LogicalName != "WorkerCompute" || memory.LogicalName != "WorkerMemory" {
+		t.Errorf("unexpected logical names %s, %s", compute.LogicalName, memory.LogicalName)
+	}
+	if compute.MaxCount != 4 || memory.MaxCount != 4 {
+		t.Errorf("unexpected max counts %d, %d", compute.MaxCount, memory.MaxCount)
+	}
+	if memory.InstanceType != cfg.WorkerInstanceType {
+		t.Errorf("expected memory pool to default to instance type %s, got %s", cfg.WorkerInstanceType, memory.InstanceType)
+	}
+	if labels := compute.NodeLabelList(); labels != "pool=compute,zone=b" {
+		t.Errorf("unexpected node labels %s", labels)
+	}
+
+	for _, poolConfig := range []string{`
+workerPools:
+  - name: compute-pool #not alphanumeric
+    count: 1
+`, `
+workerPools:
+  - name: compute
+  - name: compute #used twice
+`, `
+workerPools:
+  - name: compute
+  - name: Compute #same logical IDs as compute
+`, `
+workerPools:
+  - name: compute
+    count: 3
+    minCount: 4 #more than count
+`, `
+workerPools:
+  - name: compute
+    count: 3
+    maxCount: 2 #less than count
+`, `
+workerPools:
+  - name: compute
+    taints:
+      - dedicated #missing effect
+`, `
+workerPools:
+  - name: compute
+    nodeLabels: #kubelet too old for --node-labels
+      pool: compute
+`, `
+kubernetesVersion: v1.5.4_coreos.0
+workerPools:
+  - name: compute
+    taints: #kubelet too old for --register-with-taints
+      - dedicated=compute:NoSchedule
+`, `
+kubernetesVersion: latest
+workerPools:
+  - name: compute
+    nodeLabels: #kubelet version unknown
+      pool: compute
+`,
+	} {
+		if _, err := newConfigFromBytes([]byte(MinimalConfigYaml + poolConfig)); err == nil {
+			t.Errorf("Incorrect config tested valid, expected error:\n%s", poolConfig)
+		}
+	}
+}
+
+func TestWorkerCountBounds(t *testing.T) {
+	for _, tc := range []struct {
+		Config   string
+		MinCount int
+		MaxCount int
+	}{
+		{"workerCount: 2\n", 0, 3},
+		{"workerCount: 2\nworkerSpotPrice: \"0.05\"\n", 2, 3},
+		{"workerCount: 2\nworkerMinCount: 1\nworkerMaxCount: 10\n", 1, 10},
+	} {
+		cfg, err := newConfigFromBytes([]byte(MinimalConfigYaml + tc.Config))
+		if err != nil {
+			t.Errorf("Correct config tested invalid: %s\n%s", err, tc.Config)
+			continue
+		}
+		pool := cfg.WorkerPools[0]
+		if pool.MinCount != tc.MinCount || pool.MaxCount != tc.MaxCount {
+			t.Errorf("expected bounds %d-%d, got %d-%d\n%s", tc.MinCount, tc.MaxCount, pool.MinCount, pool.MaxCount, tc.Config)
+		}
+	}
+
+	for _, boundsConfig := range []string{
+		"workerCount: 2\nworkerMinCount: 3\n",
+		"workerCount: 2\nworkerMaxCount: 1\n",
+		"workerCount: -1\n",
+		"clusterAutoscaler: true\n", //v1.1.7 is too old for cluster-autoscaler
+	} {
+		if _, err := newConfigFromBytes([]byte(MinimalConfigYaml + boundsConfig)); err == nil {
+			t.Errorf("Incorrect config tested valid, expected error:\n%s", boundsConfig)
+		}
+	}
+}
+
+func TestInstanceProfileARNs(t *testing.T) {
+	cfg, err := newConfigFromBytes([]byte(MinimalConfigYaml + `
+controllerInstanceProfileARN: arn:aws:iam::123456789012:instance-profile/kube/controller
+workerInstanceProfileARN: arn:aws:iam::123456789012:instance-profile/worker
+`))
+	if err != nil {
+		t.Fatalf("Correct config tested invalid: %s", err)
+	}
+	if cfg.ControllerInstanceProfile != "controller" {
+		t.Errorf("expected controller instance profile name controller, got %s", cfg.ControllerInstanceProfile)
+	}
+
+	for _, arnConfig := range []string{
+		"controllerInstanceProfileARN: kube-controller\n",
+		"workerInstanceProfileARN: arn:aws:iam::123456789012:role/kube-worker\n",
+	} {
+		if _, err := newConfigFromBytes([]byte(MinimalConfigYaml + arnConfig)); err == nil {
+			t.Errorf("Incorrect config tested valid, expected error:\n%s", arnConfig)
+		}
+	}
+}
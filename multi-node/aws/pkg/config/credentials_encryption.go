@@ -0,0 +1,203 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/coreos/coreos-kubernetes/multi-node/aws/pkg/blobutil"
+)
+
+const (
+	//encrypted files are named after the plaintext they hold, plus this
+	//suffix, so that they can be decrypted with the age command as well
+	EncryptedSuffix = ".age"
+
+	//passphraseEnv holds the passphrase of credentials encrypted with
+	//credentialsEncryption.passphrase
+	passphraseEnv = "KUBE_AWS_PASSPHRASE"
+	//identityFileEnv is the path of an age identity file, holding the
+	//private keys of credentialsEncryption.recipients
+	identityFileEnv = "KUBE_AWS_IDENTITY_FILE"
+)
+
+// CredentialsEncryption has the private keys written to the credentials
+// directory, and the stack template exported by up --export, encrypted
+// with age. Either to the recipients' public keys, or with the passphrase
+// in $KUBE_AWS_PASSPHRASE.
+type CredentialsEncryption struct {
+	Recipients []string `yaml:"recipients"`
+	Passphrase bool     `yaml:"passphrase"`
+}
+
+func (e *CredentialsEncryption) valid() error {
+	if e.Passphrase == (len(e.Recipients) > 0) {
+		return errors.New("credentialsEncryption must have either recipients or passphrase set")
+	}
+	for _, recipient := range e.Recipients {
+		if _, err := age.ParseX25519Recipient(recipient); err != nil {
+			return fmt.Errorf("invalid credentialsEncryption recipient %q: %v", recipient, err)
+		}
+	}
+	return nil
+}
+
+func (e *CredentialsEncryption) recipients() ([]age.Recipient, error) {
+	if e.Passphrase {
+		passphrase := os.Getenv(passphraseEnv)
+		if passphrase == "" {
+			return nil, fmt.Errorf("credentialsEncryption.passphrase requires $%s to be set", passphraseEnv)
+		}
+		recipient, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Recipient{recipient}, nil
+	}
+
+	recipients := []age.Recipient{}
+	for _, r := range e.Recipients {
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, nil
+}
+
+// Encrypt returns data encrypted to the configured recipients, or with
+// the passphrase
+func (e *CredentialsEncryption) Encrypt(data []byte) ([]byte, error) {
+	recipients, err := e.recipients()
+	if err != nil {
+		return nil, err
+	}
+
+	out := &bytes.Buffer{}
+	w, err := age.Encrypt(out, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// decryptionIdentities returns the identities given by $KUBE_AWS_PASSPHRASE
+// and $KUBE_AWS_IDENTITY_FILE, whichever are set
+func decryptionIdentities() ([]age.Identity, error) {
+	identities := []age.Identity{}
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		identity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	if path := os.Getenv(identityFileEnv); path != "" {
+		in, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening %s : %v", path, err)
+		}
+		defer in.Close()
+		fileIdentities, err := age.ParseIdentities(in)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing identity file %s : %v", path, err)
+		}
+		identities = append(identities, fileIdentities...)
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("set $%s or $%s to decrypt it", passphraseEnv, identityFileEnv)
+	}
+	return identities, nil
+}
+
+func decrypt(data []byte) ([]byte, error) {
+	identities, err := decryptionIdentities()
+	if err != nil {
+		return nil, err
+	}
+	r, err := age.Decrypt(bytes.NewReader(data), identities...)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// isPrivateKey reports whether the credentials file name holds key material
+func isPrivateKey(name string) bool {
+	return strings.HasSuffix(name, "-key.pem")
+}
+
+// credentialExists reports whether the credentials file name exists in
+// dir, encrypted or not
+func credentialExists(dir, name string) bool {
+	for _, path := range []string{name, name + EncryptedSuffix} {
+		if _, err := os.Stat(filepath.Join(dir, path)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// readCredential reads buf from dir, decrypting the file suffixed with
+// EncryptedSuffix instead when there is one
+func readCredential(dir string, buf *blobutil.NamedBuffer) error {
+	path := filepath.Join(dir, buf.Name+EncryptedSuffix)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return buf.ReadFromFile(dir)
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading %s : %v", path, err)
+	}
+
+	plaintext, err := decrypt(data)
+	if err != nil {
+		return fmt.Errorf("Error decrypting %s : %v", path, err)
+	}
+	buf.Reset()
+	_, err = buf.Write(plaintext)
+	return err
+}
+
+// writeCredential writes buf to dir. Private keys are encrypted to the
+// file suffixed with EncryptedSuffix when enc is set, and the copy in the
+// other form, if any, is removed so that the two cannot disagree.
+func writeCredential(enc *CredentialsEncryption, dir string, buf *blobutil.NamedBuffer) error {
+	plainPath := filepath.Join(dir, buf.Name)
+	encryptedPath := plainPath + EncryptedSuffix
+
+	if enc == nil || !isPrivateKey(buf.Name) {
+		if err := buf.WriteToFile(dir); err != nil {
+			return err
+		}
+		return removeIfExists(encryptedPath)
+	}
+
+	data, err := enc.Encrypt(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("Error encrypting %s : %v", plainPath, err)
+	}
+	if err := ioutil.WriteFile(encryptedPath, data, 0600); err != nil {
+		return fmt.Errorf("Error writing %s : %v", encryptedPath, err)
+	}
+	return removeIfExists(plainPath)
+}
+
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error removing %s : %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestCredentialsEncryptionValidation(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("failed generating identity: %v", err)
+	}
+
+	for _, encryptionConfig := range []string{
+		`
+credentialsEncryption:
+  recipients: []
+`, `
+credentialsEncryption:
+  passphrase: true
+  recipients:
+    - ` + identity.Recipient().String() + `
+`, `
+credentialsEncryption:
+  recipients:
+    - age1notarecipient
+`,
+	} {
+		if _, err := newConfigFromBytes([]byte(MinimalConfigYaml + encryptionConfig)); err == nil {
+			t.Errorf("expected error parsing invalid config:\n%s", encryptionConfig)
+		}
+	}
+}
+
+func TestCredentialsEncryption(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("failed generating identity: %v", err)
+	}
+	configYaml := MinimalConfigYaml + fmt.Sprintf(`
+credentialsEncryption:
+  recipients:
+    - %s
+`, identity.Recipient())
+
+	config, err := newConfigFromBytes([]byte(configYaml))
+	if err != nil {
+		t.Fatalf("failed generating config: %v", err)
+	}
+	if err := config.TLSConfig.generateAllTLS(config); err != nil {
+		t.Fatalf("failed generating tls: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "kube-aws-encryption")
+	if err != nil {
+		t.Fatalf("failed creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	//a plaintext key left over from before encryption was enabled
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca-key.pem"), []byte("stale"), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := config.TLSConfig.writeToFiles(dir); err != nil {
+		t.Fatalf("failed writing tls assets: %v", err)
+	}
+
+	for _, buf := range config.TLSConfig.buffers {
+		_, plainErr := os.Stat(filepath.Join(dir, buf.Name))
+		_, encryptedErr := os.Stat(filepath.Join(dir, buf.Name+EncryptedSuffix))
+		if isPrivateKey(buf.Name) {
+			if !os.IsNotExist(plainErr) || encryptedErr != nil {
+				t.Errorf("%s was not written encrypted only", buf.Name)
+			}
+		} else if plainErr != nil || !os.IsNotExist(encryptedErr) {
+			t.Errorf("%s was not written in plaintext only", buf.Name)
+		}
+	}
+
+	os.Unsetenv(passphraseEnv)
+	os.Unsetenv(identityFileEnv)
+	read, err := newConfigFromBytes([]byte(configYaml))
+	if err != nil {
+		t.Fatalf("failed generating config: %v", err)
+	}
+	if err := read.TLSConfig.readFromFiles(dir); err == nil {
+		t.Errorf("encrypted keys read without an identity")
+	}
+
+	identityFile := filepath.Join(dir, "identity.txt")
+	if err := ioutil.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+	os.Setenv(identityFileEnv, identityFile)
+	defer os.Unsetenv(identityFileEnv)
+
+	if err := read.TLSConfig.readFromFiles(dir); err != nil {
+		t.Fatalf("failed reading encrypted tls assets: %v", err)
+	}
+	for i, buf := range read.TLSConfig.buffers {
+		if !bytes.Equal(buf.Bytes(), config.TLSConfig.buffers[i].Bytes()) {
+			t.Errorf("%s differs after decryption", buf.Name)
+		}
+	}
+
+	//reading does not depend on the config: the keys are decrypted
+	//transparently once encryption is turned off again
+	plain, err := newConfigFromBytes([]byte(MinimalConfigYaml))
+	if err != nil {
+		t.Fatalf("failed generating config: %v", err)
+	}
+	if err := plain.TLSConfig.readFromFiles(dir); err != nil {
+		t.Fatalf("failed reading encrypted tls assets: %v", err)
+	}
+	if err := plain.TLSConfig.writeToFiles(dir); err != nil {
+		t.Fatalf("failed writing tls assets: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ca-key.pem"+EncryptedSuffix)); !os.IsNotExist(err) {
+		t.Errorf("encrypted ca key left behind after writing it in plaintext")
+	}
+}
+
+func TestCredentialsPassphrase(t *testing.T) {
+	encryption := &CredentialsEncryption{Passphrase: true}
+
+	os.Unsetenv(passphraseEnv)
+	if _, err := encryption.Encrypt([]byte("secret")); err == nil {
+		t.Errorf("encrypted without a passphrase")
+	}
+
+	os.Setenv(passphraseEnv, "correct horse battery staple")
+	defer os.Unsetenv(passphraseEnv)
+	data, err := encryption.Encrypt([]byte("secret"))
+	if err != nil {
+		t.Fatalf("failed encrypting: %v", err)
+	}
+	plaintext, err := decrypt(data)
+	if err != nil {
+		t.Fatalf("failed decrypting: %v", err)
+	}
+	if string(plaintext) != "secret" {
+		t.Errorf("expected secret, got %q", plaintext)
+	}
+
+	os.Setenv(passphraseEnv, "wrong")
+	if _, err := decrypt(data); err == nil {
+		t.Errorf("decrypted with the wrong passphrase")
+	}
+}
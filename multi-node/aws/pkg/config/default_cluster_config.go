@@ -9,7 +9,8 @@ clusterName: {{.ClusterName}}
 
 # DNS name routable to the Kubernetes controller nodes
 # from worker nodes and external clients. The deployer
-# is responsible for making this name routable
+# is responsible for making this name routable, unless
+# apiServerLoadBalancer.hostedZoneID is set below
 externalDNSName: {{.ExternalDNSName}}
 
 ### DO NOT CHANGE PARAMETERS ABOVE HERE ###
@@ -22,6 +23,7 @@ keyName: {{.KeyName}}
 region: {{.Region}}
 
 # Availability Zone to provision Kubernetes cluster
+# (remove when using subnets below)
 availabilityZone: {{.AvailabilityZone}}
 
 # CoreOS Release Channel
@@ -33,6 +35,22 @@ releaseChannel: alpha
 # Kubernetes version to deploy
 kubernetesVersion: v1.1.7-coreos.1-ethtool
 
+# Number of controller nodes to create. Each controller runs an etcd
+# member and an apiserver. When more than one controller is created,
+# an internal load balancer is placed in front of the apiservers and
+# apiServerLoadBalancer.hostedZoneID must be set, so that the record
+# routing externalDNSName to it, which workers use, is created
+#controllerCount: 1
+
+# Place a load balancer in front of the controllers' apiservers on port
+# 443, even with a single controller. The scheme defaults to
+# internet-facing (internal, with more than one controller). If
+# hostedZoneID is set, a Route53 alias record pointing externalDNSName at
+# the load balancer is created in that hosted zone
+#apiServerLoadBalancer:
+#  scheme: internet-facing
+#  hostedZoneID: ZXXXXXXXXXXXXX
+
 # Instance type for controller node
 # controllerInstanceType: m3.medium
 
@@ -42,12 +60,72 @@ kubernetesVersion: v1.1.7-coreos.1-ethtool
 # Disk size (GiB) for controller nodes' ebs-backed etcd volume
 #controllerEtcdVolumeSize: 30
 
+# Number of dedicated etcd nodes to create. When 0, etcd runs on the
+# controller nodes. Otherwise controllers only run an etcd proxy and
+# the cluster state lives on the etcd nodes' own ebs volumes
+#etcdCount: 0
+
+# Instance type for etcd nodes
+#etcdInstanceType: m3.medium
+
+# Disk size (GiB) for etcd nodes' ebs-backed data volume
+#etcdVolumeSize: 30
+
+# IP Address for the first etcd node. Further etcd nodes are addressed
+# the same way as additional controllers (see controllerIP). Must be in
+# privateInstanceCIDR when workerTopology is private
+#etcdIP: 10.0.0.20
+
 # Number of worker nodes to create
 #workerCount: 1
 
+# Bounds of the worker auto scaling group. workerMinCount defaults to 0
+# (workerCount for spot instances) and workerMaxCount to workerCount + 1
+#workerMinCount: 0
+#workerMaxCount: 2
+
+# Run the Kubernetes cluster-autoscaler on the controllers, growing and
+# shrinking the worker auto scaling groups (within their bounds) with
+# the pods waiting to be scheduled. Requires kubernetesVersion v1.7 or
+# newer, the version cluster-autoscaler v0.6.0 is built for
+#clusterAutoscaler: false
+
 # Price (Dollars) to bid for spot instances. Omit for on-demand instances.
 # workerSpotPrice: "0.05"
 
+# Run several pools of workers, each with its own auto scaling group.
+# Replaces workerCount, workerMinCount, workerMaxCount, workerInstanceType
+# and workerSpotPrice. Pool names must be alphanumeric. Node labels and
+# taints are registered by the kubelet, and require a kubernetesVersion of
+# v1.2 and v1.6 or newer respectively
+#workerPools:
+#  - name: compute
+#    instanceType: c4.xlarge
+#    count: 3
+#    minCount: 1
+#    maxCount: 6
+#    spotPrice: "0.10"
+#    rootVolumeSize: 50
+#    nodeLabels:
+#      pool: compute
+#  - name: memory
+#    instanceType: r3.xlarge
+#    count: 2
+#    taints:
+#      - dedicated=memory:NoSchedule
+
+# Use existing IAM instance profiles instead of creating them (and their
+# roles) in the stack. Their roles must grant what the Kubernetes AWS cloud
+# provider needs: managing volumes, security groups and load balancers on
+# controllers (and the auto scaling groups, with clusterAutoscaler), and
+# attaching volumes on workers. With tls.perNodeWorkerCertificates, the
+# controllers' role must also allow autoscaling:DescribeAutoScalingInstances,
+# autoscaling:DescribeTags and kms:Decrypt with tls.kmsKeyARN. The roles created by the stack only allow
+# changing volumes and load balancers tagged KubernetesCluster with the
+# cluster name, as the cloud provider tags those it creates
+#controllerInstanceProfileARN: arn:aws:iam::123456789012:instance-profile/kube-controller
+#workerInstanceProfileARN: arn:aws:iam::123456789012:instance-profile/kube-worker
+
 # CIDR for Kubernetes VPC (must match existingVPC's cidr, if provided)
 # vpcCIDR: "10.0.0.0/16"
 
@@ -58,12 +136,60 @@ kubernetesVersion: v1.1.7-coreos.1-ethtool
 
   #The route table in the existing VPC
   #which the new kubernetes subnet should associate with
+  #(not needed if every subnet below has a subnetID)
   #routeTableID: rtb-xxxx
 
+  #Existing security groups to attach to every node, in addition
+  #to the ones created for the cluster
+  #securityGroupIDs:
+  #  - sg-xxxx
+
 # CIDR for Kubernetes subnet
 # instanceCIDR: "10.0.0.0/24"
 
-# IP Address for controller in Kubernetes subnet
+# Set to private to place workers (and etcd nodes) in private subnets
+# without public IPs. Their outbound traffic leaves through a NAT gateway
+# in each availability zone, and only the controllers remain reachable
+# from outside the VPC: on 443 for the apiserver, and on 22 only from
+# sshAccessCIDRs, to serve as SSH bastions for the private nodes
+#workerTopology: public
+
+# Networks allowed to reach the nodes over SSH (and ICMP). Defaults to
+# 0.0.0.0/0 when workerTopology is public, and to none when private, in
+# which case it only applies to the controllers
+#sshAccessCIDRs:
+#  - 203.0.113.0/24
+
+# CIDR for the private Kubernetes subnet when workerTopology is private
+# privateInstanceCIDR: "10.0.1.0/24"
+
+# Spread the cluster across several availability zones, one subnet
+# per zone. Replaces availabilityZone and instanceCIDR. Controllers
+# are placed round-robin across the subnets, and workers are spread
+# across all of them
+#subnets:
+#  - availabilityZone: us-west-1a
+#    instanceCIDR: "10.0.0.0/24"
+#    privateInstanceCIDR: "10.0.128.0/24"
+#  - availabilityZone: us-west-1c
+#    instanceCIDR: "10.0.1.0/24"
+#    privateInstanceCIDR: "10.0.129.0/24"
+#
+# When deploying to an existing VPC, a subnet may instead refer to an
+# existing subnet by subnetID (and privateSubnetID for its private
+# counterpart), in which case the stack does not create it. The CIDRs
+# must still be given and match the existing subnets, which must also be
+# tagged with KubernetesCluster=<clusterName> for service load balancers
+# to be placed in them. An existing private subnet must already route
+# its outbound traffic, e.g. through a NAT gateway
+#  - availabilityZone: us-west-1b
+#    instanceCIDR: "10.0.2.0/24"
+#    subnetID: subnet-xxxx
+
+# IP Address for controller in Kubernetes subnet (the first subnet,
+# if subnets are specified). Additional controllers in the same subnet
+# are assigned the consecutive addresses following it. Controllers in
+# other subnets use the same host offset within their own subnet
 # controllerIP: 10.0.0.50
 
 # CIDR for all service IP addresses
@@ -77,4 +203,63 @@ kubernetesVersion: v1.1.7-coreos.1-ethtool
 
 # IP address of Kubernetes dns service (must be contained by serviceCIDR)
 # dnsServiceIP: 10.3.0.10
+
+# Certificates generated by render. The CA is valid for caValidityDays and
+# the certificates it signs for validityDays; kube-aws certs rotate re-issues
+# the latter. Certificates issued by kube-aws certs issue-user are valid
+# for userValidityDays, validityDays unless set: revoked certificates keep
+# working until they expire. The subject is given to the CA and inherited by the
+# certificates, unless a CA is imported. Keys use keyAlgorithm (rsa-2048,
+# rsa-3072, rsa-4096, ecdsa-p256 or ecdsa-p384), except for the RSA key
+# service account tokens are signed with, service-account-key.pem.
+# The apiserver certificate is valid for externalDNSName, the in-cluster
+# service names and the controller IPs, plus apiServerDNSNames and
+# apiServerIPs (e.g. internal load balancer names or bastion aliases).
+#
+# With perNodeWorkerCertificates, workers no longer share worker.pem. Each
+# requests its own certificate from the controllers at boot, valid for its
+# private DNS name and IP, and renews it within a week of expiry, checking
+# daily. The controllers check the signature of the worker's instance
+# identity document against instanceIdentityCertificate, the AWS public
+# certificate for the region (see "Instance Identity Documents" in the EC2
+# docs), and that the instance was launched by one of the cluster's auto
+# scaling groups. Not available with an external CA.
+# The controllers sign with worker-signer-ca.pem, an intermediate CA only
+# allowed to issue client and server certificates for the cluster's VPC.
+# Its key reaches them encrypted with kmsKeyARN, which kube-aws up
+# encrypts it with, and only the controllers' role may decrypt it for this
+# cluster. Whoever can run code on a controller can still use the key to
+# sign any client certificate, kube-admin included
+#tls:
+#  keyAlgorithm: rsa-2048
+#  caValidityDays: 365
+#  validityDays: 90
+#  userValidityDays: 7
+#  caCommonName: kube-ca
+#  subject:
+#    organization: kube-aws
+#    organizationalUnit: ""
+#    country: ""
+#    province: ""
+#    locality: ""
+#  apiServerDNSNames:
+#    - kube-internal.example.com
+#  apiServerIPs:
+#    - 10.0.0.10
+#  perNodeWorkerCertificates: false
+#  instanceIdentityCertificate: |
+#    -----BEGIN CERTIFICATE-----
+#    ...
+#    -----END CERTIFICATE-----
+#  kmsKeyARN: arn:aws:kms:us-west-1:123456789012:key/12345678-1234-1234-1234-123456789012
+
+# Encrypt the private keys in credentials/ (written as <name>-key.pem.age)
+# and the stack template exported by "up --export" with age, either to the
+# recipients' public keys or with the passphrase in $KUBE_AWS_PASSPHRASE.
+# kube-aws decrypts them with $KUBE_AWS_PASSPHRASE or the age identity file
+# at $KUBE_AWS_IDENTITY_FILE
+#credentialsEncryption:
+#  recipients:
+#    - age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+#  passphrase: false
 `
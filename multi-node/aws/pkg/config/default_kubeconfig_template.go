@@ -11,12 +11,12 @@ contexts:
 - context:
     cluster: kube-aws-{{ .ClusterName }}-cluster
     namespace: default
-    user: kube-aws-{{ .ClusterName }}-admin
+    user: kube-aws-{{ .ClusterName }}-{{ .User }}
   name: kube-aws-{{ .ClusterName }}-context
 users:
-- name: kube-aws-{{ .ClusterName }}-admin
+- name: kube-aws-{{ .ClusterName }}-{{ .User }}
   user:
-    client-certificate: {{ .TLSConfig.AdminCert.Name }}
-    client-key: {{ .TLSConfig.AdminKey.Name }}
+    client-certificate: {{ .ClientCert.Name }}
+    client-key: {{ .ClientKey.Name }}
 current-context: kube-aws-{{ .ClusterName }}-context
 `
@@ -10,16 +10,17 @@ var defaultStackTemplate = `
         "Type" : "String",
         "Default" : "{{.VPCID}}",
         "Description" : "ID of kubernetes VPC"
-      },
+      }{{if .RouteTableID}},
       "RouteTable": {
         "Type" : "String",
         "Default" : "{{.RouteTableID}}",
 	    "Description" : "Route Table to attach to"
-      }
+      }{{end}}
     {{end}}
   },
   "Resources": {
-    "AlarmControllerRecover": {
+    {{range .Controllers}}
+    "Alarm{{.Name}}Recover": {
       "Properties": {
         "AlarmActions": [
           {
@@ -41,7 +42,7 @@ var defaultStackTemplate = `
           {
             "Name": "InstanceId",
             "Value": {
-              "Ref": "InstanceController"
+              "Ref": "Instance{{.Name}}"
             }
           }
         ],
@@ -54,72 +55,187 @@ var defaultStackTemplate = `
       },
       "Type": "AWS::CloudWatch::Alarm"
     },
-    "AutoScaleWorker": {
+    {{end}}
+    {{range .EtcdInstances}}
+    "Alarm{{.Name}}Recover": {
+      "Properties": {
+        "AlarmActions": [
+          {
+            "Fn::Join": [
+              "",
+              [
+                "arn:aws:automate:",
+                {
+                  "Ref": "AWS::Region"
+                },
+                ":ec2:recover"
+              ]
+            ]
+          }
+        ],
+        "AlarmDescription": "Trigger a recovery when system check fails for 5 consecutive minutes.",
+        "ComparisonOperator": "GreaterThanThreshold",
+        "Dimensions": [
+          {
+            "Name": "InstanceId",
+            "Value": {
+              "Ref": "Instance{{.Name}}"
+            }
+          }
+        ],
+        "EvaluationPeriods": "5",
+        "MetricName": "StatusCheckFailed_System",
+        "Namespace": "AWS/EC2",
+        "Period": "60",
+        "Statistic": "Minimum",
+        "Threshold": "0"
+      },
+      "Type": "AWS::CloudWatch::Alarm"
+    },
+    {{end}}
+    {{range .WorkerPools}}
+    "AutoScale{{.LogicalName}}": {
       "Properties": {
         "AvailabilityZones": [
-          "{{.AvailabilityZone}}"
+          {{range $i, $subnet := $.Subnets}}{{if $i}},{{end}}
+          "{{$subnet.AvailabilityZone}}"
+          {{end}}
         ],
-        "DesiredCapacity": "{{.WorkerCount}}",
+        "DesiredCapacity": "{{.Count}}",
         "HealthCheckGracePeriod": 600,
         "HealthCheckType": "EC2",
         "LaunchConfigurationName": {
-          "Ref": "LaunchConfigurationWorker"
+          "Ref": "LaunchConfiguration{{.LogicalName}}"
         },
-        "MaxSize": "{{.MaxWorkersASG}}",
-        "MinSize": "{{.MinWorkersASG}}",
+        "MaxSize": "{{.MaxCount}}",
+        "MinSize": "{{.MinCount}}",
         "Tags": [
           {
             "Key": "KubernetesCluster",
             "PropagateAtLaunch": "true",
-            "Value": "{{.ClusterName}}"
+            "Value": "{{$.ClusterName}}"
           },
           {
             "Key": "Name",
             "PropagateAtLaunch": "true",
-            "Value": "kube-aws-worker"
-          }
+            "Value": "kube-aws-worker{{if .Name}}-{{.Name}}{{end}}"
+          }{{if $.ClusterAutoscaler}},
+          {
+            "Key": "k8s.io/cluster-autoscaler/enabled",
+            "PropagateAtLaunch": "false",
+            "Value": "true"
+          },
+          {
+            "Key": "kubernetes.io/cluster/{{$.ClusterName}}",
+            "PropagateAtLaunch": "false",
+            "Value": "owned"
+          }{{end}}
         ],
         "VPCZoneIdentifier": [
-          {
-            "Ref": "Subnet"
-          }
+          {{range $i, $subnet := $.WorkerSubnets}}{{if $i}},{{end}}
+          {{$subnet.Ref}}
+          {{end}}
         ]
       },
       "Type": "AWS::AutoScaling::AutoScalingGroup",
       "UpdatePolicy" : {
 	    "AutoScalingRollingUpdate" : {
-          "MinInstancesInService" : "{{.MinWorkersASG}}",
+          "MinInstancesInService" : "{{.MinCount}}",
           "MaxBatchSize" : "1",
           "PauseTime" : "PT2M"
 	    }
       }
     },
-    "EIPController": {
+    {{end}}
+    {{range .Controllers}}
+    "EIP{{.Name}}": {
       "Properties": {
         "Domain": "vpc",
         "InstanceId": {
-          "Ref": "InstanceController"
+          "Ref": "Instance{{.Name}}"
         }
       },
       "Type": "AWS::EC2::EIP"
     },
-    "IAMInstanceProfileController": {
+    {{end}}
+    {{if .APIServerLoadBalancer}}
+    "ElbAPIServer": {
       "Properties": {
-        "Path": "/",
-        "Roles": [
+        "CrossZone": true,
+        "HealthCheck": {
+          "HealthyThreshold": "3",
+          "Interval": "10",
+          "Target": "TCP:443",
+          "Timeout": "5",
+          "UnhealthyThreshold": "3"
+        },
+        "Instances": [
+          {{range $i, $c := .Controllers}}{{if $i}},{{end}}
           {
-            "Ref": "IAMRoleController"
+            "Ref": "Instance{{$c.Name}}"
+          }
+          {{end}}
+        ],
+        "Listeners": [
+          {
+            "InstancePort": "443",
+            "InstanceProtocol": "TCP",
+            "LoadBalancerPort": "443",
+            "Protocol": "TCP"
+          }
+        ],
+        "Scheme": "{{.APIServerLoadBalancer.Scheme}}",
+        "SecurityGroups": [
+          {
+            "Ref": "SecurityGroupElbAPIServer"
+          }
+        ],
+        "Subnets": [
+          {{range $i, $subnet := .Subnets}}{{if $i}},{{end}}
+          {{$subnet.Ref}}
+          {{end}}
+        ],
+        "Tags": [
+          {
+            "Key": "KubernetesCluster",
+            "Value": "{{.ClusterName}}"
           }
         ]
       },
-      "Type": "AWS::IAM::InstanceProfile"
+      "Type": "AWS::ElasticLoadBalancing::LoadBalancer"
     },
-    "IAMInstanceProfileWorker": {
+    {{if .APIServerLoadBalancer.HostedZoneID}}
+    "RecordSetAPIServer": {
+      "Properties": {
+        "AliasTarget": {
+          "DNSName": {
+            "Fn::GetAtt": [
+              "ElbAPIServer",
+              "DNSName"
+            ]
+          },
+          "HostedZoneId": {
+            "Fn::GetAtt": [
+              "ElbAPIServer",
+              "CanonicalHostedZoneNameID"
+            ]
+          }
+        },
+        "HostedZoneId": "{{.APIServerLoadBalancer.HostedZoneID}}",
+        "Name": "{{.ExternalDNSName}}.",
+        "Type": "A"
+      },
+      "Type": "AWS::Route53::RecordSet"
+    },
+    {{end}}
+    {{end}}
+    {{if not .ControllerInstanceProfileARN}}
+    "IAMInstanceProfileController": {
       "Properties": {
         "Path": "/",
         "Roles": [
           {
-            "Ref": "IAMRoleWorker"
+            "Ref": "IAMRoleController"
           }
         ]
       },
@@ -149,15 +265,213 @@ var defaultStackTemplate = `
             "PolicyDocument": {
               "Statement": [
                 {
-                  "Action": "ec2:*",
+                  "Action": [
+                    "ec2:DescribeAvailabilityZones",
+                    "ec2:DescribeInstances",
+                    "ec2:DescribeRegions",
+                    "ec2:DescribeRouteTables",
+                    "ec2:DescribeSecurityGroups",
+                    "ec2:DescribeSubnets",
+                    "ec2:DescribeVolumes",
+                    "ec2:CreateSecurityGroup",
+                    "ec2:CreateVolume"
+                  ],
                   "Effect": "Allow",
                   "Resource": "*"
                 },
                 {
-                  "Action": "elasticloadbalancing:*",
+                  "Action": [
+                    "ec2:CreateTags"
+                  ],
+                  "Effect": "Allow",
+                  "Resource": [
+                    {
+                      "Fn::Join": [
+                        "",
+                        [
+                          "arn:aws:ec2:",
+                          {
+                            "Ref": "AWS::Region"
+                          },
+                          ":",
+                          {
+                            "Ref": "AWS::AccountId"
+                          },
+                          ":security-group/*"
+                        ]
+                      ]
+                    },
+                    {
+                      "Fn::Join": [
+                        "",
+                        [
+                          "arn:aws:ec2:",
+                          {
+                            "Ref": "AWS::Region"
+                          },
+                          ":",
+                          {
+                            "Ref": "AWS::AccountId"
+                          },
+                          ":volume/*"
+                        ]
+                      ]
+                    }
+                  ]
+                },
+                {
+                  "Action": [
+                    "ec2:AuthorizeSecurityGroupIngress",
+                    "ec2:DeleteSecurityGroup",
+                    "ec2:RevokeSecurityGroupIngress"
+                  ],
+                  "Condition": {
+                    "StringEquals": {
+                      "ec2:ResourceTag/KubernetesCluster": "{{.ClusterName}}"
+                    }
+                  },
                   "Effect": "Allow",
                   "Resource": "*"
-                }
+                },
+                {
+                  "Action": [
+                    "ec2:AttachVolume",
+                    "ec2:DetachVolume"
+                  ],
+                  "Condition": {
+                    "StringEquals": {
+                      "ec2:ResourceTag/KubernetesCluster": "{{.ClusterName}}"
+                    }
+                  },
+                  "Effect": "Allow",
+                  "Resource": {
+                    "Fn::Join": [
+                      "",
+                      [
+                        "arn:aws:ec2:",
+                        {
+                          "Ref": "AWS::Region"
+                        },
+                        ":",
+                        {
+                          "Ref": "AWS::AccountId"
+                        },
+                        ":instance/*"
+                      ]
+                    ]
+                  }
+                },
+                {
+                  "Action": [
+                    "ec2:AttachVolume",
+                    "ec2:DeleteVolume",
+                    "ec2:DetachVolume"
+                  ],
+                  "Condition": {
+                    "StringEquals": {
+                      "ec2:ResourceTag/KubernetesCluster": "{{.ClusterName}}"
+                    }
+                  },
+                  "Effect": "Allow",
+                  "Resource": {
+                    "Fn::Join": [
+                      "",
+                      [
+                        "arn:aws:ec2:",
+                        {
+                          "Ref": "AWS::Region"
+                        },
+                        ":",
+                        {
+                          "Ref": "AWS::AccountId"
+                        },
+                        ":volume/*"
+                      ]
+                    ]
+                  }
+                },
+                {
+                  "Action": [
+                    "elasticloadbalancing:DescribeLoadBalancerAttributes",
+                    "elasticloadbalancing:DescribeLoadBalancers"
+                  ],
+                  "Effect": "Allow",
+                  "Resource": "*"
+                },
+                {
+                  "Action": [
+                    "elasticloadbalancing:CreateLoadBalancer"
+                  ],
+                  "Condition": {
+                    "StringEquals": {
+                      "aws:RequestTag/KubernetesCluster": "{{.ClusterName}}"
+                    }
+                  },
+                  "Effect": "Allow",
+                  "Resource": "*"
+                },
+                {
+                  "Action": [
+                    "elasticloadbalancing:ApplySecurityGroupsToLoadBalancer",
+                    "elasticloadbalancing:AttachLoadBalancerToSubnets",
+                    "elasticloadbalancing:ConfigureHealthCheck",
+                    "elasticloadbalancing:CreateLoadBalancerListeners",
+                    "elasticloadbalancing:DeleteLoadBalancer",
+                    "elasticloadbalancing:DeleteLoadBalancerListeners",
+                    "elasticloadbalancing:DeregisterInstancesFromLoadBalancer",
+                    "elasticloadbalancing:DetachLoadBalancerFromSubnets",
+                    "elasticloadbalancing:ModifyLoadBalancerAttributes",
+                    "elasticloadbalancing:RegisterInstancesWithLoadBalancer"
+                  ],
+                  "Condition": {
+                    "StringEquals": {
+                      "elasticloadbalancing:ResourceTag/KubernetesCluster": "{{.ClusterName}}"
+                    }
+                  },
+                  "Effect": "Allow",
+                  "Resource": "*"
+                }{{if .ClusterAutoscaler}},
+                {
+                  "Action": [
+                    "autoscaling:DescribeAutoScalingGroups",
+                    "autoscaling:DescribeAutoScalingInstances",
+                    "autoscaling:DescribeLaunchConfigurations",
+                    "autoscaling:DescribeTags"
+                  ],
+                  "Effect": "Allow",
+                  "Resource": "*"
+                },
+                {
+                  "Action": [
+                    "autoscaling:SetDesiredCapacity",
+                    "autoscaling:TerminateInstanceInAutoScalingGroup"
+                  ],
+                  "Condition": {
+                    "StringEquals": {
+                      "autoscaling:ResourceTag/KubernetesCluster": "{{.ClusterName}}"
+                    }
+                  },
+                  "Effect": "Allow",
+                  "Resource": "*"
+                }{{end}}{{if .TLS.PerNodeWorkerCertificates}},
+                {
+                  "Action": [
+                    "autoscaling:DescribeAutoScalingInstances",
+                    "autoscaling:DescribeTags"
+                  ],
+                  "Effect": "Allow",
+                  "Resource": "*"
+                },
+                {
+                  "Action": "kms:Decrypt",
+                  "Condition": {
+                    "StringEquals": {
+                      "kms:EncryptionContext:KubernetesCluster": "{{.ClusterName}}"
+                    }
+                  },
+                  "Effect": "Allow",
+                  "Resource": "{{.TLS.KMSKeyARN}}"
+                }{{end}}
               ],
               "Version": "2012-10-17"
             },
@@ -167,6 +481,19 @@ var defaultStackTemplate = `
       },
       "Type": "AWS::IAM::Role"
     },
+    {{end}}
+    {{if not .WorkerInstanceProfileARN}}
+    "IAMInstanceProfileWorker": {
+      "Properties": {
+        "Path": "/",
+        "Roles": [
+          {
+            "Ref": "IAMRoleWorker"
+          }
+        ]
+      },
+      "Type": "AWS::IAM::InstanceProfile"
+    },
     "IAMRoleWorker": {
       "Properties": {
         "AssumeRolePolicyDocument": {
@@ -191,19 +518,68 @@ var defaultStackTemplate = `
             "PolicyDocument": {
               "Statement": [
                 {
-                  "Action": "ec2:Describe*",
+                  "Action": [
+                    "ec2:DescribeInstances",
+                    "ec2:DescribeVolumes"
+                  ],
                   "Effect": "Allow",
                   "Resource": "*"
                 },
                 {
-                  "Action": "ec2:AttachVolume",
+                  "Action": [
+                    "ec2:AttachVolume",
+                    "ec2:DetachVolume"
+                  ],
+                  "Condition": {
+                    "StringEquals": {
+                      "ec2:ResourceTag/KubernetesCluster": "{{.ClusterName}}"
+                    }
+                  },
                   "Effect": "Allow",
-                  "Resource": "*"
+                  "Resource": {
+                    "Fn::Join": [
+                      "",
+                      [
+                        "arn:aws:ec2:",
+                        {
+                          "Ref": "AWS::Region"
+                        },
+                        ":",
+                        {
+                          "Ref": "AWS::AccountId"
+                        },
+                        ":instance/*"
+                      ]
+                    ]
+                  }
                 },
                 {
-                  "Action": "ec2:DetachVolume",
+                  "Action": [
+                    "ec2:AttachVolume",
+                    "ec2:DetachVolume"
+                  ],
+                  "Condition": {
+                    "StringEquals": {
+                      "ec2:ResourceTag/KubernetesCluster": "{{.ClusterName}}"
+                    }
+                  },
                   "Effect": "Allow",
-                  "Resource": "*"
+                  "Resource": {
+                    "Fn::Join": [
+                      "",
+                      [
+                        "arn:aws:ec2:",
+                        {
+                          "Ref": "AWS::Region"
+                        },
+                        ":",
+                        {
+                          "Ref": "AWS::AccountId"
+                        },
+                        ":volume/*"
+                      ]
+                    ]
+                  }
                 }
               ],
               "Version": "2012-10-17"
@@ -214,40 +590,44 @@ var defaultStackTemplate = `
       },
       "Type": "AWS::IAM::Role"
     },
-    "ControllerEBSVolume": {
+    {{end}}
+    {{range .Controllers}}
+    {{if not $.EtcdCount}}
+    "{{.Name}}EBSVolume": {
       "Type":"AWS::EC2::Volume",
       "Properties" : {
-	"AvailabilityZone" : "{{.AvailabilityZone}}",
-	"Size" : "{{.ControllerEtcdVolumeSize}}",
+	"AvailabilityZone" : "{{.Subnet.AvailabilityZone}}",
+	"Size" : "{{$.ControllerEtcdVolumeSize}}",
 	"Tags" : [
 	  {
 	    "Key" : "Name",
-	    "Value" :"{{.ClusterName}}-controller-etcd"
+	    "Value" :"{{$.ClusterName}}-controller-etcd"
 	  },
 	  {
 	    "Key" : "KubernetesCluster",
-	    "Value" :"{{.ClusterName}}"
+	    "Value" :"{{$.ClusterName}}"
 	  }
 	]
       }
     },
-    "ControllerEBSAttachment" : {
+    "{{.Name}}EBSAttachment" : {
 	"Type" : "AWS::EC2::VolumeAttachment",
 	"Properties" : {
-	  "InstanceId" : { "Ref" : "InstanceController" },
-	  "VolumeId"  : { "Ref" : "ControllerEBSVolume" },
+	  "InstanceId" : { "Ref" : "Instance{{.Name}}" },
+	  "VolumeId"  : { "Ref" : "{{.Name}}EBSVolume" },
 	  "Device" : "/dev/xvdf"
 	}
     },
-    "InstanceController": {
+    {{end}}
+    "Instance{{.Name}}": {
       "Properties": {
-        "AvailabilityZone": "{{.AvailabilityZone}}",
-        "IamInstanceProfile": {
+        "AvailabilityZone": "{{.Subnet.AvailabilityZone}}",
+        "IamInstanceProfile": {{if $.ControllerInstanceProfile}}"{{$.ControllerInstanceProfile}}"{{else}}{
           "Ref": "IAMInstanceProfileController"
-        },
-        "ImageId": "{{.AMI}}",
-        "InstanceType": "{{.ControllerInstanceType}}",
-        "KeyName": "{{.KeyName}}",
+        }{{end}},
+        "ImageId": "{{$.AMI}}",
+        "InstanceType": "{{$.ControllerInstanceType}}",
+        "KeyName": "{{$.KeyName}}",
         "NetworkInterfaces": [
           {
             "AssociatePublicIpAddress": false,
@@ -256,48 +636,127 @@ var defaultStackTemplate = `
             "GroupSet": [
               {
                 "Ref": "SecurityGroupController"
-              }
+              }{{with $.ExistingVPC}}{{range .SecurityGroupIDs}},
+              "{{.}}"{{end}}{{end}}
             ],
-            "PrivateIpAddress": "{{.ControllerIP}}",
-            "SubnetId": {
-              "Ref": "Subnet"
-            }
+            "PrivateIpAddress": "{{.IP}}",
+            "SubnetId": {{.Subnet.Ref}}
           }
         ],
         "Tags": [
           {
             "Key": "KubernetesCluster",
-            "Value": "{{.ClusterName}}"
+            "Value": "{{$.ClusterName}}"
           },
           {
             "Key": "Name",
             "Value": "kube-aws-controller"
           }
         ],
-        "UserData": "{{.UserData.Controller.String}}"
+        "UserData": "{{$.UserData.Controller.String}}"
       },
       "Type": "AWS::EC2::Instance"
     },
-    "LaunchConfigurationWorker": {
+    {{end}}
+    {{range .EtcdInstances}}
+    "{{.Name}}EBSVolume": {
+      "Type":"AWS::EC2::Volume",
+      "Properties" : {
+	"AvailabilityZone" : "{{.Subnet.AvailabilityZone}}",
+	"Size" : "{{$.EtcdVolumeSize}}",
+	"Tags" : [
+	  {
+	    "Key" : "Name",
+	    "Value" :"{{$.ClusterName}}-etcd"
+	  },
+	  {
+	    "Key" : "KubernetesCluster",
+	    "Value" :"{{$.ClusterName}}"
+	  }
+	]
+      }
+    },
+    "{{.Name}}EBSAttachment" : {
+	"Type" : "AWS::EC2::VolumeAttachment",
+	"Properties" : {
+	  "InstanceId" : { "Ref" : "Instance{{.Name}}" },
+	  "VolumeId"  : { "Ref" : "{{.Name}}EBSVolume" },
+	  "Device" : "/dev/xvdf"
+	}
+    },
+    "Instance{{.Name}}": {
       "Properties": {
-        "IamInstanceProfile": {
+        "AvailabilityZone": "{{.Subnet.AvailabilityZone}}",
+        "ImageId": "{{$.AMI}}",
+        "InstanceType": "{{$.EtcdInstanceType}}",
+        "KeyName": "{{$.KeyName}}",
+        "NetworkInterfaces": [
+          {
+            "AssociatePublicIpAddress": {{if eq $.WorkerTopology "private"}}false{{else}}true{{end}},
+            "DeleteOnTermination": true,
+            "DeviceIndex": "0",
+            "GroupSet": [
+              {
+                "Ref": "SecurityGroupEtcd"
+              }{{with $.ExistingVPC}}{{range .SecurityGroupIDs}},
+              "{{.}}"{{end}}{{end}}
+            ],
+            "PrivateIpAddress": "{{.IP}}",
+            "SubnetId": {{.Subnet.Ref}}
+          }
+        ],
+        "Tags": [
+          {
+            "Key": "KubernetesCluster",
+            "Value": "{{$.ClusterName}}"
+          },
+          {
+            "Key": "Name",
+            "Value": "kube-aws-etcd"
+          }
+        ],
+        "UserData": "{{$.UserData.Etcd.String}}"
+      },
+      "Type": "AWS::EC2::Instance"
+    },
+    {{end}}
+    {{range .WorkerPools}}
+    "LaunchConfiguration{{.LogicalName}}": {
+      "Properties": {
+        {{if eq $.WorkerTopology "private"}}
+        "AssociatePublicIpAddress": false,
+        {{end}}
+        {{if .RootVolumeSize}}
+        "BlockDeviceMappings": [
+          {
+            "DeviceName": "/dev/xvda",
+            "Ebs": {
+              "VolumeSize": "{{.RootVolumeSize}}",
+              "VolumeType": "gp2"
+            }
+          }
+        ],
+        {{end}}
+        "IamInstanceProfile": {{if $.WorkerInstanceProfileARN}}"{{$.WorkerInstanceProfileARN}}"{{else}}{
           "Ref": "IAMInstanceProfileWorker"
-        },
-        "ImageId": "{{.AMI}}",
-        "InstanceType": "{{.WorkerInstanceType}}",
-        "KeyName": "{{.KeyName}}",
+        }{{end}},
+        "ImageId": "{{$.AMI}}",
+        "InstanceType": "{{.InstanceType}}",
+        "KeyName": "{{$.KeyName}}",
         "SecurityGroups": [
           {
             "Ref": "SecurityGroupWorker"
-          }
+          }{{with $.ExistingVPC}}{{range .SecurityGroupIDs}},
+          "{{.}}"{{end}}{{end}}
         ],
-        {{if .WorkerSpotPrice}}
-        "SpotPrice": {{.WorkerSpotPrice}},
+        {{if .SpotPrice}}
+        "SpotPrice": {{.SpotPrice}},
         {{end}}
-        "UserData": "{{.UserData.Worker.String}}"
+        "UserData": "{{.UserData.String}}"
       },
       "Type": "AWS::AutoScaling::LaunchConfiguration"
     },
+    {{end}}
     "SecurityGroupController": {
       "Properties": {
         "GroupDescription": {
@@ -318,18 +777,20 @@ var defaultStackTemplate = `
           }
         ],
         "SecurityGroupIngress": [
+          {{range .SSHAccessCIDRs}}
           {
-            "CidrIp": "0.0.0.0/0",
+            "CidrIp": "{{.}}",
             "FromPort": 3,
             "IpProtocol": "icmp",
             "ToPort": -1
           },
           {
-            "CidrIp": "0.0.0.0/0",
+            "CidrIp": "{{.}}",
             "FromPort": 22,
             "IpProtocol": "tcp",
             "ToPort": 22
           },
+          {{end}}
           {
             "CidrIp": "0.0.0.0/0",
             "FromPort": 443,
@@ -349,6 +810,167 @@ var defaultStackTemplate = `
       },
       "Type": "AWS::EC2::SecurityGroup"
     },
+    {{if and (gt .ControllerCount 1) (not .EtcdCount)}}
+    "SecurityGroupControllerIngressFromControllerToEtcd": {
+      "Properties": {
+        "FromPort": 2379,
+        "GroupId": {
+          "Ref": "SecurityGroupController"
+        },
+        "IpProtocol": "tcp",
+        "SourceSecurityGroupId": {
+          "Ref": "SecurityGroupController"
+        },
+        "ToPort": 2380
+      },
+      "Type": "AWS::EC2::SecurityGroupIngress"
+    },
+    {{end}}
+    {{if .APIServerLoadBalancer}}
+    "SecurityGroupControllerIngressFromElbToAPIServer": {
+      "Properties": {
+        "FromPort": 443,
+        "GroupId": {
+          "Ref": "SecurityGroupController"
+        },
+        "IpProtocol": "tcp",
+        "SourceSecurityGroupId": {
+          "Ref": "SecurityGroupElbAPIServer"
+        },
+        "ToPort": 443
+      },
+      "Type": "AWS::EC2::SecurityGroupIngress"
+    },
+    "SecurityGroupElbAPIServer": {
+      "Properties": {
+        "GroupDescription": {
+          "Ref": "AWS::StackName"
+        },
+        "SecurityGroupIngress": [
+          {
+            "CidrIp": "{{if eq .APIServerLoadBalancer.Scheme "internal"}}{{.VPCCIDR}}{{else}}0.0.0.0/0{{end}}",
+            "FromPort": 443,
+            "IpProtocol": "tcp",
+            "ToPort": 443
+          }
+        ],
+        "Tags": [
+          {
+            "Key": "KubernetesCluster",
+            "Value": "{{.ClusterName}}"
+          }
+        ],
+        "VpcId": {
+          "Ref": "VPC"
+        }
+      },
+      "Type": "AWS::EC2::SecurityGroup"
+    },
+    {{end}}
+    {{if .EtcdCount}}
+    "SecurityGroupEtcd": {
+      "Properties": {
+        "GroupDescription": {
+          "Ref": "AWS::StackName"
+        },
+        "SecurityGroupEgress": [
+          {
+            "CidrIp": "0.0.0.0/0",
+            "FromPort": 0,
+            "IpProtocol": "tcp",
+            "ToPort": 65535
+          },
+          {
+            "CidrIp": "0.0.0.0/0",
+            "FromPort": 0,
+            "IpProtocol": "udp",
+            "ToPort": 65535
+          }
+        ],
+        "SecurityGroupIngress": [
+          {{if eq .WorkerTopology "private"}}
+          {
+            "CidrIp": "{{.VPCCIDR}}",
+            "FromPort": 3,
+            "IpProtocol": "icmp",
+            "ToPort": -1
+          },
+          {
+            "CidrIp": "{{.VPCCIDR}}",
+            "FromPort": 22,
+            "IpProtocol": "tcp",
+            "ToPort": 22
+          }
+          {{else}}{{range $i, $cidr := .SSHAccessCIDRs}}{{if $i}},{{end}}
+          {
+            "CidrIp": "{{$cidr}}",
+            "FromPort": 3,
+            "IpProtocol": "icmp",
+            "ToPort": -1
+          },
+          {
+            "CidrIp": "{{$cidr}}",
+            "FromPort": 22,
+            "IpProtocol": "tcp",
+            "ToPort": 22
+          }
+          {{end}}{{end}}
+        ],
+        "Tags": [
+          {
+            "Key": "KubernetesCluster",
+            "Value": "{{.ClusterName}}"
+          }
+        ],
+        "VpcId": {
+          "Ref": "VPC"
+        }
+      },
+      "Type": "AWS::EC2::SecurityGroup"
+    },
+    "SecurityGroupEtcdIngressFromControllerToEtcd": {
+      "Properties": {
+        "FromPort": 2379,
+        "GroupId": {
+          "Ref": "SecurityGroupEtcd"
+        },
+        "IpProtocol": "tcp",
+        "SourceSecurityGroupId": {
+          "Ref": "SecurityGroupController"
+        },
+        "ToPort": 2380
+      },
+      "Type": "AWS::EC2::SecurityGroupIngress"
+    },
+    "SecurityGroupEtcdIngressFromEtcdToEtcd": {
+      "Properties": {
+        "FromPort": 2379,
+        "GroupId": {
+          "Ref": "SecurityGroupEtcd"
+        },
+        "IpProtocol": "tcp",
+        "SourceSecurityGroupId": {
+          "Ref": "SecurityGroupEtcd"
+        },
+        "ToPort": 2380
+      },
+      "Type": "AWS::EC2::SecurityGroupIngress"
+    },
+    "SecurityGroupEtcdIngressFromWorkerToEtcd": {
+      "Properties": {
+        "FromPort": 2379,
+        "GroupId": {
+          "Ref": "SecurityGroupEtcd"
+        },
+        "IpProtocol": "tcp",
+        "SourceSecurityGroupId": {
+          "Ref": "SecurityGroupWorker"
+        },
+        "ToPort": 2379
+      },
+      "Type": "AWS::EC2::SecurityGroupIngress"
+    },
+    {{else}}
     "SecurityGroupControllerIngressFromWorkerToEtcd": {
       "Properties": {
         "FromPort": 2379,
@@ -363,6 +985,23 @@ var defaultStackTemplate = `
       },
       "Type": "AWS::EC2::SecurityGroupIngress"
     },
+    {{end}}
+    {{if .TLS.PerNodeWorkerCertificates}}
+    "SecurityGroupControllerIngressFromWorkerToWorkerSigner": {
+      "Properties": {
+        "FromPort": 9443,
+        "GroupId": {
+          "Ref": "SecurityGroupController"
+        },
+        "IpProtocol": "tcp",
+        "SourceSecurityGroupId": {
+          "Ref": "SecurityGroupWorker"
+        },
+        "ToPort": 9443
+      },
+      "Type": "AWS::EC2::SecurityGroupIngress"
+    },
+    {{end}}
     "SecurityGroupWorker": {
       "Properties": {
         "GroupDescription": {
@@ -383,18 +1022,33 @@ var defaultStackTemplate = `
           }
         ],
         "SecurityGroupIngress": [
+          {{if eq .WorkerTopology "private"}}
           {
-            "CidrIp": "0.0.0.0/0",
+            "CidrIp": "{{.VPCCIDR}}",
             "FromPort": 3,
             "IpProtocol": "icmp",
             "ToPort": -1
           },
           {
-            "CidrIp": "0.0.0.0/0",
+            "CidrIp": "{{.VPCCIDR}}",
             "FromPort": 22,
             "IpProtocol": "tcp",
             "ToPort": 22
           }
+          {{else}}{{range $i, $cidr := .SSHAccessCIDRs}}{{if $i}},{{end}}
+          {
+            "CidrIp": "{{$cidr}}",
+            "FromPort": 3,
+            "IpProtocol": "icmp",
+            "ToPort": -1
+          },
+          {
+            "CidrIp": "{{$cidr}}",
+            "FromPort": 22,
+            "IpProtocol": "tcp",
+            "ToPort": 22
+          }
+          {{end}}{{end}}
         ],
         "Tags": [
           {
@@ -477,16 +1131,16 @@ var defaultStackTemplate = `
         "ToPort": 10255
       },
       "Type": "AWS::EC2::SecurityGroupIngress"
-    },
-    "Subnet": {
+    }{{range $subnet := .Subnets}}{{if not $subnet.SubnetID}},
+    "{{$subnet.Name}}": {
       "Properties": {
-        "AvailabilityZone": "{{.AvailabilityZone}}",
-        "CidrBlock": "{{.InstanceCIDR}}",
+        "AvailabilityZone": "{{$subnet.AvailabilityZone}}",
+        "CidrBlock": "{{$subnet.InstanceCIDR}}",
         "MapPublicIpOnLaunch": true,
         "Tags": [
           {
             "Key": "KubernetesCluster",
-            "Value": "{{.ClusterName}}"
+            "Value": "{{$.ClusterName}}"
           }
         ],
         "VpcId": {
@@ -495,17 +1149,102 @@ var defaultStackTemplate = `
       },
       "Type": "AWS::EC2::Subnet"
     },
-    "SubnetRouteTableAssociation": {
+    "{{$subnet.Name}}RouteTableAssociation": {
       "Properties": {
         "RouteTableId": {
           "Ref": "RouteTable"
         },
+        "SubnetId": {{$subnet.Ref}}
+      },
+      "Type": "AWS::EC2::SubnetRouteTableAssociation"
+    }{{end}}{{if and (eq $.WorkerTopology "private") (not $subnet.PrivateSubnetID)}},
+    "EIPNatGateway{{$subnet.Name}}": {
+      {{if not $.ExistingVPC}}
+      "DependsOn": "VPCGatewayAttachment",
+      {{end}}
+      "Properties": {
+        "Domain": "vpc",
+        "Tags": [
+          {
+            "Key": "KubernetesCluster",
+            "Value": "{{$.ClusterName}}"
+          }
+        ]
+      },
+      "Type": "AWS::EC2::EIP"
+    },
+    "NatGateway{{$subnet.Name}}": {
+      "Properties": {
+        "AllocationId": {
+          "Fn::GetAtt": [
+            "EIPNatGateway{{$subnet.Name}}",
+            "AllocationId"
+          ]
+        },
+        "SubnetId": {{$subnet.Ref}},
+        "Tags": [
+          {
+            "Key": "KubernetesCluster",
+            "Value": "{{$.ClusterName}}"
+          }
+        ]
+      },
+      "Type": "AWS::EC2::NatGateway"
+    },
+    "{{$subnet.PrivateName}}": {
+      "Properties": {
+        "AvailabilityZone": "{{$subnet.AvailabilityZone}}",
+        "CidrBlock": "{{$subnet.PrivateInstanceCIDR}}",
+        "MapPublicIpOnLaunch": false,
+        "Tags": [
+          {
+            "Key": "KubernetesCluster",
+            "Value": "{{$.ClusterName}}"
+          }
+        ],
+        "VpcId": {
+          "Ref": "VPC"
+        }
+      },
+      "Type": "AWS::EC2::Subnet"
+    },
+    "{{$subnet.PrivateName}}RouteTableAssociation": {
+      "Properties": {
+        "RouteTableId": {
+          "Ref": "RouteTable{{$subnet.PrivateName}}"
+        },
         "SubnetId": {
-          "Ref": "Subnet"
+          "Ref": "{{$subnet.PrivateName}}"
         }
       },
       "Type": "AWS::EC2::SubnetRouteTableAssociation"
-    }{{if not .ExistingVPC }},
+    },
+    "RouteTable{{$subnet.PrivateName}}": {
+      "Properties": {
+        "Tags": [
+          {
+            "Key": "KubernetesCluster",
+            "Value": "{{$.ClusterName}}"
+          }
+        ],
+        "VpcId": {
+          "Ref": "VPC"
+        }
+      },
+      "Type": "AWS::EC2::RouteTable"
+    },
+    "RouteToNatGateway{{$subnet.PrivateName}}": {
+      "Properties": {
+        "DestinationCidrBlock": "0.0.0.0/0",
+        "NatGatewayId": {
+          "Ref": "NatGateway{{$subnet.Name}}"
+        },
+        "RouteTableId": {
+          "Ref": "RouteTable{{$subnet.PrivateName}}"
+        }
+      },
+      "Type": "AWS::EC2::Route"
+    }{{end}}{{end}}{{if not .ExistingVPC }},
     "VPC": {
       "Properties": {
         "CidrBlock": "{{.VPCCIDR}}",
@@ -574,6 +1313,17 @@ var defaultStackTemplate = `
       "Type": "AWS::EC2::RouteTable"
     }
     {{end}}
-  }
+  }{{if .APIServerLoadBalancer}},
+  "Outputs": {
+    "APIServerLoadBalancerDNSName": {
+      "Description": "DNS name of the apiserver load balancer",
+      "Value": {
+        "Fn::GetAtt": [
+          "ElbAPIServer",
+          "DNSName"
+        ]
+      }
+    }
+  }{{end}}
 }
 `
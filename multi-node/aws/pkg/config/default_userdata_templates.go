@@ -7,6 +7,9 @@ coreos:
   flannel:
     interface: $private_ipv4
     etcd_endpoints: {{.ETCDEndpoints}}
+    etcd_cafile: /etc/kubernetes/ssl/ca.pem
+    etcd_certfile: /etc/kubernetes/ssl/etcd-client.pem
+    etcd_keyfile: /etc/kubernetes/ssl/etcd-client-key.pem
   units:
     - name: docker.service
       drop-ins:
@@ -39,14 +42,120 @@ coreos:
         --cloud-provider=aws \
         --kubeconfig=/etc/kubernetes/worker-kubeconfig.yaml \
         --tls-cert-file=/etc/kubernetes/ssl/worker.pem \
-        --tls-private-key-file=/etc/kubernetes/ssl/worker-key.pem
+        --tls-private-key-file=/etc/kubernetes/ssl/worker-key.pem{{with .WorkerPool.NodeLabelList}} \
+        --node-labels={{.}}{{end}}{{with .WorkerPool.TaintList}} \
+        --register-with-taints={{.}}{{end}}
         StartLimitInterval=0
         Restart=always
         RestartSec=10
         [Install]
         WantedBy=multi-user.target
+{{if .TLS.PerNodeWorkerCertificates}}
+    - name: kube-worker-cert.service
+      enable: true
+      content: |
+        [Unit]
+        Description=Worker certificate request
+        Before=kubelet.service
+        Wants=network-online.target
+        After=network-online.target
+
+        [Service]
+        Type=oneshot
+        RemainAfterExit=yes
+        TimeoutStartSec=0
+        ExecStart=/opt/bin/kube-worker-cert
+
+        [Install]
+        RequiredBy=kubelet.service
+
+    - name: kube-worker-cert-renew.service
+      content: |
+        [Unit]
+        Description=Worker certificate renewal
+        After=kube-worker-cert.service
+
+        [Service]
+        Type=oneshot
+        ExecStart=/opt/bin/kube-worker-cert
+
+    - name: kube-worker-cert-renew.timer
+      enable: true
+      command: start
+      content: |
+        [Unit]
+        Description=Daily worker certificate renewal
 
+        [Timer]
+        OnCalendar=daily
+        RandomizedDelaySec=1h
+        Persistent=true
+
+        [Install]
+        WantedBy=timers.target
+{{end}}
 write_files:
+{{if .TLS.PerNodeWorkerCertificates}}
+  - path: /opt/bin/kube-worker-cert
+    permissions: 0700
+    owner: root:root
+    content: |
+      #!/bin/bash -e
+      # Has a controller sign this worker its own certificate, unless the
+      # one it holds is valid for another week. Run at boot, and daily by
+      # kube-worker-cert-renew.timer.
+      ssl=/etc/kubernetes/ssl
+      if [[ -s $ssl/worker.pem ]] && openssl x509 -noout -checkend 604800 -in $ssl/worker.pem; then
+        echo "worker certificate is still valid"
+        exit 0
+      fi
+
+      work=$(mktemp -d)
+      trap "rm -rf $work" EXIT
+      cd $work
+      algorithm={{.TLS.KeyAlgorithm}}
+      case $algorithm in
+        rsa-*)
+          openssl genpkey -algorithm RSA -pkeyopt rsa_keygen_bits:${algorithm#rsa-} -out worker-key.pem 2> /dev/null
+          ;;
+        ecdsa-*)
+          openssl genpkey -algorithm EC -pkeyopt ec_paramgen_curve:P-${algorithm#ecdsa-p} \
+            -pkeyopt ec_param_enc:named_curve -out worker-key.pem
+          ;;
+      esac
+      openssl req -new -key worker-key.pem -subj "/CN=kube-worker" -out worker.csr
+
+      metadata=http://169.254.169.254/latest/dynamic/instance-identity
+      curl -sf $metadata/document > document
+      curl -sf $metadata/pkcs7 > pkcs7
+
+      #controllers may still be booting
+      until [[ -s worker.pem ]]; do
+        for signer in {{range .Controllers}}{{.IP}} {{end}}; do
+          if timeout 60 bash -c 'exec 3<> /dev/tcp/$0/9443
+              for part in document pkcs7 worker.csr; do base64 -w0 $part >&3; echo >&3; done
+              cat <&3' $signer > worker.pem 2> /dev/null \
+            && [[ -s worker.pem ]] \
+            && openssl verify -CAfile $ssl/ca.pem -untrusted worker.pem worker.pem | grep -q OK \
+            && [[ "$(openssl x509 -noout -pubkey -in worker.pem)" == "$(openssl pkey -pubout -in worker-key.pem)" ]]; then
+            echo "worker certificate signed by $signer"
+            break
+          fi
+          > worker.pem
+        done
+        [[ -s worker.pem ]] || sleep 10
+      done
+
+      install -m 0600 worker-key.pem $ssl/worker-key.pem
+      install -m 0644 worker.pem $ssl/worker.pem
+
+      #when renewing on a running worker, the kubelet and kube-proxy only
+      #pick the certificate up when restarted
+      if systemctl -q is-active kubelet.service; then
+        systemctl --no-block restart kubelet.service
+        docker ps -q --filter name=k8s_kube-proxy | xargs -r docker kill
+      fi
+{{else}}
   - path: /etc/kubernetes/ssl/worker.pem
     encoding: gzip+base64
     content: {{.TLSConfig.WorkerCert.String}}
@@ -54,11 +163,22 @@ write_files:
   - path: /etc/kubernetes/ssl/worker-key.pem
     encoding: gzip+base64
     content: {{.TLSConfig.WorkerKey.String}}
+{{end}}
 
   - path: /etc/kubernetes/ssl/ca.pem
     encoding: gzip+base64
     content: {{.TLSConfig.CACert.String}}
 
+  - path: /etc/kubernetes/ssl/etcd-client.pem
+    encoding: gzip+base64
+    content: {{.TLSConfig.EtcdClientCert.String}}
+
+  - path: /etc/kubernetes/ssl/etcd-client-key.pem
+    encoding: gzip+base64
+    permissions: 0600
+    owner: etcd:etcd
+    content: {{.TLSConfig.EtcdClientKey.String}}
+
   - path: /etc/kubernetes/manifests/kube-proxy.yaml
     content: |
         apiVersion: v1
@@ -74,7 +194,7 @@ write_files:
             command:
             - /hyperkube
             - proxy
-            - --master=https://{{.ControllerIP}}:443
+            - --master={{.WorkerAPIServerEndpoint}}
             - --kubeconfig=/etc/kubernetes/worker-kubeconfig.yaml
             - --proxy-mode=iptables
             securityContext:
@@ -127,13 +247,33 @@ coreos:
   flannel:
     interface: $private_ipv4
     etcd_endpoints: {{.ETCDEndpoints}}
+    etcd_cafile: /etc/kubernetes/ssl/ca.pem
+    etcd_certfile: /etc/kubernetes/ssl/etcd-client.pem
+    etcd_keyfile: /etc/kubernetes/ssl/etcd-client-key.pem
   etcd2:
-    name: controller
-    advertise-client-urls: http://$private_ipv4:2379
-    initial-advertise-peer-urls: http://$private_ipv4:2380
-    listen-client-urls: http://0.0.0.0:2379
-    listen-peer-urls: http://0.0.0.0:2380
-    initial-cluster: controller=http://$private_ipv4:2380
+{{if .EtcdCount}}
+    proxy: on
+    listen-client-urls: http://127.0.0.1:2379
+    initial-cluster: {{.ETCDInitialCluster}}
+    peer-cert-file: /etc/kubernetes/ssl/etcd-client.pem
+    peer-key-file: /etc/kubernetes/ssl/etcd-client-key.pem
+    peer-trusted-ca-file: /etc/kubernetes/ssl/ca.pem
+{{else}}
+    name: $private_ipv4
+    advertise-client-urls: https://$private_ipv4:2379
+    initial-advertise-peer-urls: https://$private_ipv4:2380
+    listen-client-urls: https://$private_ipv4:2379,http://127.0.0.1:2379
+    listen-peer-urls: https://$private_ipv4:2380
+    initial-cluster: {{.ETCDInitialCluster}}
+    cert-file: /etc/kubernetes/ssl/etcd.pem
+    key-file: /etc/kubernetes/ssl/etcd-key.pem
+    client-cert-auth: true
+    trusted-ca-file: /etc/kubernetes/ssl/ca.pem
+    peer-cert-file: /etc/kubernetes/ssl/etcd-peer.pem
+    peer-key-file: /etc/kubernetes/ssl/etcd-peer-key.pem
+    peer-client-cert-auth: true
+    peer-trusted-ca-file: /etc/kubernetes/ssl/ca.pem
+{{end}}
   units:
     - name: etcd2.service
       command: start
@@ -197,6 +337,48 @@ coreos:
         ExecStartPre=/usr/bin/curl http://127.0.0.1:8080/version
         ExecStart=/opt/bin/install-kube-system
 
+{{if .TLS.PerNodeWorkerCertificates}}
+    - name: kube-worker-signer.socket
+      command: start
+      content: |
+        [Unit]
+        Description=Worker certificate signer
+
+        [Socket]
+        ListenStream=9443
+        Accept=yes
+        MaxConnections=16
+
+        [Install]
+        WantedBy=sockets.target
+
+    - name: kube-worker-signer@.service
+      content: |
+        [Unit]
+        Description=Worker certificate signer
+        Requires=kube-worker-signer-key.service
+        After=kube-worker-signer-key.service
+
+        [Service]
+        ExecStart=/opt/bin/kube-worker-signer
+        StandardInput=socket
+        StandardOutput=socket
+        StandardError=journal
+        TimeoutStartSec=60
+
+    - name: kube-worker-signer-key.service
+      content: |
+        [Unit]
+        Description=Worker signer CA key decryption
+        Requires=docker.service
+        After=docker.service
+
+        [Service]
+        Type=oneshot
+        RemainAfterExit=yes
+        ExecStart=/opt/bin/kube-worker-signer-key
+{{end}}
+{{if not .EtcdCount}}
     - name: var-lib-etcd2.mount
       enable: true
       content: |
@@ -228,8 +410,10 @@ coreos:
 
         [Install]
         RequiredBy=var-lib-etcd2.mount
+{{end}}
 
 write_files:
+{{if not .EtcdCount}}
   - path: /opt/bin/format-etcd2-volume
     permissions: 0700
     owner: root:root
@@ -240,6 +424,7 @@ write_files:
       else
         echo "etcd volume is already formatted"
       fi
+{{end}}
 
   - path: /opt/bin/install-kube-system
     permissions: 0700
@@ -259,6 +444,165 @@ write_files:
           -d @"/srv/kubernetes/manifests/$manifest" \
           "http://127.0.0.1:8080/api/v1/namespaces/kube-system/services"
       done
+{{if .TLS.PerNodeWorkerCertificates}}
+  - path: /opt/bin/kube-worker-signer
+    permissions: 0700
+    owner: root:root
+    content: |
+      #!/bin/bash -e
+      # Signs a certificate for the worker connected to the socket. The worker
+      # sends its instance identity document, the document's PKCS7 signature
+      # and a certificate signing request, each base64 encoded on one line,
+      # and is answered with its certificate chain. The certificate is only
+      # issued if the document is signed by AWS, belongs to this account and
+      # region, names the address the worker connects from, and its instance
+      # was launched by one of this cluster's auto scaling groups.
+      dir=/var/lib/kube-worker-signer
+      conf=/etc/kubernetes/worker-signer
+      work=$(mktemp -d)
+      trap "rm -rf $work" EXIT
+
+      remote=${REMOTE_ADDR#::ffff:}
+      fail() {
+        echo "refusing to sign a certificate for $remote: $*" >&2
+        exit 1
+      }
+
+      for part in document pkcs7 csr; do
+        read -r -t 10 line || fail "incomplete request"
+        echo "$line" | base64 -d > $work/$part || fail "malformed request"
+      done
+
+      #-nointern ignores any certificate carried by the signature itself, so
+      #that only the AWS certificate can have signed the document
+      (echo "-----BEGIN PKCS7-----"; cat $work/pkcs7; echo; echo "-----END PKCS7-----") > $work/pkcs7.pem
+      openssl smime -verify -inform PEM -in $work/pkcs7.pem -content $work/document \
+        -certfile $conf/instance-identity.pem -nointern -noverify > /dev/null 2>&1 \
+        || fail "instance identity document signature is invalid"
+
+      field() {
+        sed -n "s/.*\"$1\" *: *\"\([^\"]*\)\".*/\1/p" $2
+      }
+      curl -sf http://169.254.169.254/latest/dynamic/instance-identity/document > $work/own-document
+      [[ "$(field accountId $work/document)" == "$(field accountId $work/own-document)" ]] \
+        || fail "instance belongs to another account"
+      region=$(field region $work/document)
+      [[ "$region" == "$(field region $work/own-document)" ]] || fail "instance is in another region"
+      ip=$(field privateIp $work/document)
+      [[ -n "$ip" && "$ip" == "$remote" ]] || fail "instance identity document is for $ip"
+      instance=$(field instanceId $work/document)
+
+      #other instances of the account get signed documents too. CloudFormation
+      #tags the auto scaling groups it creates with their stack, and aws: tags
+      #cannot be set by anyone else.
+      aws() {
+        docker run --rm --net=host quay.io/coreos/awscli aws --region $region --output text "$@"
+      }
+      asg=$(aws autoscaling describe-auto-scaling-instances --instance-ids "$instance" \
+        --query "AutoScalingInstances[].AutoScalingGroupName") || fail "failed looking up instance $instance"
+      [[ -n "$asg" && "$asg" != "None" ]] || fail "instance $instance is not in an auto scaling group"
+      stack=$(aws autoscaling describe-tags \
+        --filters "Name=auto-scaling-group,Values=$asg" "Name=key,Values=aws:cloudformation:stack-name" \
+        --query "Tags[].Value") || fail "failed looking up the stack of $asg"
+      [[ "$stack" == "{{.ClusterName}}" ]] || fail "auto scaling group $asg does not belong to this cluster"
+
+      openssl req -verify -noout -in $work/csr > /dev/null 2>&1 || fail "invalid certificate signing request"
+      export WORKER_KEY_USAGE=digitalSignature
+      if openssl req -noout -text -in $work/csr | grep -q rsaEncryption; then
+        WORKER_KEY_USAGE=digitalSignature,keyEncipherment
+      fi
+
+      name=ip-${ip//./-}.$region.compute.internal
+      if [[ "$region" == "us-east-1" ]]; then
+        name=ip-${ip//./-}.ec2.internal
+      fi
+      export WORKER_SANS="DNS:$name,IP:$ip"
+
+      #certificates must not outlive the CA signing them
+      end=$(( $(date -u +%s) + {{.TLS.ValidityDays}} * 86400 ))
+      ca_end=$(date -u -d "$(openssl x509 -noout -enddate -in $conf/ca.pem | cut -d= -f2)" +%s)
+      [[ $end -le $ca_end ]] || end=$ca_end
+
+      mkdir -p $dir/certs
+      exec 9> $dir/lock
+      flock 9
+      [[ -f $dir/index.txt ]] || touch $dir/index.txt
+      [[ -f $dir/serial ]] || openssl rand -hex 16 > $dir/serial
+      openssl ca -batch -notext -config $conf/openssl.cnf -in $work/csr \
+        -enddate $(date -u -d @$end +%Y%m%d%H%M%SZ) \
+        -subj "{{.TLS.Subject.OpenSSLSubject "$name"}}" -out $work/worker.pem 2> $work/ca.log \
+        || fail "$(cat $work/ca.log)"
+      flock -u 9
+
+      #the worker signer CA is an intermediate, whose chain goes along
+      cat $conf/ca.pem >> $work/worker.pem
+      echo "signed certificate $(openssl x509 -noout -serial -in $work/worker.pem) for $instance ($name)" >&2
+      cat $work/worker.pem
+
+  - path: /opt/bin/kube-worker-signer-key
+    permissions: 0700
+    owner: root:root
+    content: |
+      #!/bin/bash -e
+      # Decrypts the worker signer CA key with KMS. Only the controllers' role
+      # may decrypt it, and only for this cluster, so the key is kept out of
+      # the user data and off the disk.
+      key=/run/kube-worker-signer/ca-key.pem
+      mkdir -p -m 0700 /run/kube-worker-signer
+      plaintext=$(docker run --rm --net=host -v /etc/kubernetes/worker-signer:/worker-signer:ro \
+        quay.io/coreos/awscli aws --region {{.Region}} kms decrypt \
+        --ciphertext-blob fileb:///worker-signer/ca-key.pem.kms \
+        --encryption-context KubernetesCluster={{.ClusterName}} \
+        --output text --query Plaintext)
+      (umask 077; echo "$plaintext" | base64 -d > $key)
+
+  - path: /etc/kubernetes/worker-signer/openssl.cnf
+    content: |
+      [ ca ]
+      default_ca = worker_signer
+
+      [ worker_signer ]
+      dir = /var/lib/kube-worker-signer
+      database = $dir/index.txt
+      serial = $dir/serial
+      new_certs_dir = $dir/certs
+      certificate = /etc/kubernetes/worker-signer/ca.pem
+      private_key = /run/kube-worker-signer/ca-key.pem
+      default_md = sha256
+      default_days = {{.TLS.ValidityDays}}
+      unique_subject = no
+      copy_extensions = none
+      policy = worker_policy
+      x509_extensions = worker_extensions
+
+      [ worker_policy ]
+      countryName = optional
+      stateOrProvinceName = optional
+      localityName = optional
+      organizationName = optional
+      organizationalUnitName = optional
+      commonName = supplied
+
+      [ worker_extensions ]
+      basicConstraints = critical, CA:FALSE
+      keyUsage = critical, ${ENV::WORKER_KEY_USAGE}
+      extendedKeyUsage = serverAuth, clientAuth
+      subjectAltName = ${ENV::WORKER_SANS}
+
+  - path: /etc/kubernetes/worker-signer/instance-identity.pem
+    encoding: base64
+    content: {{.TLS.EncodedInstanceIdentityCertificate}}
+
+  - path: /etc/kubernetes/worker-signer/ca.pem
+    encoding: gzip+base64
+    content: {{.TLSConfig.WorkerSignerCACert.String}}
+
+  - path: /etc/kubernetes/worker-signer/ca-key.pem.kms
+    encoding: gzip+base64
+    permissions: 0600
+    owner: root:root
+    content: {{.TLSConfig.WorkerSignerCAKeyCiphertext.String}}
+{{end}}
 
   - path: /etc/kubernetes/manifests/kube-proxy.yaml
     content: |
@@ -313,7 +657,7 @@ write_files:
           - --tls-cert-file=/etc/kubernetes/ssl/apiserver.pem
           - --tls-private-key-file=/etc/kubernetes/ssl/apiserver-key.pem
           - --client-ca-file=/etc/kubernetes/ssl/ca.pem
-          - --service-account-key-file=/etc/kubernetes/ssl/apiserver-key.pem
+          - --service-account-key-file=/etc/kubernetes/ssl/service-account-key.pem
           - --runtime-config=extensions/v1beta1/deployments=true,extensions/v1beta1/daemonsets=true
           - --cloud-provider=aws
           ports:
@@ -379,7 +723,23 @@ write_files:
             readOnly: true
           - mountPath: /dst/manifests
             name: manifest-dst
-        volumes:
+{{if .ClusterAutoscaler}}
+        - name: cluster-autoscaler-elector
+          image: gcr.io/google_containers/podmaster:1.1
+          command:
+          - /podmaster
+          - --etcd-servers=http://localhost:2379
+          - --key=cluster-autoscaler
+          - --whoami=$private_ipv4
+          - --source-file=/src/manifests/cluster-autoscaler.yaml
+          - --dest-file=/dst/manifests/cluster-autoscaler.yaml
+          volumeMounts:
+          - mountPath: /src/manifests
+            name: manifest-src
+            readOnly: true
+          - mountPath: /dst/manifests
+            name: manifest-dst
+{{end}}        volumes:
         - hostPath:
             path: /srv/kubernetes/manifests
           name: manifest-src
@@ -387,7 +747,7 @@ write_files:
             path: /etc/kubernetes/manifests
           name: manifest-dst
 
-  - path: /etc/kubernetes/manifests/kube-controller-manager.yaml
+  - path: /srv/kubernetes/manifests/kube-controller-manager.yaml
     content: |
       apiVersion: v1
       kind: Pod
@@ -402,7 +762,7 @@ write_files:
           - /hyperkube
           - controller-manager
           - --master=http://127.0.0.1:8080
-          - --service-account-private-key-file=/etc/kubernetes/ssl/apiserver-key.pem
+          - --service-account-private-key-file=/etc/kubernetes/ssl/service-account-key.pem
           - --root-ca-file=/etc/kubernetes/ssl/ca.pem
           - --cloud-provider=aws
           livenessProbe:
@@ -428,7 +788,7 @@ write_files:
             path: /usr/share/ca-certificates
           name: ssl-certs-host
 
-  - path: /etc/kubernetes/manifests/kube-scheduler.yaml
+  - path: /srv/kubernetes/manifests/kube-scheduler.yaml
     content: |
       apiVersion: v1
       kind: Pod
@@ -452,6 +812,37 @@ write_files:
             initialDelaySeconds: 15
             timeoutSeconds: 1
 
+{{if .ClusterAutoscaler}}
+  - path: /srv/kubernetes/manifests/cluster-autoscaler.yaml
+    content: |
+      apiVersion: v1
+      kind: Pod
+      metadata:
+        name: cluster-autoscaler
+        namespace: kube-system
+      spec:
+        hostNetwork: true
+        containers:
+        - name: cluster-autoscaler
+          image: gcr.io/google_containers/cluster-autoscaler:v0.6.0
+          command:
+          - ./cluster-autoscaler
+          - --kubernetes=http://127.0.0.1:8080
+          - --cloud-provider=aws
+          - --skip-nodes-with-local-storage=false
+          - --node-group-auto-discovery=asg:tag=k8s.io/cluster-autoscaler/enabled,kubernetes.io/cluster/{{.ClusterName}}
+          env:
+          - name: AWS_REGION
+            value: {{.Region}}
+          volumeMounts:
+          - mountPath: /etc/ssl/certs
+            name: ssl-certs-host
+            readOnly: true
+        volumes:
+        - hostPath:
+            path: /usr/share/ca-certificates
+          name: ssl-certs-host
+{{end}}
   - path: /srv/kubernetes/manifests/kube-system.json
     content: |
         {
@@ -842,4 +1233,137 @@ write_files:
   - path: /etc/kubernetes/ssl/apiserver-key.pem
     encoding: gzip+base64
     content: {{.TLSConfig.APIServerKey.String}}
+
+  - path: /etc/kubernetes/ssl/service-account-key.pem
+    encoding: gzip+base64
+    content: {{.TLSConfig.ServiceAccountKey.String}}
+
+  - path: /etc/kubernetes/ssl/etcd-client.pem
+    encoding: gzip+base64
+    content: {{.TLSConfig.EtcdClientCert.String}}
+
+  - path: /etc/kubernetes/ssl/etcd-client-key.pem
+    encoding: gzip+base64
+    permissions: 0600
+    owner: etcd:etcd
+    content: {{.TLSConfig.EtcdClientKey.String}}
+{{if not .EtcdCount}}
+  - path: /etc/kubernetes/ssl/etcd.pem
+    encoding: gzip+base64
+    content: {{.TLSConfig.EtcdCert.String}}
+
+  - path: /etc/kubernetes/ssl/etcd-key.pem
+    encoding: gzip+base64
+    permissions: 0600
+    owner: etcd:etcd
+    content: {{.TLSConfig.EtcdKey.String}}
+
+  - path: /etc/kubernetes/ssl/etcd-peer.pem
+    encoding: gzip+base64
+    content: {{.TLSConfig.EtcdPeerCert.String}}
+
+  - path: /etc/kubernetes/ssl/etcd-peer-key.pem
+    encoding: gzip+base64
+    permissions: 0600
+    owner: etcd:etcd
+    content: {{.TLSConfig.EtcdPeerKey.String}}
+{{end}}`
+
+const cloudConfigEtcdTemplate = `#cloud-config
+coreos:
+  update:
+    reboot-strategy: "off"
+  etcd2:
+    name: $private_ipv4
+    advertise-client-urls: https://$private_ipv4:2379
+    initial-advertise-peer-urls: https://$private_ipv4:2380
+    listen-client-urls: https://0.0.0.0:2379
+    listen-peer-urls: https://0.0.0.0:2380
+    initial-cluster: {{.ETCDInitialCluster}}
+    cert-file: /etc/kubernetes/ssl/etcd.pem
+    key-file: /etc/kubernetes/ssl/etcd-key.pem
+    client-cert-auth: true
+    trusted-ca-file: /etc/kubernetes/ssl/ca.pem
+    peer-cert-file: /etc/kubernetes/ssl/etcd-peer.pem
+    peer-key-file: /etc/kubernetes/ssl/etcd-peer-key.pem
+    peer-client-cert-auth: true
+    peer-trusted-ca-file: /etc/kubernetes/ssl/ca.pem
+  units:
+    - name: etcd2.service
+      command: start
+      drop-ins:
+        - name: 80-data-dir-permissions.conf
+          content: |
+            [Service]
+            Environment=ETCD_DATA_DIR=/var/lib/etcd2
+            PermissionsStartOnly=true
+            ExecStartPre=/usr/bin/chown -R etcd:etcd /var/lib/etcd2
+
+    - name: var-lib-etcd2.mount
+      enable: true
+      content: |
+        [Unit]
+        Description=etcd2 data directory ebs volume mount
+        Before=etcd2.service
+
+        [Mount]
+        What=/dev/xvdf
+        Where=/var/lib/etcd2
+        Type=ext4
+
+        [Install]
+        RequiredBy=etcd2.service
+
+    - name: format-etcd2-volume.service
+      enable: true
+      content: |
+        [Unit]
+        Description=etcd2 ebs volume formatting
+        Before=var-lib-etcd2.mount
+        After=dev-xvdf.device
+        Requires=dev-xvdf.device
+
+        [Service]
+        Type=oneshot
+        RemainAfterExit=yes
+        ExecStart=/opt/bin/format-etcd2-volume
+
+        [Install]
+        RequiredBy=var-lib-etcd2.mount
+
+write_files:
+  - path: /opt/bin/format-etcd2-volume
+    permissions: 0700
+    owner: root:root
+    content: |
+      #!/bin/bash -e
+      if [[ "$(wipefs -n -p /dev/xvdf | grep ext4)" == "" ]];then
+        mkfs.ext4 /dev/xvdf
+      else
+        echo "etcd volume is already formatted"
+      fi
+
+  - path: /etc/kubernetes/ssl/ca.pem
+    encoding: gzip+base64
+    content: {{.TLSConfig.CACert.String}}
+
+  - path: /etc/kubernetes/ssl/etcd.pem
+    encoding: gzip+base64
+    content: {{.TLSConfig.EtcdCert.String}}
+
+  - path: /etc/kubernetes/ssl/etcd-key.pem
+    encoding: gzip+base64
+    permissions: 0600
+    owner: etcd:etcd
+    content: {{.TLSConfig.EtcdKey.String}}
+
+  - path: /etc/kubernetes/ssl/etcd-peer.pem
+    encoding: gzip+base64
+    content: {{.TLSConfig.EtcdPeerCert.String}}
+
+  - path: /etc/kubernetes/ssl/etcd-peer-key.pem
+    encoding: gzip+base64
+    permissions: 0600
+    owner: etcd:etcd
+    content: {{.TLSConfig.EtcdPeerKey.String}}
 `
@@ -1,11 +1,26 @@
 package config
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/coreos/coreos-kubernetes/multi-node/aws/pkg/blobutil"
 	"github.com/coreos/coreos-kubernetes/multi-node/aws/pkg/tlsutil"
+	yaml "gopkg.in/yaml.v2"
 )
 
 type TLSConfig struct {
@@ -15,16 +30,61 @@ type TLSConfig struct {
 	APIServerCert *blobutil.NamedBuffer
 	APIServerKey  *blobutil.NamedBuffer
 
+	//ServiceAccountKey signs service account tokens. It is always RSA, the
+	//only kind of key the apiserver verifies tokens with, and has no
+	//certificate.
+	ServiceAccountKey *blobutil.NamedBuffer
+
 	WorkerCert *blobutil.NamedBuffer
 	WorkerKey  *blobutil.NamedBuffer
 
 	AdminCert *blobutil.NamedBuffer
 	AdminKey  *blobutil.NamedBuffer
 
+	EtcdCert *blobutil.NamedBuffer
+	EtcdKey  *blobutil.NamedBuffer
+
+	EtcdPeerCert *blobutil.NamedBuffer
+	EtcdPeerKey  *blobutil.NamedBuffer
+
+	EtcdClientCert *blobutil.NamedBuffer
+	EtcdClientKey  *blobutil.NamedBuffer
+
 	buffers        blobutil.NamedBufferList
 	credentialsDir string
+
+	//encryption, when set, has the private keys encrypted at rest
+	encryption *CredentialsEncryption
+
+	//certificate signing requests written in place of certificates
+	//when an external CA signs them
+	externalCA bool
+	requests   blobutil.NamedBufferList
+
+	//CRL lists the revoked certificates, signed by the CA. It is kept
+	//apart from the other assets, as it may be missing.
+	CRL     *blobutil.NamedBuffer
+	revoked []RevokedCertificate
+
+	//WorkerSignerCACert and WorkerSignerCAKey are the intermediate CA the
+	//controllers sign the workers' certificates with, when
+	//tls.perNodeWorkerCertificates is enabled. The key only reaches the
+	//controllers encrypted with KMS, as WorkerSignerCAKeyCiphertext.
+	WorkerSignerCACert          *blobutil.NamedBuffer
+	WorkerSignerCAKey           *blobutil.NamedBuffer
+	WorkerSignerCAKeyCiphertext *blobutil.NamedBuffer
 }
 
+// RevokedCertificate is an entry of the revocation database kept in the
+// credentials directory
+type RevokedCertificate struct {
+	SerialNumber string `yaml:"serialNumber"`
+	Name         string `yaml:"name,omitempty"`
+	RevokedAt    string `yaml:"revokedAt"`
+}
+
+const revocationDatabase = "revoked.yaml"
+
 func newTLSConfig() *TLSConfig {
 	tlsConfig := &TLSConfig{
 		CACert: &blobutil.NamedBuffer{Name: "ca.pem"},
@@ -33,12 +93,29 @@ func newTLSConfig() *TLSConfig {
 		APIServerCert: &blobutil.NamedBuffer{Name: "apiserver.pem"},
 		APIServerKey:  &blobutil.NamedBuffer{Name: "apiserver-key.pem"},
 
+		ServiceAccountKey: &blobutil.NamedBuffer{Name: "service-account-key.pem"},
+
 		WorkerCert: &blobutil.NamedBuffer{Name: "worker.pem"},
 		WorkerKey:  &blobutil.NamedBuffer{Name: "worker-key.pem"},
 
 		AdminCert: &blobutil.NamedBuffer{Name: "admin.pem"},
 		AdminKey:  &blobutil.NamedBuffer{Name: "admin-key.pem"},
 
+		EtcdCert: &blobutil.NamedBuffer{Name: "etcd.pem"},
+		EtcdKey:  &blobutil.NamedBuffer{Name: "etcd-key.pem"},
+
+		EtcdPeerCert: &blobutil.NamedBuffer{Name: "etcd-peer.pem"},
+		EtcdPeerKey:  &blobutil.NamedBuffer{Name: "etcd-peer-key.pem"},
+
+		EtcdClientCert: &blobutil.NamedBuffer{Name: "etcd-client.pem"},
+		EtcdClientKey:  &blobutil.NamedBuffer{Name: "etcd-client-key.pem"},
+
+		CRL: &blobutil.NamedBuffer{Name: "crl.pem"},
+
+		WorkerSignerCACert:          &blobutil.NamedBuffer{Name: "worker-signer-ca.pem"},
+		WorkerSignerCAKey:           &blobutil.NamedBuffer{Name: "worker-signer-ca-key.pem"},
+		WorkerSignerCAKeyCiphertext: &blobutil.NamedBuffer{Name: "worker-signer-ca-key.pem.kms"},
+
 		credentialsDir: credentialsDir,
 	}
 
@@ -49,143 +126,972 @@ func newTLSConfig() *TLSConfig {
 		tlsConfig.APIServerCert,
 		tlsConfig.APIServerKey,
 
+		tlsConfig.ServiceAccountKey,
+
 		tlsConfig.WorkerCert,
 		tlsConfig.WorkerKey,
 
 		tlsConfig.AdminCert,
 		tlsConfig.AdminKey,
+
+		tlsConfig.EtcdCert,
+		tlsConfig.EtcdKey,
+
+		tlsConfig.EtcdPeerCert,
+		tlsConfig.EtcdPeerKey,
+
+		tlsConfig.EtcdClientCert,
+		tlsConfig.EtcdClientKey,
 	}
 
 	return tlsConfig
 }
 
 func (tc *TLSConfig) generateAllTLS(cfg *Config) error {
+	if err := tc.generateServiceAccountKey(); err != nil {
+		return err
+	}
+
+	if tc.externalCA {
+		if cfg.TLS.PerNodeWorkerCertificates {
+			return fmt.Errorf("tls.perNodeWorkerCertificates requires %s to be kept with the cluster, it cannot be used with an external CA", tc.CAKey.Name)
+		}
+		return tc.generateLeafTLS(cfg, nil, nil)
+	}
+
+	//an imported CA signs the leaf certificates instead of a new one
+	if tc.CACert.Len() > 0 {
+		if err := tc.rotateLeafTLS(cfg, true); err != nil {
+			return err
+		}
+		return tc.generateCRL(cfg)
+	}
 
 	caConfig := tlsutil.CACertConfig{
-		CommonName:   "kube-ca",
-		Organization: "kube-aws",
+		CommonName: cfg.TLS.CACommonName,
+		Subject:    cfg.TLS.Subject.subject(),
+		Duration:   cfg.TLS.CAValidity(),
 	}
 
-	caKey, caCert, err := tc.generateTLSCA(caConfig)
+	caKey, err := tlsutil.NewPrivateKey(cfg.TLS.KeyAlgorithm)
+	if err != nil {
+		return err
+	}
+	caCert, err := tc.generateTLSCA(caConfig, caKey)
 	if err != nil {
 		return err
 	}
 
-	apiserverConfig := tlsutil.ServerCertConfig{
-		CommonName: "kube-apiserver",
-		DNSNames: []string{
-			"kubernetes",
-			"kubernetes.default",
-			"kubernetes.default.svc",
-			"kubernetes.default.svc.cluster.local",
-			cfg.ExternalDNSName,
-		},
-		IPAddresses: []string{
-			cfg.ControllerIP,
-			cfg.KubernetesServiceIP,
-		},
+	if err := tc.generateLeafTLS(cfg, caCert, caKey); err != nil {
+		return err
+	}
+	if cfg.TLS.PerNodeWorkerCertificates {
+		if err := tc.generateWorkerSignerCA(cfg, caCert, caKey); err != nil {
+			return err
+		}
 	}
-	if err := tc.generateTLSServer(apiserverConfig, caKey, caCert); err != nil {
+	return tc.generateCRL(cfg)
+}
+
+// generateServiceAccountKey generates the RSA key service account tokens
+// are signed with
+func (tc *TLSConfig) generateServiceAccountKey() error {
+	key, err := tlsutil.NewPrivateKey(tlsutil.KeyAlgorithmRSA2048)
+	if err != nil {
 		return err
 	}
+	tc.ServiceAccountKey.Reset()
+	return tlsutil.WritePrivateKeyPEMBlock(tc.ServiceAccountKey, key)
+}
 
-	workerConfig := tlsutil.ClientCertConfig{
-		CommonName: "kube-worker",
-		DNSNames: []string{
-			"*.*.compute.internal",
-			"*.ec2.internal",
-		},
+// serviceAccountKeyFromAPIServerKey takes the service account key from
+// the apiserver's key, which signed service account tokens in asset
+// directories rendered by older versions, so that the tokens stay valid
+func (tc *TLSConfig) serviceAccountKeyFromAPIServerKey() error {
+	key, err := tlsutil.DecodePrivateKeyPEM(tc.APIServerKey.Bytes())
+	if err != nil {
+		return fmt.Errorf("Error parsing %s : %v", tc.APIServerKey.Name, err)
+	}
+	if _, ok := key.(*rsa.PrivateKey); !ok {
+		return fmt.Errorf("%s is missing, and %s is not an RSA key to sign service account tokens with", tc.ServiceAccountKey.Name, tc.APIServerKey.Name)
+	}
+	tc.ServiceAccountKey.Reset()
+	return tlsutil.WritePrivateKeyPEMBlock(tc.ServiceAccountKey, key)
+}
+
+// workerSignerBuffers returns the buffers of the worker signer CA, which
+// may be missing
+func (tc *TLSConfig) workerSignerBuffers() blobutil.NamedBufferList {
+	return blobutil.NamedBufferList{
+		tc.WorkerSignerCACert,
+		tc.WorkerSignerCAKey,
+	}
+}
+
+// generateWorkerSignerCA issues the intermediate CA the controllers sign
+// the workers' certificates with, for its existing key if it has one. The
+// CA may only sign certificates authenticating clients and servers, for
+// the names and addresses EC2 gives instances in the cluster's VPC. A new
+// key has to be encrypted with KMS again.
+func (tc *TLSConfig) generateWorkerSignerCA(cfg *Config, caCert *x509.Certificate, caKey crypto.Signer) error {
+	previousKey := tc.WorkerSignerCAKey.String()
+	key, err := leafKey(cfg, tc.WorkerSignerCAKey)
+	if err != nil {
+		return err
+	}
+
+	domain := cfg.Region + ".compute.internal"
+	if cfg.Region == "us-east-1" {
+		domain = "ec2.internal"
+	}
+	cert, err := tlsutil.NewSignedIntermediateCACertificate(tlsutil.IntermediateCACertConfig{
+		CommonName:          "kube-worker-signer",
+		ExtKeyUsages:        []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		PermittedDNSDomains: []string{domain},
+		PermittedIPRanges:   []string{cfg.VPCCIDR},
+		Duration:            cfg.TLS.Validity(),
+	}, key, caCert, caKey)
+	if err != nil {
+		return err
+	}
+
+	if err := tlsutil.WritePrivateKeyPEMBlock(tc.WorkerSignerCAKey, key); err != nil {
+		return err
+	}
+	if tc.WorkerSignerCAKey.String() != previousKey {
+		tc.WorkerSignerCAKeyCiphertext.Reset()
 	}
-	if err := tc.generateTLSClientWorker(workerConfig, caKey, caCert); err != nil {
+	//the chain up to the root is served along with the workers' certificates
+	tc.WorkerSignerCACert.Reset()
+	if err := tlsutil.WriteCertificatePEMBlock(tc.WorkerSignerCACert, cert); err != nil {
 		return err
 	}
+	_, err = tc.WorkerSignerCACert.Write(tc.CACert.Bytes())
+	return err
+}
+
+// leafCert describes one of the certificates signed by the cluster's CA
+type leafCert struct {
+	certBuf, keyBuf *blobutil.NamedBuffer
+	commonName      string
+	dnsNames        []string
+	ipAddresses     []string
+	usages          []x509.ExtKeyUsage
+}
+
+func (tc *TLSConfig) leafCerts(cfg *Config) []leafCert {
+	apiserverIPs := []string{cfg.KubernetesServiceIP}
+	for _, controller := range cfg.Controllers {
+		apiserverIPs = append(apiserverIPs, controller.IP)
+	}
+	apiserverIPs = append(apiserverIPs, cfg.TLS.APIServerIPs...)
+
+	//etcd members serve clients and peers on their private IPs, and
+	//controllers additionally reach their local member over loopback
+	etcdIPs := []string{"127.0.0.1"}
+	for _, member := range cfg.etcdMembers() {
+		etcdIPs = append(etcdIPs, member.IP)
+	}
+
+	serverAuth := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	clientAuth := []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return []leafCert{
+		{
+			certBuf:    tc.APIServerCert,
+			keyBuf:     tc.APIServerKey,
+			commonName: "kube-apiserver",
+			dnsNames: append([]string{
+				"kubernetes",
+				"kubernetes.default",
+				"kubernetes.default.svc",
+				"kubernetes.default.svc.cluster.local",
+				cfg.ExternalDNSName,
+			}, cfg.TLS.APIServerDNSNames...),
+			ipAddresses: apiserverIPs,
+			usages:      serverAuth,
+		},
+		{
+			certBuf:    tc.WorkerCert,
+			keyBuf:     tc.WorkerKey,
+			commonName: "kube-worker",
+			dnsNames: []string{
+				"*.*.compute.internal",
+				"*.ec2.internal",
+			},
+			usages: clientAuth,
+		},
+		{
+			certBuf:    tc.AdminCert,
+			keyBuf:     tc.AdminKey,
+			commonName: "kube-admin",
+			usages:     clientAuth,
+		},
+		{
+			certBuf:     tc.EtcdCert,
+			keyBuf:      tc.EtcdKey,
+			commonName:  "kube-etcd",
+			dnsNames:    []string{"localhost"},
+			ipAddresses: etcdIPs,
+			usages:      serverAuth,
+		},
+		{
+			certBuf:     tc.EtcdPeerCert,
+			keyBuf:      tc.EtcdPeerKey,
+			commonName:  "kube-etcd-peer",
+			ipAddresses: etcdIPs[1:],
+			usages:      append(serverAuth, clientAuth...),
+		},
+		{
+			certBuf:    tc.EtcdClientCert,
+			keyBuf:     tc.EtcdClientKey,
+			commonName: "kube-etcd-client",
+			usages:     clientAuth,
+		},
+	}
+}
+
+// generateLeafTLS issues every certificate other than the CA itself. Without
+// a CA, it writes certificate signing requests for an external CA instead.
+func (tc *TLSConfig) generateLeafTLS(cfg *Config, caCert *x509.Certificate, caKey crypto.Signer) error {
+	tc.requests = nil
+	for _, leaf := range tc.leafCerts(cfg) {
+		key, err := leafKey(cfg, leaf.keyBuf)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case caCert == nil:
+			err = tc.generateTLSRequest(leaf, key, cfg.TLS.Subject.subject())
+		case len(leaf.usages) > 1:
+			err = tc.generateTLSPeer(tlsutil.PeerCertConfig{
+				CommonName:  leaf.commonName,
+				DNSNames:    leaf.dnsNames,
+				IPAddresses: leaf.ipAddresses,
+				Duration:    cfg.TLS.Validity(),
+			}, key, caCert, caKey, leaf.certBuf, leaf.keyBuf)
+		case leaf.usages[0] == x509.ExtKeyUsageServerAuth:
+			err = tc.generateTLSServer(tlsutil.ServerCertConfig{
+				CommonName:  leaf.commonName,
+				DNSNames:    leaf.dnsNames,
+				IPAddresses: leaf.ipAddresses,
+				Duration:    cfg.TLS.Validity(),
+			}, key, caCert, caKey, leaf.certBuf, leaf.keyBuf)
+		default:
+			err = tc.generateTLSClient(tlsutil.ClientCertConfig{
+				CommonName:  leaf.commonName,
+				DNSNames:    leaf.dnsNames,
+				IPAddresses: leaf.ipAddresses,
+				Duration:    cfg.TLS.Validity(),
+			}, key, caCert, caKey, leaf.certBuf, leaf.keyBuf)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leafKey returns the key held in keyBuf, if any, so that it is signed
+// again, or a new key otherwise. keyBuf is emptied for the key to be
+// written back.
+func leafKey(cfg *Config, keyBuf *blobutil.NamedBuffer) (crypto.Signer, error) {
+	defer keyBuf.Reset()
+	if keyBuf.Len() > 0 {
+		if key, err := tlsutil.DecodePrivateKeyPEM(keyBuf.Bytes()); err == nil {
+			return key, nil
+		}
+	}
+	return tlsutil.NewPrivateKey(cfg.TLS.KeyAlgorithm)
+}
+
+func (tc *TLSConfig) leafBuffers() blobutil.NamedBufferList {
+	return blobutil.NamedBufferList{
+		tc.APIServerCert,
+		tc.APIServerKey,
+
+		tc.WorkerCert,
+		tc.WorkerKey,
 
-	adminConfig := tlsutil.ClientCertConfig{
-		CommonName: "kube-admin",
+		tc.AdminCert,
+		tc.AdminKey,
+
+		tc.EtcdCert,
+		tc.EtcdKey,
+
+		tc.EtcdPeerCert,
+		tc.EtcdPeerKey,
+
+		tc.EtcdClientCert,
+		tc.EtcdClientKey,
 	}
-	return tc.generateTLSClientAdmin(adminConfig, caKey, caCert)
 }
 
-func (tc *TLSConfig) generateTLSCA(cfg tlsutil.CACertConfig) (*x509.Certificate, *rsa.PrivateKey, error) {
-	key, err := tlsutil.NewPrivateKey()
+// CACertificate parses the CA certificate held in CACert.
+func (tc *TLSConfig) CACertificate() (*x509.Certificate, error) {
+	cert, err := tlsutil.DecodeCertificatePEM(tc.CACert.Bytes())
 	if err != nil {
-		return nil, nil, err
+		return nil, fmt.Errorf("Error parsing %s : %v", tc.CACert.Name, err)
 	}
+	return cert, nil
+}
 
-	cert, err := tlsutil.NewSelfSignedCACertificate(cfg, key)
+// caSigner parses the CA certificate and key held in CACert and CAKey,
+// checking that they can still sign certificates
+func (tc *TLSConfig) caSigner() (*x509.Certificate, crypto.Signer, error) {
+	caCert, err := tc.CACertificate()
 	if err != nil {
 		return nil, nil, err
 	}
+	if tc.CAKey.Len() == 0 {
+		return nil, nil, fmt.Errorf("%s is not available, certificates signed by an external CA must be managed by it", tc.CAKey.Name)
+	}
+	caKey, err := tlsutil.DecodePrivateKeyPEM(tc.CAKey.Bytes())
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error parsing %s : %v", tc.CAKey.Name, err)
+	}
+	if !tlsutil.KeyMatchesCertificate(caKey, caCert) {
+		return nil, nil, fmt.Errorf("%s does not match %s", tc.CAKey.Name, tc.CACert.Name)
+	}
+	if time.Now().After(caCert.NotAfter) {
+		return nil, nil, fmt.Errorf("CA certificate expired on %s, the cluster assets must be re-rendered", caCert.NotAfter.Format(time.RFC3339))
+	}
+	return caCert, caKey, nil
+}
+
+// rotateLeafTLS re-issues the leaf certificates from the CA already held
+// in CACert and CAKey. Their keys are kept unless newKeys is set. The
+// service account key is never replaced, as that would invalidate every
+// service account token.
+func (tc *TLSConfig) rotateLeafTLS(cfg *Config, newKeys bool) error {
+	caCert, caKey, err := tc.caSigner()
+	if err != nil {
+		return err
+	}
 
-	if err := tlsutil.WritePrivateKeyPEMBlock(tc.CAKey, key); err != nil {
-		return nil, nil, err
+	for _, buf := range append(tc.leafBuffers(), tc.workerSignerBuffers()...) {
+		if newKeys || !strings.HasSuffix(buf.Name, "-key.pem") {
+			buf.Reset()
+		}
 	}
-	if err := tlsutil.WriteCertificatePEMBlock(tc.CACert, cert); err != nil {
-		return nil, nil, err
+	if err := tc.generateLeafTLS(cfg, caCert, caKey); err != nil {
+		return err
+	}
+	if cfg.TLS.PerNodeWorkerCertificates {
+		if err := tc.generateWorkerSignerCA(cfg, caCert, caKey); err != nil {
+			return err
+		}
+	}
+
+	//certificates signed by an intermediate CA carry its chain, so that
+	//they verify against the root alone
+	if !bytes.Equal(caCert.RawIssuer, caCert.RawSubject) {
+		for _, buf := range tc.leafBuffers() {
+			if !strings.HasSuffix(buf.Name, "-key.pem") {
+				if _, err := buf.Write(tc.CACert.Bytes()); err != nil {
+					return err
+				}
+			}
+		}
 	}
 
-	return cert, key, nil
+	return nil
 }
 
-func (tc *TLSConfig) generateTLSServer(cfg tlsutil.ServerCertConfig, caCert *x509.Certificate, caKey *rsa.PrivateKey) error {
-	key, err := tlsutil.NewPrivateKey()
+// generateCRL signs a certificate revocation list of the certificates in
+// the revocation database into CRL
+func (tc *TLSConfig) generateCRL(cfg *Config) error {
+	caCert, caKey, err := tc.caSigner()
 	if err != nil {
 		return err
 	}
 
-	cert, err := tlsutil.NewSignedServerCertificate(cfg, key, caCert, caKey)
+	revoked := make([]pkix.RevokedCertificate, len(tc.revoked))
+	for i, entry := range tc.revoked {
+		serial, ok := new(big.Int).SetString(entry.SerialNumber, 10)
+		if !ok {
+			return fmt.Errorf("invalid serial number %q in %s", entry.SerialNumber, revocationDatabase)
+		}
+		revokedAt, err := time.Parse(time.RFC3339, entry.RevokedAt)
+		if err != nil {
+			return fmt.Errorf("invalid revocation time of serial number %s in %s: %v", entry.SerialNumber, revocationDatabase, err)
+		}
+		revoked[i] = pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: revokedAt.UTC(),
+		}
+	}
+
+	crl, err := tlsutil.NewSignedCRL(revoked, cfg.TLS.Validity(), caCert, caKey)
 	if err != nil {
 		return err
 	}
+	tc.CRL.Reset()
+	return tlsutil.WriteCRLPEMBlock(tc.CRL, crl)
+}
+
+// revoke adds a certificate to the revocation database and re-generates
+// the CRL. The certificate is either one of the TLS assets, by file name
+// with or without its .pem extension, or any certificate signed by the CA
+// by serial number, as parsed by parseSerialNumber.
+func (tc *TLSConfig) revoke(cfg *Config, certificate string) (*RevokedCertificate, error) {
+	entry := &RevokedCertificate{RevokedAt: time.Now().UTC().Format(time.RFC3339)}
+	for _, buf := range tc.leafBuffers() {
+		if strings.HasSuffix(buf.Name, "-key.pem") || (buf.Name != certificate && buf.Name != certificate+".pem") {
+			continue
+		}
+		cert, err := tlsutil.DecodeCertificatePEM(buf.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing %s : %v", buf.Name, err)
+		}
+		entry.Name = buf.Name
+		entry.SerialNumber = cert.SerialNumber.String()
+	}
+	if entry.Name == "" {
+		serial, ok := parseSerialNumber(certificate)
+		if !ok {
+			return nil, fmt.Errorf("%s is neither a certificate in %s nor a serial number", certificate, tc.credentialsDir)
+		}
+		entry.SerialNumber = serial.String()
+	}
+
+	if caCert, err := tc.CACertificate(); err == nil && caCert.SerialNumber.String() == entry.SerialNumber {
+		return nil, errors.New("the CA certificate cannot be revoked, the cluster assets must be re-rendered to replace it")
+	}
+	for _, revoked := range tc.revoked {
+		if revoked.SerialNumber == entry.SerialNumber {
+			return nil, fmt.Errorf("serial number %s was already revoked on %s", entry.SerialNumber, revoked.RevokedAt)
+		}
+	}
+
+	tc.revoked = append(tc.revoked, *entry)
+	if err := tc.generateCRL(cfg); err != nil {
+		tc.revoked = tc.revoked[:len(tc.revoked)-1]
+		return nil, err
+	}
+	return entry, nil
+}
+
+// parseSerialNumber parses a certificate serial number. It is read as
+// hexadecimal when printed by openssl, either prefixed with serial= (as by
+// openssl x509 -serial) or colon separated (as by openssl x509 -text), when
+// prefixed with 0x, or when it holds any of the letters a to f. Otherwise
+// it is read as decimal, as printed by kube-aws.
+func parseSerialNumber(s string) (*big.Int, bool) {
+	digits, base := s, 10
+	switch {
+	case strings.HasPrefix(s, "serial="):
+		digits, base = strings.TrimPrefix(s, "serial="), 16
+	case strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X"):
+		digits, base = s[2:], 16
+	case strings.Contains(s, ":"):
+		digits, base = strings.Replace(s, ":", "", -1), 16
+	case strings.ContainsAny(s, "abcdefABCDEF"):
+		base = 16
+	}
+	if digits == "" || strings.ContainsAny(digits, "+-_") {
+		return nil, false
+	}
+	return new(big.Int).SetString(digits, base)
+}
 
-	if err := tlsutil.WritePrivateKeyPEMBlock(tc.APIServerKey, key); err != nil {
+// issueUserTLS signs a client certificate for user, carrying groups as
+// its organizations, into certBuf and keyBuf
+func (tc *TLSConfig) issueUserTLS(cfg *Config, user string, groups []string, certBuf, keyBuf *blobutil.NamedBuffer) (*x509.Certificate, error) {
+	caCert, caKey, err := tc.caSigner()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := tlsutil.NewPrivateKey(cfg.TLS.KeyAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tlsutil.NewSignedClientCertificate(tlsutil.ClientCertConfig{
+		CommonName:    user,
+		Organizations: groups,
+		Duration:      cfg.TLS.UserValidity(),
+	}, key, caCert, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tlsutil.WritePrivateKeyPEMBlock(keyBuf, key); err != nil {
+		return nil, err
+	}
+	if err := tlsutil.WriteCertificatePEMBlock(certBuf, cert); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(caCert.RawIssuer, caCert.RawSubject) {
+		if _, err := certBuf.Write(tc.CACert.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	return cert, nil
+}
+
+// ImportCA makes the TLS config sign its certificates with an existing
+// CA instead of a self-signed one. caCertPEM holds the CA certificate,
+// optionally followed by the chain of certificates that issued it.
+func (tc *TLSConfig) ImportCA(caCertPEM, caKeyPEM []byte) error {
+	certs, err := tlsutil.DecodeCertificatesPEM(caCertPEM)
+	if err != nil {
+		return fmt.Errorf("Error parsing CA certificate: %v", err)
+	}
+	caKey, err := tlsutil.DecodePrivateKeyPEM(caKeyPEM)
+	if err != nil {
+		return fmt.Errorf("Error parsing CA key: %v", err)
+	}
+
+	caCert := certs[0]
+	if !caCert.IsCA || (caCert.KeyUsage != 0 && caCert.KeyUsage&x509.KeyUsageCertSign == 0) {
+		return fmt.Errorf("certificate %s is not allowed to sign certificates", caCert.Subject.CommonName)
+	}
+	if !tlsutil.KeyMatchesCertificate(caKey, caCert) {
+		return fmt.Errorf("CA key does not match certificate %s", caCert.Subject.CommonName)
+	}
+	if time.Now().After(caCert.NotAfter) {
+		return fmt.Errorf("CA certificate %s expired on %s", caCert.Subject.CommonName, caCert.NotAfter.Format(time.RFC3339))
+	}
+	for i := 1; i < len(certs); i++ {
+		if err := certs[i-1].CheckSignatureFrom(certs[i]); err != nil {
+			return fmt.Errorf("certificate %s is not issued by %s, the chain must be ordered from the CA up to the root: %v", certs[i-1].Subject.CommonName, certs[i].Subject.CommonName, err)
+		}
+	}
+
+	tc.CACert.Reset()
+	for _, cert := range certs {
+		if err := tlsutil.WriteCertificatePEMBlock(tc.CACert, cert); err != nil {
+			return err
+		}
+	}
+	tc.CAKey.Reset()
+	return tlsutil.WritePrivateKeyPEMBlock(tc.CAKey, caKey)
+}
+
+// UseExternalCA makes the TLS config generate keys and certificate signing
+// requests for a CA outside of kube-aws to sign, instead of certificates.
+// The signed certificates are brought back with Config.ImportCertificates.
+func (tc *TLSConfig) UseExternalCA() {
+	tc.externalCA = true
+}
+
+// importCertificates reads the CA certificate and the certificates signed
+// by it from dir, in place of the ones kube-aws would have issued. Each
+// must match the private key already held in the TLS config, chain to the
+// CA and carry the SANs and key usages kube-aws would have given it.
+func (tc *TLSConfig) importCertificates(cfg *Config, dir string) error {
+	if err := tc.CACert.ReadFromFile(dir); err != nil {
+		return err
+	}
+	caCerts, err := tlsutil.DecodeCertificatesPEM(tc.CACert.Bytes())
+	if err != nil {
+		return fmt.Errorf("Error parsing %s : %v", tc.CACert.Name, err)
+	}
+	roots := x509.NewCertPool()
+	for _, caCert := range caCerts {
+		roots.AddCert(caCert)
+	}
+
+	for _, leaf := range tc.leafCerts(cfg) {
+		if err := leaf.certBuf.ReadFromFile(dir); err != nil {
+			return err
+		}
+		certs, err := tlsutil.DecodeCertificatesPEM(leaf.certBuf.Bytes())
+		if err != nil {
+			return fmt.Errorf("Error parsing %s : %v", leaf.certBuf.Name, err)
+		}
+		key, err := tlsutil.DecodePrivateKeyPEM(leaf.keyBuf.Bytes())
+		if err != nil {
+			return fmt.Errorf("Error parsing %s : %v", leaf.keyBuf.Name, err)
+		}
+
+		cert := certs[0]
+		if !tlsutil.KeyMatchesCertificate(key, cert) {
+			return fmt.Errorf("%s does not match %s", leaf.certBuf.Name, leaf.keyBuf.Name)
+		}
+		intermediates := x509.NewCertPool()
+		for _, intermediate := range certs[1:] {
+			intermediates.AddCert(intermediate)
+		}
+		//a chain verifies if any one of the requested usages is allowed
+		for _, usage := range leaf.usages {
+			if _, err := cert.Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: intermediates,
+				KeyUsages:     []x509.ExtKeyUsage{usage},
+			}); err != nil {
+				return fmt.Errorf("%s is not valid for its use, signed by %s: %v", leaf.certBuf.Name, tc.CACert.Name, err)
+			}
+		}
+		for _, dnsName := range leaf.dnsNames {
+			if !containsString(cert.DNSNames, dnsName) {
+				return fmt.Errorf("%s lacks DNS SAN %s", leaf.certBuf.Name, dnsName)
+			}
+		}
+		for _, ip := range leaf.ipAddresses {
+			found := false
+			for _, certIP := range cert.IPAddresses {
+				found = found || certIP.Equal(net.ParseIP(ip))
+			}
+			if !found {
+				return fmt.Errorf("%s lacks IP SAN %s", leaf.certBuf.Name, ip)
+			}
+		}
+	}
+
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// readFromFiles reads the TLS assets from dir. The CA key may be missing,
+// as it stays with an external CA, and so may the CRL and the revocation
+// database. Without a service account key, the apiserver's key is used.
+func (tc *TLSConfig) readFromFiles(dir string) error {
+	for _, buf := range tc.buffers {
+		if (buf == tc.CAKey || buf == tc.ServiceAccountKey) && !credentialExists(dir, buf.Name) {
+			buf.Reset()
+			continue
+		}
+		if err := readCredential(dir, buf); err != nil {
+			return err
+		}
+	}
+
+	if tc.ServiceAccountKey.Len() == 0 {
+		if err := tc.serviceAccountKeyFromAPIServerKey(); err != nil {
+			return err
+		}
+	}
+
+	//the worker signer CA only exists with per-node worker certificates,
+	//and its key is only encrypted with KMS by kube-aws up
+	for _, buf := range append(tc.workerSignerBuffers(), tc.WorkerSignerCAKeyCiphertext) {
+		buf.Reset()
+		if !credentialExists(dir, buf.Name) {
+			continue
+		}
+		if err := readCredential(dir, buf); err != nil {
+			return err
+		}
+	}
+
+	//asset directories rendered by older versions lack the CRL
+	tc.CRL.Reset()
+	if _, err := os.Stat(filepath.Join(dir, tc.CRL.Name)); err == nil {
+		if err := tc.CRL.ReadFromFile(dir); err != nil {
+			return err
+		}
+	}
+
+	tc.revoked = nil
+	data, err := ioutil.ReadFile(filepath.Join(dir, revocationDatabase))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading %s : %v", revocationDatabase, err)
+	}
+	if err := yaml.Unmarshal(data, &tc.revoked); err != nil {
+		return fmt.Errorf("Error parsing %s : %v", revocationDatabase, err)
+	}
+	return nil
+}
+
+// writeToFiles writes the TLS assets that were generated to dir, along
+// with any certificate signing requests.
+func (tc *TLSConfig) writeToFiles(dir string) error {
+	generated := blobutil.NamedBufferList{}
+	for _, buf := range append(tc.buffers, tc.workerSignerBuffers()...) {
+		if buf.Len() > 0 {
+			generated = append(generated, buf)
+		}
+	}
+	if err := tc.writeCredentials(dir, generated); err != nil {
 		return err
 	}
-	if err := tlsutil.WriteCertificatePEMBlock(tc.APIServerCert, cert); err != nil {
+	if err := tc.writeRevocationsToFiles(dir); err != nil {
 		return err
 	}
+	return tc.requests.WriteToFiles(dir)
+}
 
+// writeCredentials writes bufs to dir, encrypting the private keys among
+// them if configured to
+func (tc *TLSConfig) writeCredentials(dir string, bufs blobutil.NamedBufferList) error {
+	for _, buf := range bufs {
+		if err := writeCredential(tc.encryption, dir, buf); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (tc *TLSConfig) generateTLSClientAdmin(cfg tlsutil.ClientCertConfig, caCert *x509.Certificate, caKey *rsa.PrivateKey) error {
-	key, err := tlsutil.NewPrivateKey()
+// writeRevocationsToFiles writes the CRL and the revocation database to dir
+func (tc *TLSConfig) writeRevocationsToFiles(dir string) error {
+	if tc.CRL.Len() > 0 {
+		if err := tc.CRL.WriteToFile(dir); err != nil {
+			return err
+		}
+	}
+	if len(tc.revoked) == 0 {
+		return nil
+	}
+
+	data, err := yaml.Marshal(tc.revoked)
 	if err != nil {
 		return err
 	}
+	path := filepath.Join(dir, revocationDatabase)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("Error writing %s : %v", path, err)
+	}
+	return nil
+}
+
+// CertificateStatus describes one of the cluster's certificates and
+// the problems found with it.
+type CertificateStatus struct {
+	Name         string    `json:"name"`
+	Subject      string    `json:"subject"`
+	DNSNames     []string  `json:"dnsNames"`
+	IPAddresses  []string  `json:"ipAddresses"`
+	Issuer       string    `json:"issuer"`
+	SerialNumber string    `json:"serialNumber"`
+	KeyAlgorithm string    `json:"keyAlgorithm"`
+	KeySize      int       `json:"keySize"`
+	NotBefore    time.Time `json:"notBefore"`
+	NotAfter     time.Time `json:"notAfter"`
+	Expiring     bool      `json:"expiring"`
+	Problems     []string  `json:"problems"`
+}
+
+func (s *CertificateStatus) String() string {
+	buf := new(bytes.Buffer)
+	w := new(tabwriter.Writer)
+	w.Init(buf, 0, 8, 0, '\t', 0)
+
+	fmt.Fprintf(w, "%s\n", s.Name)
+	if s.Subject != "" {
+		fmt.Fprintf(w, "  Subject:\t%s\n", s.Subject)
+		if sans := append(append([]string{}, s.DNSNames...), s.IPAddresses...); len(sans) > 0 {
+			fmt.Fprintf(w, "  SANs:\t%s\n", strings.Join(sans, ", "))
+		}
+		fmt.Fprintf(w, "  Issuer:\t%s\n", s.Issuer)
+		fmt.Fprintf(w, "  Serial:\t%s\n", s.SerialNumber)
+		fmt.Fprintf(w, "  Key:\t%s %d\n", s.KeyAlgorithm, s.KeySize)
+		fmt.Fprintf(w, "  Not Before:\t%s\n", s.NotBefore.Format(time.RFC3339))
+		fmt.Fprintf(w, "  Not After:\t%s\n", s.NotAfter.Format(time.RFC3339))
+	}
+	if s.Expiring {
+		fmt.Fprintf(w, "  EXPIRING\n")
+	}
+	for _, problem := range s.Problems {
+		fmt.Fprintf(w, "  PROBLEM:\t%s\n", problem)
+	}
+
+	w.Flush()
+	return buf.String()
+}
+
+// CertificateStatuses inspects every certificate held in the TLS config,
+// flagging those that expire within window, do not chain to the CA or do
+// not match their private key.
+func (tc *TLSConfig) CertificateStatuses(window time.Duration) []*CertificateStatus {
+	all := append(blobutil.NamedBufferList{}, tc.buffers...)
+	if tc.WorkerSignerCACert.Len() > 0 {
+		all = append(all, tc.workerSignerBuffers()...)
+	}
+	buffers := map[string]*blobutil.NamedBuffer{}
+	for _, buf := range all {
+		buffers[buf.Name] = buf
+	}
+
+	roots := x509.NewCertPool()
+	if caCert, err := tc.CACertificate(); err == nil {
+		roots.AddCert(caCert)
+	}
+
+	deadline := time.Now().Add(window)
+	statuses := []*CertificateStatus{}
+	for _, buf := range all {
+		if strings.HasSuffix(buf.Name, "-key.pem") {
+			continue
+		}
+		status := &CertificateStatus{Name: buf.Name}
+		statuses = append(statuses, status)
 
+		cert, err := tlsutil.DecodeCertificatePEM(buf.Bytes())
+		if err != nil {
+			status.Problems = append(status.Problems, err.Error())
+			continue
+		}
+		status.Subject = pkixNameString(cert.Subject)
+		status.DNSNames = cert.DNSNames
+		for _, ip := range cert.IPAddresses {
+			status.IPAddresses = append(status.IPAddresses, ip.String())
+		}
+		status.Issuer = pkixNameString(cert.Issuer)
+		status.SerialNumber = cert.SerialNumber.String()
+		status.KeyAlgorithm, status.KeySize = publicKeyInfo(cert.PublicKey)
+		status.NotBefore = cert.NotBefore
+		status.NotAfter = cert.NotAfter
+		status.Expiring = cert.NotAfter.Before(deadline)
+
+		for _, revoked := range tc.revoked {
+			if revoked.SerialNumber == status.SerialNumber {
+				status.Problems = append(status.Problems, fmt.Sprintf("revoked on %s", revoked.RevokedAt))
+			}
+		}
+
+		if _, err := cert.Verify(x509.VerifyOptions{
+			Roots:     roots,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}); err != nil {
+			status.Problems = append(status.Problems, fmt.Sprintf("does not chain to %s: %v", tc.CACert.Name, err))
+		}
+
+		keyName := strings.TrimSuffix(buf.Name, ".pem") + "-key.pem"
+		keyBuf, ok := buffers[keyName]
+		if !ok || keyBuf.Len() == 0 {
+			continue
+		}
+		key, err := tlsutil.DecodePrivateKeyPEM(keyBuf.Bytes())
+		if err != nil {
+			status.Problems = append(status.Problems, fmt.Sprintf("%s: %v", keyName, err))
+			continue
+		}
+		if !tlsutil.KeyMatchesCertificate(key, cert) {
+			status.Problems = append(status.Problems, fmt.Sprintf("does not match %s", keyName))
+		}
+	}
+
+	return statuses
+}
+
+func pkixNameString(name pkix.Name) string {
+	parts := []string{}
+	if name.CommonName != "" {
+		parts = append(parts, "CN="+name.CommonName)
+	}
+	for _, attr := range []struct {
+		key    string
+		values []string
+	}{
+		{"OU", name.OrganizationalUnit},
+		{"O", name.Organization},
+		{"L", name.Locality},
+		{"ST", name.Province},
+		{"C", name.Country},
+	} {
+		for _, value := range attr.values {
+			parts = append(parts, attr.key+"="+value)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func publicKeyInfo(pub interface{}) (string, int) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return "RSA", pub.N.BitLen()
+	case *ecdsa.PublicKey:
+		return "ECDSA", pub.Curve.Params().BitSize
+	}
+	return "unknown", 0
+}
+
+func (tc *TLSConfig) generateTLSCA(cfg tlsutil.CACertConfig, key crypto.Signer) (*x509.Certificate, error) {
+	cert, err := tlsutil.NewSelfSignedCACertificate(cfg, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tlsutil.WritePrivateKeyPEMBlock(tc.CAKey, key); err != nil {
+		return nil, err
+	}
+	if err := tlsutil.WriteCertificatePEMBlock(tc.CACert, cert); err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+func (tc *TLSConfig) generateTLSServer(cfg tlsutil.ServerCertConfig, key crypto.Signer, caCert *x509.Certificate, caKey crypto.Signer, certBuf, keyBuf *blobutil.NamedBuffer) error {
+	cert, err := tlsutil.NewSignedServerCertificate(cfg, key, caCert, caKey)
+	if err != nil {
+		return err
+	}
+
+	if err := tlsutil.WritePrivateKeyPEMBlock(keyBuf, key); err != nil {
+		return err
+	}
+	if err := tlsutil.WriteCertificatePEMBlock(certBuf, cert); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (tc *TLSConfig) generateTLSClient(cfg tlsutil.ClientCertConfig, key crypto.Signer, caCert *x509.Certificate, caKey crypto.Signer, certBuf, keyBuf *blobutil.NamedBuffer) error {
 	cert, err := tlsutil.NewSignedClientCertificate(cfg, key, caCert, caKey)
 	if err != nil {
 		return err
 	}
 
-	if err := tlsutil.WritePrivateKeyPEMBlock(tc.AdminKey, key); err != nil {
+	if err := tlsutil.WritePrivateKeyPEMBlock(keyBuf, key); err != nil {
 		return err
 	}
-	if err := tlsutil.WriteCertificatePEMBlock(tc.AdminCert, cert); err != nil {
+	if err := tlsutil.WriteCertificatePEMBlock(certBuf, cert); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (tc *TLSConfig) generateTLSClientWorker(cfg tlsutil.ClientCertConfig, caCert *x509.Certificate, caKey *rsa.PrivateKey) error {
-	key, err := tlsutil.NewPrivateKey()
+func (tc *TLSConfig) generateTLSPeer(cfg tlsutil.PeerCertConfig, key crypto.Signer, caCert *x509.Certificate, caKey crypto.Signer, certBuf, keyBuf *blobutil.NamedBuffer) error {
+	cert, err := tlsutil.NewSignedPeerCertificate(cfg, key, caCert, caKey)
 	if err != nil {
 		return err
 	}
 
-	cert, err := tlsutil.NewSignedClientCertificate(cfg, key, caCert, caKey)
+	if err := tlsutil.WritePrivateKeyPEMBlock(keyBuf, key); err != nil {
+		return err
+	}
+	if err := tlsutil.WriteCertificatePEMBlock(certBuf, cert); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (tc *TLSConfig) generateTLSRequest(leaf leafCert, key crypto.Signer, subject tlsutil.Subject) error {
+	csr, err := tlsutil.NewCertificateRequest(tlsutil.CertificateRequestConfig{
+		CommonName:  leaf.commonName,
+		Subject:     subject,
+		DNSNames:    leaf.dnsNames,
+		IPAddresses: leaf.ipAddresses,
+	}, key)
 	if err != nil {
 		return err
 	}
 
-	if err := tlsutil.WritePrivateKeyPEMBlock(tc.WorkerKey, key); err != nil {
+	csrBuf := &blobutil.NamedBuffer{Name: strings.TrimSuffix(leaf.certBuf.Name, ".pem") + ".csr"}
+	if err := tlsutil.WritePrivateKeyPEMBlock(leaf.keyBuf, key); err != nil {
 		return err
 	}
-	if err := tlsutil.WriteCertificatePEMBlock(tc.WorkerCert, cert); err != nil {
+	if err := tlsutil.WriteCertificateRequestPEMBlock(csrBuf, csr); err != nil {
 		return err
 	}
+	tc.requests = append(tc.requests, csrBuf)
 
 	return nil
 }
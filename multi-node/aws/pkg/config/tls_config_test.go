@@ -3,15 +3,27 @@ package config
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"compress/gzip"
-	"crypto/rsa"
+	"crypto"
+	"crypto/rand"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/pem"
+	"math/big"
+
+	"github.com/aws/aws-sdk-go/service/kms"
 
 	"github.com/coreos/coreos-kubernetes/multi-node/aws/pkg/blobutil"
+	"github.com/coreos/coreos-kubernetes/multi-node/aws/pkg/tlsutil"
 )
 
 func genTLSConfig(t *testing.T) *TLSConfig {
@@ -71,7 +83,7 @@ func TestTLSGeneration(t *testing.T) {
 	pairs := []*struct {
 		KeyBuffer  *blobutil.NamedBuffer
 		CertBuffer *blobutil.NamedBuffer
-		Key        *rsa.PrivateKey
+		Key        interface{}
 		Cert       *x509.Certificate
 	}{
 		//CA MUST come first
@@ -91,6 +103,18 @@ func TestTLSGeneration(t *testing.T) {
 			KeyBuffer:  tlsConfig.WorkerKey,
 			CertBuffer: tlsConfig.WorkerCert,
 		},
+		{
+			KeyBuffer:  tlsConfig.EtcdKey,
+			CertBuffer: tlsConfig.EtcdCert,
+		},
+		{
+			KeyBuffer:  tlsConfig.EtcdPeerKey,
+			CertBuffer: tlsConfig.EtcdPeerCert,
+		},
+		{
+			KeyBuffer:  tlsConfig.EtcdClientKey,
+			CertBuffer: tlsConfig.EtcdClientCert,
+		},
 	}
 
 	var err error
@@ -131,3 +155,938 @@ func TestTLSGeneration(t *testing.T) {
 		}
 	}
 }
+
+func TestEtcdTLSGeneration(t *testing.T) {
+	tlsConfig := genTLSConfig(t)
+
+	caBlock, _ := pem.Decode(tlsConfig.CACert.Bytes())
+	if caBlock == nil {
+		t.Fatalf("Failed decoding pem block from %s", tlsConfig.CACert.Name)
+	}
+	caCert, err := x509.ParseCertificate(caBlock.Bytes)
+	if err != nil {
+		t.Fatalf("Failed to parse cert %s: %v", tlsConfig.CACert.Name, err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	for _, check := range []struct {
+		CertBuffer *blobutil.NamedBuffer
+		IP         string
+		Usages     []x509.ExtKeyUsage
+	}{
+		{tlsConfig.EtcdCert, "10.0.0.50", []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}},
+		{tlsConfig.EtcdCert, "127.0.0.1", []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}},
+		{tlsConfig.EtcdPeerCert, "10.0.0.50", []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}},
+		{tlsConfig.EtcdPeerCert, "10.0.0.50", []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}},
+		{tlsConfig.EtcdClientCert, "", []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}},
+	} {
+		certBlock, _ := pem.Decode(check.CertBuffer.Bytes())
+		if certBlock == nil {
+			t.Errorf("Failed decoding pem block from %s", check.CertBuffer.Name)
+			continue
+		}
+		cert, err := x509.ParseCertificate(certBlock.Bytes)
+		if err != nil {
+			t.Errorf("Failed to parse cert %s: %v", check.CertBuffer.Name, err)
+			continue
+		}
+		opts := x509.VerifyOptions{
+			DNSName:   check.IP,
+			Roots:     roots,
+			KeyUsages: check.Usages,
+		}
+		if _, err := cert.Verify(opts); err != nil {
+			t.Errorf("Could not verify %s for %s %v: %v", check.CertBuffer.Name, check.IP, check.Usages, err)
+		}
+	}
+}
+
+func TestTLSRotation(t *testing.T) {
+	config, err := newConfigFromBytes([]byte(MinimalConfigYaml))
+	if err != nil {
+		t.Fatalf("failed generating config: %v", err)
+	}
+	tlsConfig := genTLSConfig(t)
+
+	caBytes := append([]byte{}, tlsConfig.CACert.Bytes()...)
+	caKeyBytes := append([]byte{}, tlsConfig.CAKey.Bytes()...)
+	leafBytes := map[string][]byte{}
+	for _, buffer := range tlsConfig.leafBuffers() {
+		leafBytes[buffer.Name] = append([]byte{}, buffer.Bytes()...)
+	}
+
+	if err := tlsConfig.rotateLeafTLS(config, false); err != nil {
+		t.Fatalf("failed rotating tls: %v", err)
+	}
+
+	if !bytes.Equal(caBytes, tlsConfig.CACert.Bytes()) || !bytes.Equal(caKeyBytes, tlsConfig.CAKey.Bytes()) {
+		t.Errorf("CA changed during rotation")
+	}
+
+	caCert, err := tlsConfig.CACertificate()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	for _, buffer := range tlsConfig.leafBuffers() {
+		isKey := strings.HasSuffix(buffer.Name, "-key.pem")
+		if bytes.Equal(leafBytes[buffer.Name], buffer.Bytes()) != isKey {
+			t.Errorf("%s was not re-issued, or its key was replaced", buffer.Name)
+		}
+		if n := bytes.Count(buffer.Bytes(), []byte("-----BEGIN")); n != 1 {
+			t.Errorf("expected a single PEM block in %s, found %d", buffer.Name, n)
+		}
+	}
+
+	cert, err := tlsutil.DecodeCertificatePEM(tlsConfig.APIServerCert.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to parse cert %s: %v", tlsConfig.APIServerCert.Name, err)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{DNSName: config.ExternalDNSName, Roots: roots}); err != nil {
+		t.Errorf("Could not verify rotated %s: %v", tlsConfig.APIServerCert.Name, err)
+	}
+	key, err := tlsutil.DecodePrivateKeyPEM(tlsConfig.APIServerKey.Bytes())
+	if err != nil || !tlsutil.KeyMatchesCertificate(key, cert) {
+		t.Errorf("rotated %s does not match %s: %v", tlsConfig.APIServerCert.Name, tlsConfig.APIServerKey.Name, err)
+	}
+
+	serviceAccountKey := append([]byte{}, tlsConfig.ServiceAccountKey.Bytes()...)
+	if err := tlsConfig.rotateLeafTLS(config, true); err != nil {
+		t.Fatalf("failed rotating tls with new keys: %v", err)
+	}
+	for _, buffer := range tlsConfig.leafBuffers() {
+		if bytes.Equal(leafBytes[buffer.Name], buffer.Bytes()) {
+			t.Errorf("%s was not replaced", buffer.Name)
+		}
+	}
+	if !bytes.Equal(serviceAccountKey, tlsConfig.ServiceAccountKey.Bytes()) {
+		t.Errorf("%s was replaced", tlsConfig.ServiceAccountKey.Name)
+	}
+
+	//a CA key not matching the CA certificate must be rejected
+	otherTLSConfig := genTLSConfig(t)
+	tlsConfig.CAKey = otherTLSConfig.CAKey
+	if err := tlsConfig.rotateLeafTLS(config, false); err == nil {
+		t.Errorf("rotation succeeded with a mismatched CA key")
+	}
+}
+
+func TestRotateTLSAssets(t *testing.T) {
+	config, err := newConfigFromBytes([]byte(MinimalConfigYaml))
+	if err != nil {
+		t.Fatalf("failed generating config: %v", err)
+	}
+	if err := config.TLSConfig.generateAllTLS(config); err != nil {
+		t.Fatalf("failed generating tls: %v", err)
+	}
+
+	//credentials are written relative to the asset directory
+	dir, err := ioutil.TempDir("", "kube-aws-rotation")
+	if err != nil {
+		t.Fatalf("failed creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Mkdir(credentialsDir, 0700); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := config.TLSConfig.writeToFiles(credentialsDir); err != nil {
+		t.Fatalf("failed writing tls assets: %v", err)
+	}
+
+	read := func() map[string][]byte {
+		files := map[string][]byte{}
+		for _, buf := range config.TLSConfig.buffers {
+			data, err := ioutil.ReadFile(filepath.Join(credentialsDir, buf.Name))
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			files[buf.Name] = data
+		}
+		return files
+	}
+	before := read()
+
+	//asset directories rendered by older versions lack a service account
+	//key, as tokens are signed with the apiserver's key, which must go on
+	//signing them after the apiserver is given a new one
+	if err := os.Remove(filepath.Join(credentialsDir, "service-account-key.pem")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	before["service-account-key.pem"] = before["apiserver-key.pem"]
+
+	for _, newKeys := range []bool{false, true} {
+		if err := config.TLSConfig.readFromFiles(credentialsDir); err != nil {
+			t.Fatalf("failed reading tls assets: %v", err)
+		}
+		if err := config.RotateTLSAssets(newKeys); err != nil {
+			t.Fatalf("failed rotating tls assets: %v", err)
+		}
+		after := read()
+
+		for name, data := range after {
+			isKey := strings.HasSuffix(name, "-key.pem")
+			changed := !bytes.Equal(before[name], data)
+			switch {
+			case name == "ca.pem" || name == "ca-key.pem" || name == "service-account-key.pem":
+				if changed {
+					t.Errorf("%s changed in rotating the certificates (new keys: %v)", name, newKeys)
+				}
+			case isKey && changed != newKeys:
+				t.Errorf("%s changed: %v, expected: %v", name, changed, newKeys)
+			case !isKey && !changed:
+				t.Errorf("%s was not re-issued (new keys: %v)", name, newKeys)
+			}
+		}
+		before = after
+	}
+}
+
+func TestCertificateStatuses(t *testing.T) {
+	tlsConfig := genTLSConfig(t)
+
+	statuses := tlsConfig.CertificateStatuses(0)
+	if len(statuses) != len(tlsConfig.buffers)/2 {
+		t.Fatalf("expected %d certificates, got %d", len(tlsConfig.buffers)/2, len(statuses))
+	}
+	for _, status := range statuses {
+		if status.Expiring || len(status.Problems) > 0 {
+			t.Errorf("unexpected status for fresh certificate:\n%s", status)
+		}
+		if status.KeyAlgorithm != "RSA" || status.KeySize != 2048 {
+			t.Errorf("unexpected key %s %d for %s", status.KeyAlgorithm, status.KeySize, status.Name)
+		}
+	}
+
+	//leaf certificates expire before the CA
+	for _, status := range tlsConfig.CertificateStatuses(tlsutil.Duration90d + time.Hour) {
+		if expected := status.Name != tlsConfig.CACert.Name; status.Expiring != expected {
+			t.Errorf("expected %s expiring to be %t", status.Name, expected)
+		}
+	}
+
+	//swap in a key and a CA from another cluster
+	otherTLSConfig := genTLSConfig(t)
+	tlsConfig.AdminKey.Reset()
+	tlsConfig.AdminKey.Write(otherTLSConfig.AdminKey.Bytes())
+	tlsConfig.CACert.Reset()
+	tlsConfig.CACert.Write(otherTLSConfig.CACert.Bytes())
+	for _, status := range tlsConfig.CertificateStatuses(0) {
+		//the CA no longer matches its key, and no leaf chains to it
+		expected := 1
+		if status.Name == tlsConfig.AdminCert.Name {
+			expected = 2
+		}
+		if len(status.Problems) != expected {
+			t.Errorf("expected %d problems for %s, got %v", expected, status.Name, status.Problems)
+		}
+	}
+}
+
+func TestImportCA(t *testing.T) {
+	config, err := newConfigFromBytes([]byte(MinimalConfigYaml))
+	if err != nil {
+		t.Fatalf("failed generating config: %v", err)
+	}
+
+	rootKey, err := tlsutil.NewPrivateKey(tlsutil.DefaultKeyAlgorithm)
+	if err != nil {
+		t.Fatalf("failed generating key: %v", err)
+	}
+	rootCert, err := tlsutil.NewSelfSignedCACertificate(tlsutil.CACertConfig{CommonName: "org-root", Subject: tlsutil.Subject{Organization: "org"}}, rootKey)
+	if err != nil {
+		t.Fatalf("failed generating root: %v", err)
+	}
+
+	intermediateKey, err := tlsutil.NewPrivateKey(tlsutil.DefaultKeyAlgorithm)
+	if err != nil {
+		t.Fatalf("failed generating key: %v", err)
+	}
+	intermediateTmpl := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "org-kubernetes", Organization: []string{"org"}},
+		NotBefore:             rootCert.NotBefore,
+		NotAfter:              rootCert.NotAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	intermediateDER, err := x509.CreateCertificate(rand.Reader, &intermediateTmpl, rootCert, intermediateKey.Public(), rootKey)
+	if err != nil {
+		t.Fatalf("failed generating intermediate: %v", err)
+	}
+	intermediateCert, err := x509.ParseCertificate(intermediateDER)
+	if err != nil {
+		t.Fatalf("failed parsing intermediate: %v", err)
+	}
+
+	pemBytes := func(certs ...*x509.Certificate) []byte {
+		buf := &bytes.Buffer{}
+		for _, cert := range certs {
+			tlsutil.WriteCertificatePEMBlock(buf, cert)
+		}
+		return buf.Bytes()
+	}
+	keyBytes := func(key crypto.Signer) []byte {
+		buf := &bytes.Buffer{}
+		tlsutil.WritePrivateKeyPEMBlock(buf, key)
+		return buf.Bytes()
+	}
+
+	tlsConfig := newTLSConfig()
+	if err := tlsConfig.ImportCA(pemBytes(intermediateCert, rootCert), keyBytes(intermediateKey)); err != nil {
+		t.Fatalf("failed importing CA: %v", err)
+	}
+	if err := tlsConfig.generateAllTLS(config); err != nil {
+		t.Fatalf("failed generating tls: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(rootCert)
+	certs, err := tlsutil.DecodeCertificatesPEM(tlsConfig.APIServerCert.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to parse %s: %v", tlsConfig.APIServerCert.Name, err)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       config.ExternalDNSName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	}); err != nil {
+		t.Errorf("Could not verify %s against the root: %v", tlsConfig.APIServerCert.Name, err)
+	}
+	for _, status := range tlsConfig.CertificateStatuses(0) {
+		if len(status.Problems) > 0 {
+			t.Errorf("unexpected problems for %s: %v", status.Name, status.Problems)
+		}
+	}
+
+	for _, bad := range []struct {
+		CertPEM, KeyPEM []byte
+	}{
+		{pemBytes(intermediateCert), keyBytes(rootKey)},
+		{pemBytes(rootCert, intermediateCert), keyBytes(rootKey)},
+		{pemBytes(certs[0]), tlsConfig.APIServerKey.Bytes()},
+	} {
+		if err := newTLSConfig().ImportCA(bad.CertPEM, bad.KeyPEM); err == nil {
+			t.Errorf("Invalid CA imported without error:\n%s", bad.CertPEM)
+		}
+	}
+}
+
+func TestExternalCA(t *testing.T) {
+	config, err := newConfigFromBytes([]byte(MinimalConfigYaml))
+	if err != nil {
+		t.Fatalf("failed generating config: %v", err)
+	}
+
+	tlsConfig := newTLSConfig()
+	tlsConfig.UseExternalCA()
+	if err := tlsConfig.generateAllTLS(config); err != nil {
+		t.Fatalf("failed generating tls: %v", err)
+	}
+	leaves := tlsConfig.leafCerts(config)
+	if len(tlsConfig.requests) != len(leaves) {
+		t.Fatalf("expected %d certificate signing requests, got %d", len(leaves), len(tlsConfig.requests))
+	}
+	if tlsConfig.CACert.Len() > 0 || tlsConfig.CAKey.Len() > 0 || tlsConfig.APIServerCert.Len() > 0 {
+		t.Errorf("certificates generated along with certificate signing requests")
+	}
+
+	caKey, err := tlsutil.NewPrivateKey(tlsutil.DefaultKeyAlgorithm)
+	if err != nil {
+		t.Fatalf("failed generating key: %v", err)
+	}
+	caCert, err := tlsutil.NewSelfSignedCACertificate(tlsutil.CACertConfig{CommonName: "external-ca", Subject: tlsutil.Subject{Organization: "org"}}, caKey)
+	if err != nil {
+		t.Fatalf("failed generating CA: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "kube-aws-certs")
+	if err != nil {
+		t.Fatalf("failed creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	//sign drops the DNS SANs of the request named dropSANs, and signs the
+	//request named clientOnly for client authentication only
+	sign := func(dropSANs, clientOnly string) {
+		caBuf := &blobutil.NamedBuffer{Name: "ca.pem"}
+		tlsutil.WriteCertificatePEMBlock(caBuf, caCert)
+		if err := caBuf.WriteToFile(dir); err != nil {
+			t.Fatalf("%v", err)
+		}
+		for i, request := range tlsConfig.requests {
+			block, _ := pem.Decode(request.Bytes())
+			csr, err := x509.ParseCertificateRequest(block.Bytes)
+			if err != nil {
+				t.Fatalf("Failed to parse %s: %v", request.Name, err)
+			}
+			tmpl := x509.Certificate{
+				SerialNumber: big.NewInt(int64(i + 1)),
+				Subject:      csr.Subject,
+				DNSNames:     csr.DNSNames,
+				IPAddresses:  csr.IPAddresses,
+				NotBefore:    caCert.NotBefore,
+				NotAfter:     caCert.NotAfter,
+				KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+				ExtKeyUsage:  leaves[i].usages,
+			}
+			if request.Name == dropSANs {
+				tmpl.DNSNames = nil
+			}
+			if request.Name == clientOnly {
+				tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+			}
+			certDER, err := x509.CreateCertificate(rand.Reader, &tmpl, caCert, csr.PublicKey, caKey)
+			if err != nil {
+				t.Fatalf("Failed signing %s: %v", request.Name, err)
+			}
+			cert, _ := x509.ParseCertificate(certDER)
+			certBuf := &blobutil.NamedBuffer{Name: leaves[i].certBuf.Name}
+			tlsutil.WriteCertificatePEMBlock(certBuf, cert)
+			if err := certBuf.WriteToFile(dir); err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+	}
+
+	sign("", "")
+	if err := tlsConfig.importCertificates(config, dir); err != nil {
+		t.Fatalf("failed importing certificates: %v", err)
+	}
+	for _, status := range tlsConfig.CertificateStatuses(0) {
+		if len(status.Problems) > 0 {
+			t.Errorf("unexpected problems for %s: %v", status.Name, status.Problems)
+		}
+	}
+
+	for _, bad := range [][2]string{
+		{"apiserver.csr", ""},
+		{"", "etcd-peer.csr"},
+	} {
+		sign(bad[0], bad[1])
+		if err := tlsConfig.importCertificates(config, dir); err == nil {
+			t.Errorf("Invalid certificates imported without error: %v", bad)
+		}
+	}
+}
+
+func TestTLSKeyAlgorithms(t *testing.T) {
+	for _, tc := range []struct {
+		Algorithm    string
+		KeyAlgorithm string
+		KeySize      int
+		PEMType      string
+	}{
+		{tlsutil.KeyAlgorithmRSA3072, "RSA", 3072, "RSA PRIVATE KEY"},
+		{tlsutil.KeyAlgorithmECDSAP256, "ECDSA", 256, "EC PRIVATE KEY"},
+		{tlsutil.KeyAlgorithmECDSAP384, "ECDSA", 384, "EC PRIVATE KEY"},
+	} {
+		config, err := newConfigFromBytes([]byte(MinimalConfigYaml + "tls:\n  keyAlgorithm: " + tc.Algorithm + "\n"))
+		if err != nil {
+			t.Fatalf("failed generating config: %v", err)
+		}
+		tlsConfig := newTLSConfig()
+		if err := tlsConfig.generateAllTLS(config); err != nil {
+			t.Fatalf("failed generating %s tls: %v", tc.Algorithm, err)
+		}
+
+		for _, buf := range tlsConfig.buffers {
+			pemType := tc.PEMType
+			if buf == tlsConfig.ServiceAccountKey {
+				pemType = "RSA PRIVATE KEY"
+			}
+			if strings.HasSuffix(buf.Name, "-key.pem") && !bytes.HasPrefix(buf.Bytes(), []byte("-----BEGIN "+pemType+"-----")) {
+				t.Errorf("%s key %s is not a %s", tc.Algorithm, buf.Name, pemType)
+			}
+		}
+		for _, status := range tlsConfig.CertificateStatuses(0) {
+			if status.KeyAlgorithm != tc.KeyAlgorithm || status.KeySize != tc.KeySize {
+				t.Errorf("expected %s %d key for %s, got %s %d", tc.KeyAlgorithm, tc.KeySize, status.Name, status.KeyAlgorithm, status.KeySize)
+			}
+			if len(status.Problems) > 0 {
+				t.Errorf("unexpected problems for %s %s: %v", tc.Algorithm, status.Name, status.Problems)
+			}
+		}
+	}
+
+	if _, err := newConfigFromBytes([]byte(MinimalConfigYaml + "tls:\n  keyAlgorithm: dsa-1024\n")); err == nil {
+		t.Errorf("unknown tls.keyAlgorithm tested valid")
+	}
+}
+
+func TestServiceAccountKey(t *testing.T) {
+	tlsConfig := genTLSConfig(t)
+	if bytes.Equal(tlsConfig.ServiceAccountKey.Bytes(), tlsConfig.APIServerKey.Bytes()) {
+		t.Errorf("%s is the apiserver's key", tlsConfig.ServiceAccountKey.Name)
+	}
+
+	dir, err := ioutil.TempDir("", "kube-aws-service-account")
+	if err != nil {
+		t.Fatalf("failed creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := tlsConfig.writeToFiles(dir); err != nil {
+		t.Fatalf("failed writing tls assets: %v", err)
+	}
+
+	readConfig := newTLSConfig()
+	if err := readConfig.readFromFiles(dir); err != nil {
+		t.Fatalf("failed reading tls assets: %v", err)
+	}
+	if !bytes.Equal(readConfig.ServiceAccountKey.Bytes(), tlsConfig.ServiceAccountKey.Bytes()) {
+		t.Errorf("%s changed in writing it out", tlsConfig.ServiceAccountKey.Name)
+	}
+
+	//asset directories rendered by older versions signed service account
+	//tokens with the apiserver's key, which must keep signing them
+	if err := os.Remove(filepath.Join(dir, tlsConfig.ServiceAccountKey.Name)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	readConfig = newTLSConfig()
+	if err := readConfig.readFromFiles(dir); err != nil {
+		t.Fatalf("failed reading tls assets without %s: %v", tlsConfig.ServiceAccountKey.Name, err)
+	}
+	if !bytes.Equal(readConfig.ServiceAccountKey.Bytes(), tlsConfig.APIServerKey.Bytes()) {
+		t.Errorf("expected %s to fall back to %s", tlsConfig.ServiceAccountKey.Name, tlsConfig.APIServerKey.Name)
+	}
+}
+
+func TestTLSSettings(t *testing.T) {
+	config, err := newConfigFromBytes([]byte(MinimalConfigYaml + `
+tls:
+  caValidityDays: 730
+  validityDays: 30
+  caCommonName: example-kube-ca
+  subject:
+    organization: Example
+    organizationalUnit: Platform
+    country: US
+  apiServerDNSNames:
+    - kube-internal.example.com
+  apiServerIPs:
+    - 10.0.0.10
+`))
+	if err != nil {
+		t.Fatalf("Correct config tested invalid: %s", err)
+	}
+	if config.TLS.KeyAlgorithm != tlsutil.DefaultKeyAlgorithm {
+		t.Errorf("expected default key algorithm, got %q", config.TLS.KeyAlgorithm)
+	}
+
+	tlsConfig := newTLSConfig()
+	if err := tlsConfig.generateAllTLS(config); err != nil {
+		t.Fatalf("failed generating tls: %v", err)
+	}
+
+	caCert, err := tlsConfig.CACertificate()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if caCert.Subject.CommonName != "example-kube-ca" || len(caCert.Subject.OrganizationalUnit) != 1 {
+		t.Errorf("unexpected CA subject %v", caCert.Subject)
+	}
+	if validity := caCert.NotAfter.Sub(caCert.NotBefore); validity != 730*24*time.Hour {
+		t.Errorf("expected CA valid for 730 days, got %s", validity)
+	}
+
+	cert, err := tlsutil.DecodeCertificatePEM(tlsConfig.APIServerCert.Bytes())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if cert.Subject.Country[0] != "US" || cert.Subject.Organization[0] != "Example" {
+		t.Errorf("apiserver certificate did not inherit the CA subject: %v", cert.Subject)
+	}
+	if remaining := cert.NotAfter.Sub(time.Now()); remaining > 30*24*time.Hour || remaining < 29*24*time.Hour {
+		t.Errorf("expected apiserver certificate valid for 30 days, %s remain", remaining)
+	}
+	for _, name := range []string{"kube-internal.example.com", "10.0.0.10", config.ExternalDNSName} {
+		if err := cert.VerifyHostname(name); err != nil {
+			t.Errorf("apiserver certificate not valid for %s: %v", name, err)
+		}
+	}
+
+	for _, tlsConfig := range []string{
+		"tls:\n  validityDays: 0\n",
+		"tls:\n  validityDays: 400\n",
+		"tls:\n  userValidityDays: -1\n",
+		"tls:\n  userValidityDays: 400\n",
+		"tls:\n  caCommonName: \"\"\n",
+		"tls:\n  apiServerIPs:\n    - bastion.example.com\n",
+	} {
+		if _, err := newConfigFromBytes([]byte(MinimalConfigYaml + tlsConfig)); err == nil {
+			t.Errorf("Incorrect config tested valid, expected error:\n%s", tlsConfig)
+		}
+	}
+}
+
+// fakeKMS stands in for KMS, recording what it was asked to encrypt
+type fakeKMS struct {
+	inputs []*kms.EncryptInput
+}
+
+func (svc *fakeKMS) Encrypt(input *kms.EncryptInput) (*kms.EncryptOutput, error) {
+	svc.inputs = append(svc.inputs, input)
+	return &kms.EncryptOutput{CiphertextBlob: []byte("kms-ciphertext")}, nil
+}
+
+const testKMSKeyARN = "arn:aws:kms:us-west-1:123456789012:key/12345678-1234-1234-1234-123456789012"
+
+func TestPerNodeWorkerCertificates(t *testing.T) {
+	identityKey, err := tlsutil.NewPrivateKey(tlsutil.DefaultKeyAlgorithm)
+	if err != nil {
+		t.Fatalf("failed generating key: %v", err)
+	}
+	identityCert, err := tlsutil.NewSelfSignedCACertificate(tlsutil.CACertConfig{CommonName: "instance-identity"}, identityKey)
+	if err != nil {
+		t.Fatalf("failed generating certificate: %v", err)
+	}
+	identityBuf := &bytes.Buffer{}
+	if err := tlsutil.WriteCertificatePEMBlock(identityBuf, identityCert); err != nil {
+		t.Fatalf("%v", err)
+	}
+	identityConfig := "tls:\n  perNodeWorkerCertificates: true\n  instanceIdentityCertificate: |\n    " +
+		strings.Replace(strings.TrimSpace(identityBuf.String()), "\n", "\n    ", -1) + "\n"
+
+	config, err := newConfigFromBytes([]byte(MinimalConfigYaml + identityConfig + "  kmsKeyARN: " + testKMSKeyARN + "\n"))
+	if err != nil {
+		t.Fatalf("Correct config tested invalid: %s", err)
+	}
+	if err := config.GenerateDefaultAssets(); err != nil {
+		t.Fatalf("failed generating assets: %v", err)
+	}
+	if err := config.TemplateAndEncodeAssets(); err == nil {
+		t.Errorf("assets templated before the worker signer key was encrypted")
+	}
+
+	//the worker signer CA may only sign certificates for workers
+	tc := config.TLSConfig
+	caCert, err := tc.CACertificate()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	signerCert, err := tlsutil.DecodeCertificatePEM(tc.WorkerSignerCACert.Bytes())
+	if err != nil {
+		t.Fatalf("failed parsing %s: %v", tc.WorkerSignerCACert.Name, err)
+	}
+	if err := signerCert.CheckSignatureFrom(caCert); err != nil {
+		t.Errorf("worker signer CA not signed by the CA: %v", err)
+	}
+	if !signerCert.IsCA || !signerCert.MaxPathLenZero || len(signerCert.ExtKeyUsage) != 2 ||
+		len(signerCert.PermittedDNSDomains) != 1 || signerCert.PermittedDNSDomains[0] != "us-west-1.compute.internal" ||
+		len(signerCert.PermittedIPRanges) != 1 || signerCert.PermittedIPRanges[0].String() != config.VPCCIDR {
+		t.Errorf("worker signer CA is not constrained to workers: %+v", signerCert)
+	}
+	if !strings.HasSuffix(tc.WorkerSignerCACert.String(), tc.CACert.String()) {
+		t.Errorf("%s does not carry the chain to the CA", tc.WorkerSignerCACert.Name)
+	}
+	signerKey, err := tlsutil.DecodePrivateKeyPEM(tc.WorkerSignerCAKey.Bytes())
+	if err != nil {
+		t.Fatalf("failed parsing %s: %v", tc.WorkerSignerCAKey.Name, err)
+	}
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(signerCert)
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	for _, dnsName := range []string{"ip-10-0-0-100.us-west-1.compute.internal", "kube-aws.example.com"} {
+		leafKey, err := tlsutil.NewPrivateKey(tlsutil.DefaultKeyAlgorithm)
+		if err != nil {
+			t.Fatalf("failed generating key: %v", err)
+		}
+		leaf, err := tlsutil.NewSignedServerCertificate(tlsutil.ServerCertConfig{CommonName: dnsName, DNSNames: []string{dnsName}}, leafKey, signerCert, signerKey)
+		if err != nil {
+			t.Fatalf("failed signing %s: %v", dnsName, err)
+		}
+		_, err = leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, DNSName: dnsName})
+		if valid := strings.HasSuffix(dnsName, ".compute.internal"); valid != (err == nil) {
+			t.Errorf("certificate for %s signed by the worker signer CA: valid %t, got %v", dnsName, valid, err)
+		}
+	}
+
+	//its key is encrypted into the credentials directory, once
+	dir, err := ioutil.TempDir("", "kube-aws-worker-signer")
+	if err != nil {
+		t.Fatalf("failed creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Mkdir(credentialsDir, 0700); err != nil {
+		t.Fatalf("%v", err)
+	}
+	svc := &fakeKMS{}
+	for i := 0; i < 2; i++ {
+		if err := config.EncryptWorkerSignerKey(svc); err != nil {
+			t.Fatalf("failed encrypting worker signer key: %v", err)
+		}
+	}
+	if len(svc.inputs) != 1 {
+		t.Fatalf("worker signer key encrypted %d times", len(svc.inputs))
+	}
+	input := svc.inputs[0]
+	if *input.KeyId != testKMSKeyARN || *input.EncryptionContext["KubernetesCluster"] != config.ClusterName ||
+		!bytes.Equal(input.Plaintext, tc.WorkerSignerCAKey.Bytes()) {
+		t.Errorf("unexpected KMS encryption request %+v", input)
+	}
+	ciphertextPath := filepath.Join(credentialsDir, tc.WorkerSignerCAKeyCiphertext.Name)
+	if ciphertext, err := ioutil.ReadFile(ciphertextPath); err != nil || string(ciphertext) != "kms-ciphertext" {
+		t.Errorf("ciphertext not written to %s: %q %v", ciphertextPath, ciphertext, err)
+	}
+
+	//rotating keeps the key, and its ciphertext, unless asked for new keys
+	key := tc.WorkerSignerCAKey.String()
+	if err := config.RotateTLSAssets(false); err != nil {
+		t.Fatalf("failed rotating certificates: %v", err)
+	}
+	if _, err := os.Stat(ciphertextPath); err != nil || tc.WorkerSignerCAKey.String() != key || tc.WorkerSignerCAKeyCiphertext.Len() == 0 {
+		t.Errorf("rotating the certificates replaced the worker signer key: %v", err)
+	}
+	if err := config.RotateTLSAssets(true); err != nil {
+		t.Fatalf("failed rotating keys: %v", err)
+	}
+	if _, err := os.Stat(ciphertextPath); !os.IsNotExist(err) || tc.WorkerSignerCAKey.String() == key || tc.WorkerSignerCAKeyCiphertext.Len() != 0 {
+		t.Errorf("rotating the keys kept the ciphertext of the previous worker signer key: %v", err)
+	}
+	if err := config.EncryptWorkerSignerKey(svc); err != nil || len(svc.inputs) != 2 {
+		t.Fatalf("new worker signer key not encrypted: %v", err)
+	}
+
+	if err := config.TemplateAndEncodeAssets(); err != nil {
+		t.Fatalf("failed templating assets: %v", err)
+	}
+
+	decode := func(buf *blobutil.NamedBuffer) string {
+		gzipReader, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(buf.Bytes())))
+		if err != nil {
+			t.Fatalf("Failed creating gzip decoder %s: %v", buf.Name, err)
+		}
+		defer gzipReader.Close()
+		decoded, err := ioutil.ReadAll(gzipReader)
+		if err != nil {
+			t.Fatalf("Failed decoding gzip %s : %v", buf.Name, err)
+		}
+		return string(decoded)
+	}
+	//the TLS assets are embedded in the cloud-configs encoded
+	if strings.Contains(decode(config.WorkerPools[0].UserData), tc.WorkerKey.String()) {
+		t.Errorf("worker cloud-config carries the shared worker key")
+	}
+	controller := decode(config.UserData.Controller)
+	if strings.Contains(controller, tc.CAKey.String()) || strings.Contains(controller, tc.WorkerSignerCAKey.String()) {
+		t.Errorf("controller cloud-config carries a CA key")
+	}
+	if !strings.Contains(controller, tc.WorkerSignerCAKeyCiphertext.String()) {
+		t.Errorf("controller cloud-config lacks the encrypted worker signer key")
+	}
+	if !strings.Contains(config.StackTemplate.String(), "SecurityGroupControllerIngressFromWorkerToWorkerSigner") {
+		t.Errorf("workers are not allowed to reach the signer")
+	}
+	if !strings.Contains(config.StackTemplate.String(), `"Resource": "`+testKMSKeyARN+`"`) {
+		t.Errorf("controllers are not allowed to decrypt the worker signer key")
+	}
+
+	if subject := (TLSSubject{Organization: "kube/aws", Country: "US"}).OpenSSLSubject("node"); subject != `/C=US/O=kube\/aws/CN=node` {
+		t.Errorf("unexpected openssl subject %s", subject)
+	}
+
+	tlsConfig := newTLSConfig()
+	tlsConfig.UseExternalCA()
+	if err := tlsConfig.generateAllTLS(config); err == nil {
+		t.Errorf("per-node worker certificates allowed with an external CA")
+	}
+
+	for _, tlsConfig := range []string{
+		"tls:\n  perNodeWorkerCertificates: true\n  kmsKeyARN: " + testKMSKeyARN + "\n",
+		"tls:\n  perNodeWorkerCertificates: true\n  instanceIdentityCertificate: not-a-certificate\n  kmsKeyARN: " + testKMSKeyARN + "\n",
+		identityConfig,
+		identityConfig + "  kmsKeyARN: arn:aws:kms:us-west-1:123456789012:alias/kube-aws\n",
+	} {
+		if _, err := newConfigFromBytes([]byte(MinimalConfigYaml + tlsConfig)); err == nil {
+			t.Errorf("Incorrect config tested valid, expected error:\n%s", tlsConfig)
+		}
+	}
+}
+
+func TestCertificateRevocation(t *testing.T) {
+	config, err := newConfigFromBytes([]byte(MinimalConfigYaml))
+	if err != nil {
+		t.Fatalf("failed generating config: %v", err)
+	}
+	tlsConfig := newTLSConfig()
+	if err := tlsConfig.generateAllTLS(config); err != nil {
+		t.Fatalf("failed generating tls: %v", err)
+	}
+
+	caCert, err := tlsConfig.CACertificate()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	parseCRL := func() *pkix.CertificateList {
+		crl, err := x509.ParseCRL(tlsConfig.CRL.Bytes())
+		if err != nil {
+			t.Fatalf("failed parsing CRL: %v", err)
+		}
+		if err := caCert.CheckCRLSignature(crl); err != nil {
+			t.Errorf("CRL not signed by the CA: %v", err)
+		}
+		return crl
+	}
+	if crl := parseCRL(); len(crl.TBSCertList.RevokedCertificates) != 0 {
+		t.Errorf("expected an empty CRL, got %d entries", len(crl.TBSCertList.RevokedCertificates))
+	}
+
+	adminCert, err := tlsutil.DecodeCertificatePEM(tlsConfig.AdminCert.Bytes())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	revoked, err := tlsConfig.revoke(config, "admin")
+	if err != nil {
+		t.Fatalf("failed revoking admin certificate: %v", err)
+	}
+	if revoked.Name != "admin.pem" || revoked.SerialNumber != adminCert.SerialNumber.String() {
+		t.Errorf("unexpected revocation entry %+v", revoked)
+	}
+	if revoked, err := tlsConfig.revoke(config, "0x1f"); err != nil || revoked.SerialNumber != "31" {
+		t.Errorf("failed revoking by serial number: %+v %v", revoked, err)
+	}
+	crl := parseCRL()
+	if len(crl.TBSCertList.RevokedCertificates) != 2 || crl.TBSCertList.RevokedCertificates[0].SerialNumber.Cmp(adminCert.SerialNumber) != 0 {
+		t.Errorf("CRL does not list the revoked certificates: %+v", crl.TBSCertList.RevokedCertificates)
+	}
+
+	for _, certificate := range []string{"admin.pem", "31", "ca.pem", "0", "kube-admin"} {
+		if _, err := tlsConfig.revoke(config, certificate); err == nil {
+			t.Errorf("revoking %s did not fail", certificate)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "kube-aws-revocation")
+	if err != nil {
+		t.Fatalf("failed creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := tlsConfig.writeToFiles(dir); err != nil {
+		t.Fatalf("failed writing tls assets: %v", err)
+	}
+	readConfig := newTLSConfig()
+	if err := readConfig.readFromFiles(dir); err != nil {
+		t.Fatalf("failed reading tls assets: %v", err)
+	}
+	if len(readConfig.revoked) != 2 || !bytes.Equal(readConfig.CRL.Bytes(), tlsConfig.CRL.Bytes()) {
+		t.Errorf("revocation database or CRL lost in writing them out: %+v", readConfig.revoked)
+	}
+
+	for _, status := range readConfig.CertificateStatuses(0) {
+		if revoked := len(status.Problems) > 0 && strings.HasPrefix(status.Problems[0], "revoked"); revoked != (status.Name == "admin.pem") {
+			t.Errorf("unexpected problems for %s: %v", status.Name, status.Problems)
+		}
+	}
+}
+
+func TestParseSerialNumber(t *testing.T) {
+	for s, expected := range map[string]string{
+		"31":                  "31",
+		"0x1f":                "31",
+		"0X1F":                "31",
+		"serial=1F":           "31",
+		"serial=10":           "16",
+		"1f":                  "31",
+		"01:00":               "256",
+		"C0FFEE":              "12648430",
+		"9223372036854775807": "9223372036854775807",
+	} {
+		if serial, ok := parseSerialNumber(s); !ok || serial.String() != expected {
+			t.Errorf("serial number %s parsed as %v, expected %s", s, serial, expected)
+		}
+	}
+	for _, s := range []string{"", "serial=", "0x", "-31", "1_000", "admin", "1f:zz"} {
+		if serial, ok := parseSerialNumber(s); ok {
+			t.Errorf("invalid serial number %s parsed as %v", s, serial)
+		}
+	}
+}
+
+func TestIssueUserCertificate(t *testing.T) {
+	config, err := newConfigFromBytes([]byte(MinimalConfigYaml + "tls:\n  userValidityDays: 7\n"))
+	if err != nil {
+		t.Fatalf("failed generating config: %v", err)
+	}
+	if err := config.TLSConfig.generateAllTLS(config); err != nil {
+		t.Fatalf("failed generating tls: %v", err)
+	}
+
+	//credentials are written relative to the asset directory
+	dir, err := ioutil.TempDir("", "kube-aws-users")
+	if err != nil {
+		t.Fatalf("failed creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Mkdir(credentialsDir, 0700); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cert, err := config.IssueUserCertificate("alice@example.com", []string{"ops", "dev"})
+	if err != nil {
+		t.Fatalf("failed issuing user certificate: %v", err)
+	}
+	groups := append([]string{}, cert.Subject.Organization...)
+	sort.Strings(groups)
+	if cert.Subject.CommonName != "alice@example.com" || strings.Join(groups, ",") != "dev,ops" {
+		t.Errorf("unexpected user certificate subject %v", cert.Subject)
+	}
+	if validity := cert.NotAfter.Sub(time.Now()); validity > 7*24*time.Hour || validity < 6*24*time.Hour {
+		t.Errorf("user certificate valid for %s, expected tls.userValidityDays", validity)
+	}
+
+	kubeConfig, err := ioutil.ReadFile(credentialsDir + "/kubeconfig-alice@example.com")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, line := range []string{
+		"client-certificate: user-alice@example.com.pem",
+		"client-key: user-alice@example.com-key.pem",
+		"certificate-authority: ca.pem",
+		"user: kube-aws-test-cluster-name-alice@example.com",
+	} {
+		if !strings.Contains(string(kubeConfig), line) {
+			t.Errorf("kubeconfig lacks %q:\n%s", line, kubeConfig)
+		}
+	}
+
+	if _, err := config.IssueUserCertificate("alice@example.com", nil); err == nil {
+		t.Errorf("certificate issued twice for the same user")
+	}
+	for _, user := range []string{"", "../alice", "-alice"} {
+		if _, err := config.IssueUserCertificate(user, nil); err == nil {
+			t.Errorf("certificate issued for invalid user name %q", user)
+		}
+	}
+}
@@ -12,7 +12,18 @@ import (
 type UserDataConfig struct {
 	Controller *blobutil.NamedBuffer
 	Worker     *blobutil.NamedBuffer
+	Etcd       *blobutil.NamedBuffer
 	buffers    blobutil.NamedBufferList
+	// rendered holds the templated cloud-configs, with the worker
+	// cloud-config replaced by one per worker pool
+	rendered blobutil.NamedBufferList
+}
+
+// workerPoolTemplateData is what the worker cloud-config is templated with:
+// the cluster config, plus the worker pool being rendered
+type workerPoolTemplateData struct {
+	*Config
+	WorkerPool *WorkerPool
 }
 
 func newUserDataConfig() *UserDataConfig {
@@ -24,6 +35,9 @@ func newUserDataConfig() *UserDataConfig {
 		Worker: &blobutil.NamedBuffer{
 			Name: "cloud-config-worker",
 		},
+		Etcd: &blobutil.NamedBuffer{
+			Name: "cloud-config-etcd",
+		},
 	}
 
 	udc.buffers = blobutil.NamedBufferList{
@@ -34,27 +48,25 @@ func newUserDataConfig() *UserDataConfig {
 	return udc
 }
 
+// enableEtcd adds the cloud-config for dedicated etcd instances to the
+// managed assets. It is only rendered when the cluster has an etcd tier.
+func (udc *UserDataConfig) enableEtcd() {
+	udc.buffers = append(udc.buffers, udc.Etcd)
+}
+
 func (udc *UserDataConfig) generateDefaultConfigs() error {
-	defaultConfigs := []struct {
-		buffer          *blobutil.NamedBuffer
-		defaultTemplate string
-	}{
-		{
-			buffer:          udc.Controller,
-			defaultTemplate: cloudConfigControllerTemplate,
-		},
-		{
-			buffer:          udc.Worker,
-			defaultTemplate: cloudConfigWorkerTemplate,
-		},
+	defaultTemplates := map[*blobutil.NamedBuffer]string{
+		udc.Controller: cloudConfigControllerTemplate,
+		udc.Worker:     cloudConfigWorkerTemplate,
+		udc.Etcd:       cloudConfigEtcdTemplate,
 	}
 
-	for _, defaultConfig := range defaultConfigs {
-		in := bytes.NewBuffer([]byte(defaultConfig.defaultTemplate))
+	for _, buffer := range udc.buffers {
+		in := bytes.NewBuffer([]byte(defaultTemplates[buffer]))
 
-		if _, err := defaultConfig.buffer.ReadFrom(in); err != nil {
+		if _, err := buffer.ReadFrom(in); err != nil {
 			return fmt.Errorf("Error reading default config for %s : %v",
-				defaultConfig.buffer.Name,
+				buffer.Name,
 				err,
 			)
 		}
@@ -63,10 +75,42 @@ func (udc *UserDataConfig) generateDefaultConfigs() error {
 	return nil
 }
 
+// templateBuffers templates the cloud-configs with cfg. The worker
+// cloud-config is templated once for each worker pool into the pool's own
+// buffer, and is itself left untouched.
+func (udc *UserDataConfig) templateBuffers(cfg *Config) error {
+	udc.rendered = nil
+	for _, buffer := range udc.buffers {
+		if buffer == udc.Worker {
+			continue
+		}
+		if err := buffer.Template(cfg); err != nil {
+			return err
+		}
+		udc.rendered = append(udc.rendered, buffer)
+	}
+
+	for _, pool := range cfg.WorkerPools {
+		pool.UserData = &blobutil.NamedBuffer{Name: udc.Worker.Name}
+		if pool.Name != "" {
+			pool.UserData.Name += "-" + pool.Name
+		}
+		if _, err := pool.UserData.Write(udc.Worker.Bytes()); err != nil {
+			return err
+		}
+		if err := pool.UserData.Template(workerPoolTemplateData{cfg, pool}); err != nil {
+			return err
+		}
+		udc.rendered = append(udc.rendered, pool.UserData)
+	}
+
+	return nil
+}
+
 func (udc *UserDataConfig) validate() error {
 	errors := []string{}
 
-	for _, buffer := range udc.buffers {
+	for _, buffer := range udc.rendered {
 		report, err := validate.Validate(buffer.Bytes())
 
 		if err != nil {
@@ -1,32 +1,276 @@
 package config
 
 import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/coreos/coreos-kubernetes/multi-node/aws/pkg/blobutil"
 )
 
 func TestCloudConfigTemplating(t *testing.T) {
-	cfg, err := newConfigFromBytes([]byte(MinimalConfigYaml))
-	if err != nil {
-		t.Fatalf("Unable to load cluster config: %v", err)
+	workerPools := `
+kubernetesVersion: v1.6.1_coreos.0
+workerPools:
+  - name: compute
+    nodeLabels:
+      pool: compute
+    taints:
+      - dedicated=compute:NoSchedule
+`
+	for _, extraConfig := range []string{"", "etcdCount: 3\n", workerPools, "kubernetesVersion: v1.7.0_coreos.0\nclusterAutoscaler: true\n"} {
+		cfg, err := newConfigFromBytes([]byte(MinimalConfigYaml + extraConfig))
+		if err != nil {
+			t.Fatalf("Unable to load cluster config: %v", err)
+		}
+
+		if err := cfg.GenerateDefaultAssets(); err != nil {
+			t.Fatalf("Error reading assets from files: %v", err)
+		}
+
+		//Template and encode tls assets
+		if err := cfg.TLSConfig.buffers.TemplateBuffers(cfg); err != nil {
+			t.Fatalf("Failed generating TLS assets: %v", err)
+		}
+		if err := cfg.TLSConfig.buffers.EncodeBuffers(); err != nil {
+			t.Fatalf("Failed encoding TLS assets: %v", err)
+		}
+
+		if err := cfg.UserData.templateBuffers(cfg); err != nil {
+			t.Fatalf("Failed templating userdata assets: %v", err)
+		}
+
+		if err := cfg.UserData.validate(); err != nil {
+			t.Fatalf("Invalid userdata : %v\n%s", err, extraConfig)
+		}
+
+		//service account tokens are not signed with the apiserver's TLS key
+		if !strings.Contains(cfg.UserData.Controller.String(), "--service-account-key-file=/etc/kubernetes/ssl/service-account-key.pem") {
+			t.Errorf("service account tokens are not verified with service-account-key.pem\n%s", extraConfig)
+		}
+
+		//podmaster copies them over on the elected controller only
+		for _, manifest := range []string{"kube-controller-manager.yaml", "kube-scheduler.yaml"} {
+			if !strings.Contains(cfg.UserData.Controller.String(), "path: /srv/kubernetes/manifests/"+manifest) {
+				t.Errorf("%s is not left to podmaster to run\n%s", manifest, extraConfig)
+			}
+		}
 	}
+}
 
-	if err := cfg.GenerateDefaultAssets(); err != nil {
-		t.Fatalf("Error reading assets from files: %v", err)
+func TestWorkerSignerRejectsForgedIdentity(t *testing.T) {
+	for _, tool := range []string{"bash", "openssl", "base64", "flock"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
 	}
 
-	//Template and encode tls assets
-	if err := cfg.TLSConfig.buffers.TemplateBuffers(cfg); err != nil {
-		t.Fatalf("Failed generating TLS assets: %v", err)
+	dir, err := ioutil.TempDir("", "kube-aws-worker-signer")
+	if err != nil {
+		t.Fatalf("failed creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	openssl := func(args ...string) {
+		if out, err := exec.Command("openssl", args...).CombinedOutput(); err != nil {
+			t.Fatalf("openssl %s failed: %v\n%s", args[0], err, out)
+		}
+	}
+	//the AWS certificate the signer trusts, and one forging its signature
+	for _, name := range []string{"identity", "forged"} {
+		openssl("req", "-x509", "-newkey", "rsa:2048", "-nodes", "-days", "1", "-subj", "/CN="+name,
+			"-keyout", path(name+"-key.pem"), "-out", path(name+".pem"))
+	}
+	identityCert, err := ioutil.ReadFile(path("identity.pem"))
+	if err != nil {
+		t.Fatalf("%v", err)
 	}
-	if err := cfg.TLSConfig.buffers.EncodeBuffers(); err != nil {
-		t.Fatalf("Failed encoding TLS assets: %v", err)
+	openssl("req", "-new", "-newkey", "rsa:2048", "-nodes", "-subj", "/CN=kube-worker",
+		"-keyout", path("worker-key.pem"), "-out", path("worker.csr"))
+	csr, err := ioutil.ReadFile(path("worker.csr"))
+	if err != nil {
+		t.Fatalf("%v", err)
 	}
 
-	if err := cfg.UserData.buffers.TemplateBuffers(cfg); err != nil {
+	cfg, err := newConfigFromBytes([]byte(MinimalConfigYaml + "tls:\n  perNodeWorkerCertificates: true\n  instanceIdentityCertificate: |\n    " +
+		strings.Replace(strings.TrimSpace(string(identityCert)), "\n", "\n    ", -1) + "\n  kmsKeyARN: " + testKMSKeyARN + "\n"))
+	if err != nil {
+		t.Fatalf("Unable to load cluster config: %v", err)
+	}
+	if err := cfg.GenerateDefaultAssets(); err != nil {
+		t.Fatalf("Error generating assets: %v", err)
+	}
+	//the signer works with the CA's chain and the decrypted key, which
+	//are written to dir before the buffers are encoded
+	tc := cfg.TLSConfig
+	for name, buf := range map[string]*blobutil.NamedBuffer{"ca.pem": tc.WorkerSignerCACert, "ca-key.pem": tc.WorkerSignerCAKey} {
+		if err := ioutil.WriteFile(path(name), buf.Bytes(), 0600); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	caCert, err := tc.CACertificate()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	tc.WorkerSignerCAKeyCiphertext.WriteString("kms-ciphertext")
+	for _, bufs := range []blobutil.NamedBufferList{tc.buffers, {tc.WorkerSignerCACert, tc.WorkerSignerCAKeyCiphertext}} {
+		if err := bufs.TemplateBuffers(cfg); err != nil {
+			t.Fatalf("Failed generating TLS assets: %v", err)
+		}
+		if err := bufs.EncodeBuffers(); err != nil {
+			t.Fatalf("Failed encoding TLS assets: %v", err)
+		}
+	}
+	if err := cfg.UserData.templateBuffers(cfg); err != nil {
 		t.Fatalf("Failed templating userdata assets: %v", err)
 	}
 
 	if err := cfg.UserData.validate(); err != nil {
 		t.Fatalf("Invalid userdata : %v", err)
 	}
+
+	cloudConfig := struct {
+		WriteFiles []struct {
+			Path    string `yaml:"path"`
+			Content string `yaml:"content"`
+		} `yaml:"write_files"`
+	}{}
+	if err := yaml.Unmarshal(cfg.UserData.Controller.Bytes(), &cloudConfig); err != nil {
+		t.Fatalf("Failed parsing controller cloud-config: %v", err)
+	}
+	files := map[string]string{}
+	for _, file := range cloudConfig.WriteFiles {
+		files[file.Path] = file.Content
+	}
+	script, opensslConfig := files["/opt/bin/kube-worker-signer"], files["/etc/kubernetes/worker-signer/openssl.cnf"]
+	if script == "" || opensslConfig == "" {
+		t.Fatalf("controller cloud-config lacks the worker signer")
+	}
+	if _, ok := files["/etc/kubernetes/worker-signer/ca-key.pem"]; ok {
+		t.Errorf("controller cloud-config carries the worker signer key")
+	}
+	//run the signer against the certificates and key written to dir, a
+	//metadata service answering with own-document, and an AWS CLI placing
+	//the instance in the auto scaling group named in asg, of the stack
+	//named in stack
+	for _, dirs := range [][2]string{
+		{"/var/lib/kube-worker-signer", path("state")},
+		{"/etc/kubernetes/worker-signer", dir},
+		{"/run/kube-worker-signer", dir},
+	} {
+		script = strings.Replace(script, dirs[0], dirs[1], -1)
+		opensslConfig = strings.Replace(opensslConfig, dirs[0], dirs[1], -1)
+	}
+	if err := os.Mkdir(path("bin"), 0700); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for name, content := range map[string]string{
+		"bin/kube-worker-signer": script,
+		"bin/curl":               "#!/bin/bash\ncat " + path("own-document") + "\n",
+		"bin/docker": "#!/bin/bash\ncase \"$*\" in\n" +
+			"  *describe-auto-scaling-instances*--instance-ids\\ i-0123456789*) cat " + path("asg") + " ;;\n" +
+			"  *describe-tags*Values=$(cat " + path("asg") + ")\\ *aws:cloudformation:stack-name*) cat " + path("stack") + " ;;\n" +
+			"esac\n",
+		"openssl.cnf":           opensslConfig,
+		"instance-identity.pem": string(identityCert),
+		"document":              `{"accountId" : "111122223333", "region" : "us-west-1", "privateIp" : "10.0.0.100", "instanceId" : "i-0123456789"}`,
+	} {
+		if err := ioutil.WriteFile(path(name), []byte(content), 0700); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	sign := func(signer, ownAccount, asg, stack string) (string, string, error) {
+		for name, content := range map[string]string{
+			"own-document": `{"accountId" : "` + ownAccount + `", "region" : "us-west-1"}`,
+			"asg":          asg,
+			"stack":        stack,
+		} {
+			if err := ioutil.WriteFile(path(name), []byte(content), 0600); err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+		openssl("smime", "-sign", "-binary", "-in", path("document"), "-signer", path(signer+".pem"),
+			"-inkey", path(signer+"-key.pem"), "-outform", "PEM", "-out", path(signer+".p7"))
+		p7, err := ioutil.ReadFile(path(signer + ".p7"))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		document, err := ioutil.ReadFile(path("document"))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		//the metadata service serves the signature without PEM armor
+		lines := strings.Split(strings.TrimSpace(string(p7)), "\n")
+		pkcs7 := strings.Join(lines[1:len(lines)-1], "\n")
+
+		cmd := exec.Command(path("bin/kube-worker-signer"))
+		cmd.Env = append(os.Environ(), "PATH="+path("bin")+":"+os.Getenv("PATH"), "REMOTE_ADDR=10.0.0.100")
+		cmd.Stdin = strings.NewReader(base64.StdEncoding.EncodeToString(document) + "\n" +
+			base64.StdEncoding.EncodeToString([]byte(pkcs7)) + "\n" +
+			base64.StdEncoding.EncodeToString(csr) + "\n")
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+		err = cmd.Run()
+		return stdout.String(), stderr.String(), err
+	}
+
+	for _, request := range []struct {
+		signer, ownAccount, asg, stack, problem string
+	}{
+		{"forged", "111122223333", "", "", "signature is invalid"},
+		//a genuine signature gets past the check, to fail on the account
+		{"identity", "999999999999", "", "", "another account"},
+		{"identity", "111122223333", "", "", "not in an auto scaling group"},
+		{"identity", "111122223333", "other-workers", "other-cluster", "does not belong to this cluster"},
+	} {
+		if out, problem, err := sign(request.signer, request.ownAccount, request.asg, request.stack); err == nil || !strings.Contains(problem, request.problem) {
+			t.Errorf("signer did not refuse a request with %q:\n%s%s", request.problem, out, problem)
+		}
+	}
+
+	out, problem, err := sign("identity", "111122223333", "test-cluster-name-AutoScaleWorker-1", cfg.ClusterName)
+	if err != nil {
+		t.Fatalf("signer refused a worker of the cluster: %v\n%s", err, problem)
+	}
+	chain := []*x509.Certificate{}
+	for rest := []byte(out); ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatalf("failed parsing signed certificate: %v", err)
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) != 3 {
+		t.Fatalf("expected the worker certificate, the worker signer CA and the CA, got %d certificates:\n%s", len(chain), out)
+	}
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	roots.AddCert(caCert)
+	intermediates.AddCert(chain[1])
+	if _, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       "ip-10-0-0-100.us-west-1.compute.internal",
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		t.Errorf("worker certificate does not chain to the CA: %v", err)
+	}
+	if chain[0].NotAfter.After(chain[1].NotAfter) {
+		t.Errorf("worker certificate expires on %s, after the worker signer CA", chain[0].NotAfter)
+	}
 }
@@ -0,0 +1,67 @@
+package tlsutil
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+)
+
+const (
+	KeyAlgorithmRSA2048   = "rsa-2048"
+	KeyAlgorithmRSA3072   = "rsa-3072"
+	KeyAlgorithmRSA4096   = "rsa-4096"
+	KeyAlgorithmECDSAP256 = "ecdsa-p256"
+	KeyAlgorithmECDSAP384 = "ecdsa-p384"
+
+	DefaultKeyAlgorithm = KeyAlgorithmRSA2048
+)
+
+var KeyAlgorithms = []string{
+	KeyAlgorithmRSA2048,
+	KeyAlgorithmRSA3072,
+	KeyAlgorithmRSA4096,
+	KeyAlgorithmECDSAP256,
+	KeyAlgorithmECDSAP384,
+}
+
+func NewPrivateKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case KeyAlgorithmRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyAlgorithmRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case KeyAlgorithmRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyAlgorithmECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyAlgorithmECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	}
+	return nil, fmt.Errorf("unknown key algorithm %q", algorithm)
+}
+
+// KeyMatchesCertificate reports whether key is the private key of cert.
+func KeyMatchesCertificate(key crypto.Signer, cert *x509.Certificate) bool {
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		certPub, ok := cert.PublicKey.(*rsa.PublicKey)
+		return ok && certPub.N.Cmp(pub.N) == 0 && certPub.E == pub.E
+	case *ecdsa.PublicKey:
+		certPub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+		return ok && certPub.Curve == pub.Curve && certPub.X.Cmp(pub.X) == 0 && certPub.Y.Cmp(pub.Y) == 0
+	}
+	return false
+}
+
+// keyUsage returns the key usages of a certificate for pub. Only RSA keys
+// encipher keys, ECDSA keys are limited to signatures.
+func keyUsage(pub crypto.PublicKey) x509.KeyUsage {
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		return x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+	}
+	return x509.KeyUsageDigitalSignature
+}
@@ -1,16 +1,38 @@
 package tlsutil
 
 import (
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
 )
 
-func WritePrivateKeyPEMBlock(out io.Writer, key *rsa.PrivateKey) error {
-	block := pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
+// WritePrivateKeyPEMBlock writes RSA keys as PKCS#1 and ECDSA keys as
+// SEC 1, which older consumers such as Kubernetes' service account key
+// loader expect, rather than as PKCS#8.
+func WritePrivateKeyPEMBlock(out io.Writer, key crypto.Signer) error {
+	var block pem.Block
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		block = pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		}
+	case *ecdsa.PrivateKey:
+		keyBytes, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		block = pem.Block{
+			Type:  "EC PRIVATE KEY",
+			Bytes: keyBytes,
+		}
+	default:
+		return fmt.Errorf("unsupported private key type %T", key)
 	}
 	return pem.Encode(out, &block)
 }
@@ -22,3 +44,78 @@ func WriteCertificatePEMBlock(out io.Writer, cert *x509.Certificate) error {
 	}
 	return pem.Encode(out, &block)
 }
+
+func WriteCertificateRequestPEMBlock(out io.Writer, csr *x509.CertificateRequest) error {
+	block := pem.Block{
+		Type:  "CERTIFICATE REQUEST",
+		Bytes: csr.Raw,
+	}
+	return pem.Encode(out, &block)
+}
+
+func WriteCRLPEMBlock(out io.Writer, crlDERBytes []byte) error {
+	block := pem.Block{
+		Type:  "X509 CRL",
+		Bytes: crlDERBytes,
+	}
+	return pem.Encode(out, &block)
+}
+
+func DecodePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	}
+	return nil, fmt.Errorf("expected PEM block of type RSA PRIVATE KEY, EC PRIVATE KEY or PRIVATE KEY, got %s", block.Type)
+}
+
+func DecodeCertificatePEM(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("expected PEM block of type CERTIFICATE, got %s", block.Type)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// DecodeCertificatesPEM decodes every certificate in data, in order.
+func DecodeCertificatesPEM(data []byte) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("expected PEM block of type CERTIFICATE, got %s", block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no PEM data found")
+	}
+	return certs, nil
+}
@@ -1,8 +1,8 @@
 package tlsutil
 
 import (
+	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"math"
@@ -16,36 +16,101 @@ var (
 	Duration365d = time.Hour * 24 * 365
 )
 
+// Subject holds the distinguished name fields, other than the common name,
+// of a CA. The certificates it signs inherit them.
+type Subject struct {
+	Organization       string
+	OrganizationalUnit string
+	Country            string
+	Province           string
+	Locality           string
+}
+
+func (s Subject) name(commonName string) pkix.Name {
+	return pkix.Name{
+		CommonName:         commonName,
+		Organization:       nonEmpty(s.Organization),
+		OrganizationalUnit: nonEmpty(s.OrganizationalUnit),
+		Country:            nonEmpty(s.Country),
+		Province:           nonEmpty(s.Province),
+		Locality:           nonEmpty(s.Locality),
+	}
+}
+
+func nonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
+
+// CACertConfig describes a self-signed CA, valid for Duration365d unless
+// Duration is set.
 type CACertConfig struct {
-	CommonName   string
-	Organization string
+	CommonName string
+	Subject
+	Duration time.Duration
+}
+
+// IntermediateCACertConfig describes a CA signed by another, valid for
+// Duration90d unless Duration is set. It may only sign end-entity
+// certificates for ExtKeyUsages, whose names are within PermittedDNSDomains
+// and whose IPs are within PermittedIPRanges, given as CIDRs.
+type IntermediateCACertConfig struct {
+	CommonName          string
+	ExtKeyUsages        []x509.ExtKeyUsage
+	PermittedDNSDomains []string
+	PermittedIPRanges   []string
+	Duration            time.Duration
 }
 
+// ServerCertConfig, ClientCertConfig and PeerCertConfig describe
+// certificates valid for Duration90d unless Duration is set.
 type ServerCertConfig struct {
 	CommonName  string
 	DNSNames    []string
 	IPAddresses []string
+	Duration    time.Duration
 }
 
+// ClientCertConfig certificates inherit the organization of the CA, unless
+// Organizations is set. Kubernetes takes them to be the client's groups.
 type ClientCertConfig struct {
+	CommonName    string
+	Organizations []string
+	DNSNames      []string
+	IPAddresses   []string
+	Duration      time.Duration
+}
+
+// PeerCertConfig describes a certificate used both to serve and to
+// authenticate as a client, as etcd members do towards each other.
+type PeerCertConfig struct {
 	CommonName  string
 	DNSNames    []string
 	IPAddresses []string
+	Duration    time.Duration
+}
+
+// CertificateRequestConfig describes a certificate to be signed by a
+// CA outside of kube-aws.
+type CertificateRequestConfig struct {
+	CommonName string
+	Subject
+	DNSNames    []string
+	IPAddresses []string
 }
 
-func NewSelfSignedCACertificate(cfg CACertConfig, key *rsa.PrivateKey) (*x509.Certificate, error) {
+func NewSelfSignedCACertificate(cfg CACertConfig, key crypto.Signer) (*x509.Certificate, error) {
 	now := time.Now()
 	tmpl := x509.Certificate{
-		SerialNumber: new(big.Int).SetInt64(0),
-		Subject: pkix.Name{
-			CommonName:   cfg.CommonName,
-			Organization: []string{cfg.Organization},
-		},
+		SerialNumber:          new(big.Int).SetInt64(0),
+		Subject:               cfg.Subject.name(cfg.CommonName),
 		NotBefore:             now.UTC(),
-		NotAfter:              now.Add(Duration365d).UTC(),
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		NotAfter:              now.Add(durationOr(cfg.Duration, Duration365d)).UTC(),
+		KeyUsage:              keyUsage(key.Public()) | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		BasicConstraintsValid: true,
-		IsCA: true,
+		IsCA:                  true,
 	}
 
 	certDERBytes, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, key.Public(), key)
@@ -55,7 +120,43 @@ func NewSelfSignedCACertificate(cfg CACertConfig, key *rsa.PrivateKey) (*x509.Ce
 	return x509.ParseCertificate(certDERBytes)
 }
 
-func NewSignedServerCertificate(cfg ServerCertConfig, key *rsa.PrivateKey, caCert *x509.Certificate, caKey *rsa.PrivateKey) (*x509.Certificate, error) {
+func NewSignedIntermediateCACertificate(cfg IntermediateCACertConfig, key crypto.Signer, caCert *x509.Certificate, caKey crypto.Signer) (*x509.Certificate, error) {
+	ipRanges := make([]*net.IPNet, len(cfg.PermittedIPRanges))
+	for i, cidr := range cfg.PermittedIPRanges {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		ipRanges[i] = ipNet
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).SetInt64(math.MaxInt64))
+	if err != nil {
+		return nil, err
+	}
+
+	certTmpl := x509.Certificate{
+		Subject:                     leafSubject(cfg.CommonName, caCert),
+		SerialNumber:                serial,
+		NotBefore:                   caCert.NotBefore,
+		NotAfter:                    time.Now().Add(durationOr(cfg.Duration, Duration90d)).UTC(),
+		KeyUsage:                    x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		ExtKeyUsage:                 cfg.ExtKeyUsages,
+		BasicConstraintsValid:       true,
+		IsCA:                        true,
+		MaxPathLenZero:              true,
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         cfg.PermittedDNSDomains,
+		PermittedIPRanges:           ipRanges,
+	}
+	certDERBytes, err := x509.CreateCertificate(rand.Reader, &certTmpl, caCert, key.Public(), caKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(certDERBytes)
+}
+
+func NewSignedServerCertificate(cfg ServerCertConfig, key crypto.Signer, caCert *x509.Certificate, caKey crypto.Signer) (*x509.Certificate, error) {
 	ips := make([]net.IP, len(cfg.IPAddresses))
 	for i, ipStr := range cfg.IPAddresses {
 		ips[i] = net.ParseIP(ipStr)
@@ -67,16 +168,13 @@ func NewSignedServerCertificate(cfg ServerCertConfig, key *rsa.PrivateKey, caCer
 	}
 
 	certTmpl := x509.Certificate{
-		Subject: pkix.Name{
-			CommonName:   cfg.CommonName,
-			Organization: caCert.Subject.Organization,
-		},
+		Subject:      leafSubject(cfg.CommonName, caCert),
 		DNSNames:     cfg.DNSNames,
 		IPAddresses:  ips,
 		SerialNumber: serial,
 		NotBefore:    caCert.NotBefore,
-		NotAfter:     time.Now().Add(Duration90d).UTC(),
-		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		NotAfter:     time.Now().Add(durationOr(cfg.Duration, Duration90d)).UTC(),
+		KeyUsage:     keyUsage(key.Public()),
 		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 	}
 	certDERBytes, err := x509.CreateCertificate(rand.Reader, &certTmpl, caCert, key.Public(), caKey)
@@ -86,7 +184,7 @@ func NewSignedServerCertificate(cfg ServerCertConfig, key *rsa.PrivateKey, caCer
 	return x509.ParseCertificate(certDERBytes)
 }
 
-func NewSignedClientCertificate(cfg ClientCertConfig, key *rsa.PrivateKey, caCert *x509.Certificate, caKey *rsa.PrivateKey) (*x509.Certificate, error) {
+func NewSignedClientCertificate(cfg ClientCertConfig, key crypto.Signer, caCert *x509.Certificate, caKey crypto.Signer) (*x509.Certificate, error) {
 	ips := make([]net.IP, len(cfg.IPAddresses))
 	for i, ipStr := range cfg.IPAddresses {
 		ips[i] = net.ParseIP(ipStr)
@@ -97,17 +195,19 @@ func NewSignedClientCertificate(cfg ClientCertConfig, key *rsa.PrivateKey, caCer
 		return nil, err
 	}
 
+	subject := leafSubject(cfg.CommonName, caCert)
+	if len(cfg.Organizations) > 0 {
+		subject.Organization = cfg.Organizations
+	}
+
 	certTmpl := x509.Certificate{
-		Subject: pkix.Name{
-			CommonName:   cfg.CommonName,
-			Organization: caCert.Subject.Organization,
-		},
+		Subject:      subject,
 		DNSNames:     cfg.DNSNames,
 		IPAddresses:  ips,
 		SerialNumber: serial,
 		NotBefore:    caCert.NotBefore,
-		NotAfter:     time.Now().Add(Duration90d).UTC(),
-		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		NotAfter:     time.Now().Add(durationOr(cfg.Duration, Duration90d)).UTC(),
+		KeyUsage:     keyUsage(key.Public()),
 		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
 	}
 	certDERBytes, err := x509.CreateCertificate(rand.Reader, &certTmpl, caCert, key.Public(), caKey)
@@ -116,3 +216,74 @@ func NewSignedClientCertificate(cfg ClientCertConfig, key *rsa.PrivateKey, caCer
 	}
 	return x509.ParseCertificate(certDERBytes)
 }
+
+func NewSignedPeerCertificate(cfg PeerCertConfig, key crypto.Signer, caCert *x509.Certificate, caKey crypto.Signer) (*x509.Certificate, error) {
+	ips := make([]net.IP, len(cfg.IPAddresses))
+	for i, ipStr := range cfg.IPAddresses {
+		ips[i] = net.ParseIP(ipStr)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).SetInt64(math.MaxInt64))
+	if err != nil {
+		return nil, err
+	}
+
+	certTmpl := x509.Certificate{
+		Subject:      leafSubject(cfg.CommonName, caCert),
+		DNSNames:     cfg.DNSNames,
+		IPAddresses:  ips,
+		SerialNumber: serial,
+		NotBefore:    caCert.NotBefore,
+		NotAfter:     time.Now().Add(durationOr(cfg.Duration, Duration90d)).UTC(),
+		KeyUsage:     keyUsage(key.Public()),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	certDERBytes, err := x509.CreateCertificate(rand.Reader, &certTmpl, caCert, key.Public(), caKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(certDERBytes)
+}
+
+func NewCertificateRequest(cfg CertificateRequestConfig, key crypto.Signer) (*x509.CertificateRequest, error) {
+	ips := make([]net.IP, len(cfg.IPAddresses))
+	for i, ipStr := range cfg.IPAddresses {
+		ips[i] = net.ParseIP(ipStr)
+	}
+
+	tmpl := x509.CertificateRequest{
+		Subject:     cfg.Subject.name(cfg.CommonName),
+		DNSNames:    cfg.DNSNames,
+		IPAddresses: ips,
+	}
+	csrDERBytes, err := x509.CreateCertificateRequest(rand.Reader, &tmpl, key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificateRequest(csrDERBytes)
+}
+
+// NewSignedCRL returns a certificate revocation list of revoked, signed by
+// the CA and valid for Duration90d unless duration is set.
+func NewSignedCRL(revoked []pkix.RevokedCertificate, duration time.Duration, caCert *x509.Certificate, caKey crypto.Signer) ([]byte, error) {
+	now := time.Now()
+	return caCert.CreateCRL(rand.Reader, caKey, revoked, now.UTC(), now.Add(durationOr(duration, Duration90d)).UTC())
+}
+
+func leafSubject(commonName string, caCert *x509.Certificate) pkix.Name {
+	return pkix.Name{
+		CommonName:         commonName,
+		Organization:       caCert.Subject.Organization,
+		OrganizationalUnit: caCert.Subject.OrganizationalUnit,
+		Country:            caCert.Subject.Country,
+		Province:           caCert.Subject.Province,
+		Locality:           caCert.Subject.Locality,
+	}
+}
+
+func durationOr(d, fallback time.Duration) time.Duration {
+	if d == 0 {
+		return fallback
+	}
+	return d
+}